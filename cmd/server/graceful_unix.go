@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/mylxsw/graceful"
+)
+
+// newGraceful SIGHUP、SIGUSR2 重新加载配置，其它信号停止服务
+func newGraceful() graceful.Graceful {
+	return graceful.NewWithSignal(
+		[]os.Signal{syscall.SIGHUP, syscall.SIGUSR2},
+		[]os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT},
+		15*time.Second,
+	)
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mylxsw/graceful"
+)
+
+// newGraceful Windows 不支持通过信号重新加载配置，可以开启 watch_config 监听配置文件的变化
+func newGraceful() graceful.Graceful {
+	return graceful.NewWithDefault(15 * time.Second)
+}
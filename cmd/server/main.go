@@ -12,11 +12,18 @@ import (
 	"github.com/mylxsw/asteria/writer"
 	"github.com/mylxsw/glacier/infra"
 	"github.com/mylxsw/glacier/starter/application"
+	"github.com/mylxsw/webdav-server/internal/auth/htpasswd"
 	"github.com/mylxsw/webdav-server/internal/auth/ldap"
 	"github.com/mylxsw/webdav-server/internal/auth/local"
 	"github.com/mylxsw/webdav-server/internal/auth/misc"
 	"github.com/mylxsw/webdav-server/internal/auth/none"
 	"github.com/mylxsw/webdav-server/internal/cache/memory"
+	"github.com/mylxsw/webdav-server/internal/link"
+	lockBolt "github.com/mylxsw/webdav-server/internal/lock/bolt"
+	lockMemory "github.com/mylxsw/webdav-server/internal/lock/memory"
+	lockRedis "github.com/mylxsw/webdav-server/internal/lock/redis"
+	"github.com/mylxsw/webdav-server/internal/props"
+	"github.com/mylxsw/webdav-server/internal/quota"
 	"github.com/mylxsw/webdav-server/internal/server"
 	"github.com/mylxsw/webdav-server/internal/service"
 )
@@ -28,6 +35,7 @@ func main() {
 	log.All().LogFormatter(formatter.NewJSONFormatter())
 
 	app := application.Create(fmt.Sprintf("%s %s", Version, GitCommit))
+	app.Graceful(newGraceful)
 
 	app.AddStringFlag("conf", "webdav-server.yaml", "服务器配置文件")
 	app.Singleton(func(c infra.FlagContext) (*config.Config, error) {
@@ -45,8 +53,10 @@ func main() {
 	})
 
 	app.Provider(server.Provider{}, service.Provider{})
-	app.Provider(ldap.Provider{}, none.Provider{}, local.Provider{}, misc.Provider{})
+	app.Provider(ldap.Provider{}, none.Provider{}, local.Provider{}, misc.Provider{}, htpasswd.Provider{})
 	app.Provider(memory.Provider{}, config.Provider{})
+	app.Provider(lockMemory.Provider{}, lockBolt.Provider{}, lockRedis.Provider{})
+	app.Provider(props.Provider{}, quota.Provider{}, link.Provider{})
 
 	application.MustRun(app)
 }
@@ -1,22 +1,49 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"flag"
+	"fmt"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/auth/htpasswd"
 	"github.com/mylxsw/webdav-server/internal/auth/ldap"
+	"github.com/mylxsw/webdav-server/internal/auth/local"
+	"github.com/mylxsw/webdav-server/internal/auth/misc"
+	"github.com/mylxsw/webdav-server/internal/auth/none"
+	"github.com/mylxsw/webdav-server/internal/auth/password"
 	"github.com/mylxsw/webdav-server/internal/config"
-	"io/ioutil"
+	"github.com/mylxsw/webdav-server/internal/props"
+	"github.com/mylxsw/webdav-server/internal/quota"
+	"github.com/mylxsw/webdav-server/internal/server"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/mylxsw/asteria/log"
-	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/yaml.v2"
 )
 
 func main() {
-	var action, configPath string
+	var action, configPath, shareName, account, id string
+	var username, method, requestPath, destination string
+	var format, paths string
+	var name, groups string
+	var passwordStdin bool
 
-	flag.StringVar(&action, "action", "", "执行的动作，支持 encrypt|ldap-users")
-	flag.StringVar(&configPath, "config", "./webdav-server.yaml", "要加密的配置文件路径")
+	flag.StringVar(&action, "action", "", "执行的动作，支持 encrypt|ldap-users|trash-list|trash-restore|trash-purge|validate|check-access|access-matrix|user-list|user-add|user-del|user-passwd|user-set-groups")
+	flag.StringVar(&configPath, "config", "./webdav-server.yaml", "配置文件路径")
+	flag.StringVar(&shareName, "share", "", "回收站所属的共享名称，只有一个共享时可以省略")
+	flag.StringVar(&account, "account", "", "user-* 操作的用户账号；trash-* 只操作该用户删除的文件，为空时操作所有用户")
+	flag.StringVar(&id, "id", "", "回收站中文件的 ID，trash-purge 未指定时清空回收站")
+	flag.StringVar(&username, "user", "", "check-access 检查的用户账号")
+	flag.StringVar(&method, "method", "GET", "check-access 检查的 WebDAV 方法，如 GET、PUT、MOVE")
+	flag.StringVar(&requestPath, "path", "", "check-access 检查的请求路径（包含共享的前缀），如 /builds/app/v1")
+	flag.StringVar(&destination, "destination", "", "check-access 检查 COPY、MOVE 时的目标路径")
+	flag.StringVar(&format, "format", "markdown", "access-matrix 的输出格式，支持 csv|json|markdown")
+	flag.StringVar(&paths, "paths", "", "access-matrix 检查的路径（包含共享的前缀，目录以 / 结尾），多个路径使用逗号分隔，为空时检查每个共享的根目录及其第一级文件和目录")
+	flag.StringVar(&name, "name", "", "user-add 添加的用户名称")
+	flag.StringVar(&groups, "groups", "", "user-add、user-set-groups 设置的用户组，多个用户组使用逗号分隔")
+	flag.BoolVar(&passwordStdin, "password-stdin", false, "user-add、user-passwd 从标准输入读取密码，默认从终端读取")
 	flag.Parse()
 
 	switch action {
@@ -24,9 +51,203 @@ func main() {
 		encryptConfigFile(configPath)
 	case "ldap-users":
 		listLDAPUsers(configPath)
+	case "trash-list", "trash-restore", "trash-purge":
+		manageTrash(configPath, action, shareName, account, id)
+	case "validate":
+		validateConfigFile(configPath)
+	case "check-access":
+		checkAccess(configPath, username, method, requestPath, destination)
+	case "access-matrix":
+		printAccessMatrix(configPath, format, paths)
+	case "user-list", "user-add", "user-del", "user-passwd", "user-set-groups":
+		manageUsers(configPath, action, account, name, groups, passwordStdin)
 	}
 }
 
+// validateConfigFile 检查配置文件，配置不合法或者存在警告（未知的配置项、重叠以及被覆盖的规则等）时以状态码 1 退出
+func validateConfigFile(configPath string) {
+	warnings, err := config.Check(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		os.Exit(1)
+	}
+
+	for _, warning := range warnings {
+		fmt.Printf("%s: warning: %s\n", configPath, warning)
+	}
+
+	if len(warnings) > 0 {
+		fmt.Printf("%s: %d warning(s)\n", configPath, len(warnings))
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s: ok\n", configPath)
+}
+
+// checkAccess 使用与服务端相同的逻辑检查用户对路径执行 WebDAV 方法的权限，输出每一项权限检查的结果以及做出决定的规则，
+// 被拒绝时以状态码 1 退出
+func checkAccess(configPath string, username string, method string, requestPath string, destination string) {
+	if username == "" || requestPath == "" {
+		fmt.Fprintln(os.Stderr, "-user and -path are required for check-access")
+		os.Exit(2)
+	}
+
+	conf, err := config.LoadConfFromFile(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		os.Exit(2)
+	}
+
+	user, err := newAuthor(conf).GetUser(username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "get user %s failed: %v\n", username, err)
+		os.Exit(2)
+	}
+
+	method = strings.ToUpper(method)
+	share, decisions, allowed, err := server.ExplainAccess(conf, user, method, requestPath, destination)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check access failed: %v\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("user:   %s (groups: %s)\n", user.Account, strings.Join(user.Groups, ", "))
+	fmt.Printf("share:  %s (prefix %s, access_mode %s)\n", share.Name, share.Prefix, share.AccessMode)
+	fmt.Printf("method: %s %s\n", method, requestPath)
+
+	for _, decision := range decisions {
+		result := "allowed"
+		if !decision.Allowed {
+			result = "denied"
+		}
+
+		fmt.Printf("  %-7s %s requires %s, granted %s, decided by %s\n", result, decision.Path, decision.Required, decision.Granted, decision.Rule)
+	}
+
+	if !allowed {
+		fmt.Println("result: denied (403 access denied)")
+		os.Exit(1)
+	}
+
+	fmt.Println("result: allowed")
+}
+
+// newAuthor 按照配置中的 auth_type 创建用户认证
+func newAuthor(conf *config.Config) auth.Author {
+	switch conf.AuthType {
+	case "local":
+		return local.New(conf)
+	case "ldap":
+		return ldap.New(&conf.LDAP, &conf.Users)
+	case "misc":
+		return misc.New(conf)
+	case "htpasswd":
+		return htpasswd.New(conf)
+	}
+
+	return none.New()
+}
+
+// manageTrash 直接操作共享目录中的回收站，恢复或者删除文件时同时更新 dead property 以及配额用量数据库
+//
+// 服务运行时这些数据库被服务独占，无法打开时命令失败，服务运行时使用 /.webdav/api/trash 接口
+func manageTrash(configPath string, action string, shareName string, account string, id string) {
+	conf, err := config.LoadConfFromFile(configPath)
+	if err != nil {
+		panic(err)
+	}
+
+	propsStore, quotaManager := props.NewNopStore(), quota.NewNopManager()
+	if action != "trash-list" {
+		if propsStore, quotaManager, err = openTrashStores(conf); err != nil {
+			log.Errorf("open data dir failed, stop the server or use the trash api instead: %v", err)
+			return
+		}
+	}
+
+	var share *config.Share
+	for i := range conf.Shares {
+		if conf.Shares[i].Name == shareName || shareName == "" && len(conf.Shares) == 1 {
+			share = &conf.Shares[i]
+		}
+	}
+
+	if share == nil {
+		log.Errorf("share %s not found", shareName)
+		return
+	}
+
+	scopes := []string{share.Scope}
+	if share.IsTemplate() {
+		if scopes, err = filepath.Glob(share.ScopeGlob()); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, scope := range scopes {
+		dir := server.NewTrashDir(share, scope, propsStore, quotaManager)
+		items, err := dir.Trash.List(account)
+		if err != nil {
+			log.Errorf("list trash in %s failed: %v", scope, err)
+			continue
+		}
+
+		for _, item := range items {
+			if id != "" && item.ID != id {
+				continue
+			}
+
+			switch action {
+			case "trash-list":
+				log.With(item).Infof("%s %s", item.ID, filepath.Join(scope, filepath.FromSlash(item.Path)))
+			case "trash-restore":
+				if id == "" {
+					log.Errorf("id is required for trash-restore")
+					return
+				}
+
+				if err := dir.RestoreTrash(context.Background(), item); err != nil {
+					log.Errorf("restore %s failed: %v", item.Path, err)
+					continue
+				}
+
+				log.With(item).Infof("restored to %s", filepath.Join(scope, filepath.FromSlash(item.Path)))
+			case "trash-purge":
+				if err := dir.PurgeTrash(item); err != nil {
+					log.Errorf("purge %s failed: %v", item.Path, err)
+					continue
+				}
+
+				log.With(item).Infof("purged %s", item.Path)
+			}
+		}
+	}
+}
+
+// openTrashStores 按照配置打开服务使用的 dead property 以及配额用量数据库
+func openTrashStores(conf *config.Config) (props.Store, quota.Manager, error) {
+	propsStore, quotaManager := props.NewNopStore(), quota.NewNopManager()
+	if conf.PropsDriver != "none" {
+		store, err := props.NewBoltStore(filepath.Join(conf.DataDir, "props.db"))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		propsStore = store
+	}
+
+	if conf.QuotaEnabled() {
+		manager, err := quota.NewBoltManager(config.NewReloader(conf), filepath.Join(conf.DataDir, "quota.db"))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		quotaManager = manager
+	}
+
+	return propsStore, quotaManager, nil
+}
+
 func listLDAPUsers(configPath string) {
 	conf, err := config.LoadConfFromFile(configPath)
 	if err != nil {
@@ -44,33 +265,55 @@ func listLDAPUsers(configPath string) {
 	}
 }
 
+// encryptConfigFile 使用密码策略中的算法加密配置文件中所有明文（包括 base64）保存的本地用户密码
 func encryptConfigFile(configPath string) {
-	conf, err := config.LoadConfFromFile(configPath)
+	editor, err := config.OpenEditor(configPath)
+	if err != nil {
+		panic(err)
+	}
+
+	policy, err := editor.PasswordPolicy()
+	if err != nil {
+		panic(err)
+	}
+
+	users, err := editor.LocalUsers()
 	if err != nil {
 		panic(err)
 	}
 
-	for i, user := range conf.Users.Local {
-		if user.Algo == "" {
-			encrypted, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	algo := policy.PreferredAlgo()
+	for _, user := range users {
+		if !password.IsPlaintext(user.Algo) {
+			continue
+		}
+
+		plain := user.Password
+		if user.Algo == password.Base64 {
+			decoded, err := base64.StdEncoding.DecodeString(user.Password)
 			if err != nil {
-				log.Errorf("encrypt password for %s failed: %v", user.Account, err)
+				log.Errorf("decode base64 password for %s failed: %v", user.Account, err)
 				continue
 			}
 
-			log.With(user).Debugf("password encrypted for %s", user.Account)
+			plain = string(decoded)
+		}
 
-			conf.Users.Local[i].Algo = "bcrypt"
-			conf.Users.Local[i].Password = string(encrypted)
+		encrypted, err := password.Hash(algo, plain)
+		if err != nil {
+			log.Errorf("encrypt password for %s failed: %v", user.Account, err)
+			continue
 		}
-	}
 
-	generated, err := yaml.Marshal(conf)
-	if err != nil {
-		panic(err)
+		if err := editor.SetLocalUserPassword(user.Account, encrypted, algo); err != nil {
+			log.Errorf("encrypt password for %s failed: %v", user.Account, err)
+			continue
+		}
+
+		log.Debugf("password encrypted for %s using %s", user.Account, algo)
 	}
 
-	if err := ioutil.WriteFile(configPath, generated, os.ModePerm); err != nil {
+	if err := editor.Save(); err != nil {
 		panic(err)
 	}
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+)
+
+// matrixEntry 权限矩阵中的一行：用户对共享中的一个路径实际拥有的权限
+type matrixEntry struct {
+	Account    string           `json:"account"`
+	Name       string           `json:"name,omitempty"`
+	Type       string           `json:"type,omitempty"`
+	Groups     []string         `json:"groups"`
+	Share      string           `json:"share"`
+	Path       string           `json:"path"`
+	Privileges config.Privilege `json:"privileges"`
+	// Visible 路径是否出现在用户的目录列表中
+	Visible bool `json:"visible"`
+}
+
+// printAccessMatrix 输出所有用户对每个共享根目录及其第一级文件、目录（或者 paths 中指定的路径）的实际权限，
+// format 支持 csv|json|markdown
+func printAccessMatrix(configPath string, format string, paths string) {
+	if format != "csv" && format != "json" && format != "markdown" && format != "md" {
+		fmt.Fprintf(os.Stderr, "unsupported format %s, must be one of csv|json|markdown\n", format)
+		os.Exit(2)
+	}
+
+	conf, err := config.LoadConfFromFile(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		os.Exit(2)
+	}
+
+	// misc 认证时 LDAP 服务器不可用只影响 LDAP 用户，本地用户仍然输出
+	users, err := newAuthor(conf).Users()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list users failed, only users returned before the error are included: %v\n", err)
+	}
+
+	sort.SliceStable(users, func(i, j int) bool { return users[i].Account < users[j].Account })
+
+	entries := make([]matrixEntry, 0)
+	for _, user := range users {
+		for i := range conf.Shares {
+			share := &conf.Shares[i]
+
+			var requestPaths []string
+			if paths != "" {
+				requestPaths = sharePaths(conf, share, strings.Split(paths, ","))
+			} else {
+				requestPaths = topLevelPaths(conf, share, user)
+			}
+
+			for _, requestPath := range requestPaths {
+				entries = append(entries, matrixEntry{
+					Account:    user.Account,
+					Name:       user.Name,
+					Type:       user.Type,
+					Groups:     user.Groups,
+					Share:      share.Name,
+					Path:       requestPath,
+					Privileges: user.Privileges(share, requestPath),
+					Visible:    user.CanSee(share, requestPath),
+				})
+			}
+		}
+	}
+
+	if err := writeAccessMatrix(format, entries); err != nil {
+		fmt.Fprintf(os.Stderr, "write access matrix failed: %v\n", err)
+		os.Exit(2)
+	}
+}
+
+// servedBy 判断 requestPath 是否由 share 提供服务，与服务端相同，最长前缀的共享优先
+func servedBy(conf *config.Config, share *config.Share, requestPath string) bool {
+	if !share.Contains(requestPath) {
+		return false
+	}
+
+	for i := range conf.Shares {
+		if conf.Shares[i].Contains(requestPath) && len(conf.Shares[i].Prefix) > len(share.Prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sharePaths 返回 paths 中由共享提供服务的路径，路径需要包含共享的前缀，目录以 / 结尾
+func sharePaths(conf *config.Config, share *config.Share, paths []string) []string {
+	matched := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if p = config.CanonicalPath(strings.TrimSpace(p)); servedBy(conf, share, p) {
+			matched = append(matched, p)
+		}
+	}
+
+	return matched
+}
+
+// topLevelPaths 返回共享的根目录以及根目录下第一级的文件和目录，共享目录为模板时使用用户自己的目录
+func topLevelPaths(conf *config.Config, share *config.Share, user auth.AuthedUser) []string {
+	root := strings.TrimSuffix(share.Prefix, "/") + "/"
+	paths := []string{root}
+
+	scope := share.Scope
+	if share.IsTemplate() {
+		resolved, err := share.ResolveScope(user.ScopeVars())
+		if err != nil {
+			return paths
+		}
+
+		scope = resolved
+	}
+
+	items, err := ioutil.ReadDir(scope)
+	if err != nil {
+		return paths
+	}
+
+	for _, item := range items {
+		// .webdav 为服务端保留的目录（回收站、历史版本等），不通过 WebDAV 访问
+		if item.Name() == ".webdav" {
+			continue
+		}
+
+		p := path.Join(root, item.Name())
+		if item.IsDir() {
+			p += "/"
+		}
+
+		// 被前缀更长的共享覆盖的路径不会访问到当前共享中的文件
+		if servedBy(conf, share, p) {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths
+}
+
+func writeAccessMatrix(format string, entries []matrixEntry) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		_ = writer.Write([]string{"account", "name", "type", "groups", "share", "path", "privileges", "visible"})
+		for _, entry := range entries {
+			_ = writer.Write([]string{
+				entry.Account,
+				entry.Name,
+				entry.Type,
+				strings.Join(entry.Groups, ";"),
+				entry.Share,
+				entry.Path,
+				entry.Privileges.String(),
+				fmt.Sprintf("%t", entry.Visible),
+			})
+		}
+
+		writer.Flush()
+		return writer.Error()
+	default:
+		escape := strings.NewReplacer("|", `\|`, "\n", " ").Replace
+
+		fmt.Println("| Account | Name | Groups | Share | Path | Privileges | Visible |")
+		fmt.Println("| --- | --- | --- | --- | --- | --- | --- |")
+		for _, entry := range entries {
+			fmt.Printf(
+				"| %s | %s | %s | %s | `%s` | %s | %t |\n",
+				escape(entry.Account),
+				escape(entry.Name),
+				escape(strings.Join(entry.Groups, ", ")),
+				escape(entry.Share),
+				escape(strings.ReplaceAll(entry.Path, "`", "'")),
+				entry.Privileges,
+				entry.Visible,
+			)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mylxsw/webdav-server/internal/auth/password"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// manageUsers 管理配置文件 users.local 中的本地用户，直接修改配置文件，保留注释以及配置项的顺序
+//
+// 服务开启 watch_config 或者收到 SIGHUP 信号后生效
+func manageUsers(configPath string, action string, account string, name string, groups string, passwordStdin bool) {
+	editor, err := config.OpenEditor(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		os.Exit(1)
+	}
+
+	if action == "user-list" {
+		listLocalUsers(editor)
+		return
+	}
+
+	policy, err := editor.PasswordPolicy()
+	exitOnError(err)
+	algo := policy.PreferredAlgo()
+
+	if account == "" {
+		fmt.Fprintf(os.Stderr, "-account is required for %s\n", action)
+		os.Exit(2)
+	}
+
+	switch action {
+	case "user-add":
+		if _, err := findLocalUser(editor, account); err == nil {
+			exitOnError(fmt.Errorf("user %s already exists", account))
+		}
+
+		hashed, err := hashPassword(algo, passwordStdin)
+		exitOnError(err)
+		exitOnError(editor.AddLocalUser(config.LocalUser{
+			Name:     name,
+			Account:  account,
+			Password: hashed,
+			Groups:   splitGroups(groups),
+			Algo:     algo,
+		}))
+	case "user-del":
+		exitOnError(editor.RemoveLocalUser(account))
+	case "user-passwd":
+		_, err := findLocalUser(editor, account)
+		exitOnError(err)
+
+		hashed, err := hashPassword(algo, passwordStdin)
+		exitOnError(err)
+		exitOnError(editor.SetLocalUserPassword(account, hashed, algo))
+	case "user-set-groups":
+		exitOnError(editor.SetLocalUserGroups(account, splitGroups(groups)))
+	}
+
+	exitOnError(editor.Save())
+	fmt.Printf("%s: %s %s done\n", configPath, action, account)
+}
+
+func listLocalUsers(editor *config.Editor) {
+	users, err := editor.LocalUsers()
+	exitOnError(err)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ACCOUNT\tNAME\tGROUPS\tALGO")
+	for _, user := range users {
+		algo := user.Algo
+		if algo == "" {
+			algo = password.Plain
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", user.Account, user.Name, strings.Join(user.GetUserGroups(), ","), algo)
+	}
+
+	_ = writer.Flush()
+}
+
+func findLocalUser(editor *config.Editor, account string) (*config.LocalUser, error) {
+	users, err := editor.LocalUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		if users[i].Account == account {
+			return &users[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("user %s not found", account)
+}
+
+// hashPassword 读取用户输入的密码并使用 algo 加密
+func hashPassword(algo string, passwordStdin bool) (string, error) {
+	pass, err := readPassword(passwordStdin)
+	if err != nil {
+		return "", err
+	}
+
+	return password.Hash(algo, string(pass))
+}
+
+// readPassword 从终端读取两次密码，passwordStdin 为 true 时从标准输入读取第一行作为密码，用于脚本中调用
+func readPassword(passwordStdin bool) ([]byte, error) {
+	if passwordStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("read password from stdin failed: %v", err)
+		}
+
+		return checkPassword([]byte(strings.TrimRight(line, "\r\n")))
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("stdin is not a terminal, use -password-stdin to read the password from stdin")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirmed, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(password, confirmed) {
+		return nil, errors.New("passwords do not match")
+	}
+
+	return checkPassword(password)
+}
+
+func checkPassword(password []byte) ([]byte, error) {
+	if len(password) == 0 {
+		return nil, errors.New("password must not be empty")
+	}
+
+	return password, nil
+}
+
+func splitGroups(groups string) []string {
+	items := make([]string, 0)
+	for _, group := range strings.Split(groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			items = append(items, group)
+		}
+	}
+
+	return items
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
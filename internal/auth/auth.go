@@ -11,6 +11,16 @@ type Author interface {
 	Users() ([]AuthedUser, error)
 }
 
+// Reloadable 可以在配置重新加载时更新用户信息的 Author
+type Reloadable interface {
+	Reload(conf *config.Config)
+}
+
+// Notifier 用户信息会在配置重新加载之外发生变化的 Author（如 htpasswd 文件被修改），变化后调用 OnChange 注册的函数
+type Notifier interface {
+	OnChange(fn func())
+}
+
 type AuthedUser struct {
 	Type    string   `json:"type" yaml:"type"`
 	UUID    string   `json:"uuid" yaml:"uuid"`
@@ -20,55 +30,108 @@ type AuthedUser struct {
 	Status  int8     `json:"status" yaml:"status"`
 }
 
-func (user AuthedUser) HasPrivilege(conf *config.Config, userGroupRules *config.UserGroupRules, readonlyRequest bool, requestPath string) bool {
-	// server=write
-	if conf.Server.AccessMode == config.AccessModeWrite {
-		return true
+// ScopeVars 返回用于解析共享目录模板的变量，group 为用户所属的第一个用户组
+func (user AuthedUser) ScopeVars() map[string]string {
+	vars := map[string]string{
+		"account": user.Account,
+		"name":    user.Name,
+		"uuid":    user.UUID,
 	}
 
-	// server=read, read request
-	if conf.Server.AccessMode == config.AccessModeRead && readonlyRequest {
-		return true
+	if len(user.Groups) > 0 {
+		vars["group"] = user.Groups[0]
 	}
 
-	// 用户规则优先，寻找user/group最大权限
-	if rules, ok := userGroupRules.Users[user.Account]; ok {
-		for _, rule := range rules {
-			if !rule.Matched(requestPath) {
-				continue
-			}
+	return vars
+}
 
-			if rule.AccessMode == config.AccessModeWrite {
-				return true
-			}
+// DecisionDefault 由共享默认权限做出决定时 Decision.Rule 的值
+const DecisionDefault = "default"
 
-			if rule.AccessMode == config.AccessModeRead && readonlyRequest {
-				return true
-			}
-		}
-	}
+// Decision 权限检查的结果
+type Decision struct {
+	// Path 用于匹配规则的路径，相对于共享根目录
+	Path     string           `json:"path"`
+	Required config.Privilege `json:"required"`
+	// Granted 用户对 Path 实际拥有的权限
+	Granted config.Privilege `json:"granted"`
+	Allowed bool             `json:"allowed"`
+	// Rule 做出决定的规则，共享默认权限做出决定时为 default
+	Rule string `json:"rule"`
+	// Hidden 存在匹配的 hidden 规则，Path 不应该出现在目录列表中
+	Hidden bool `json:"hidden,omitempty"`
+}
+
+// Authorize 检查用户对 requestPath 是否拥有 required 中的所有权限
+//
+// 用户的权限为共享默认权限与所有匹配的 allow 规则授予权限的并集，再去掉所有匹配的 deny 规则拒绝的权限（deny 优先）。
+// 拒绝时，Rule 为第一个拒绝了所需权限的 deny 规则；允许时，Rule 为第一个授予了所需权限的 allow 规则，
+// 共享默认权限已经满足要求时为 default
+func (user AuthedUser) Authorize(share *config.Share, required config.Privilege, requestPath string) Decision {
+	defaults := share.Privileges()
+	granted, denied := defaults, config.PrivilegeNone
+
+	// 规则匹配相对于共享根目录的规范化路径，避免 //、..、百分号编码等变形绕过规则
+	rulePath := share.RelativePath(requestPath)
 
-	for _, userGroup := range user.Groups {
-		if rules, ok := userGroupRules.Groups[userGroup]; ok {
-			for _, rule := range rules {
-				if !rule.Matched(requestPath) {
-					continue
-				}
+	var allowRule, denyRule string
+	var hidden bool
+	for _, rule := range share.MatchedRules(rulePath) {
+		if !rule.AppliesTo(user.Account, user.Groups) {
+			continue
+		}
 
-				if rule.AccessMode == config.AccessModeWrite {
-					return true
-				}
+		hidden = hidden || rule.Hidden
 
-				if rule.AccessMode == config.AccessModeRead && readonlyRequest {
-					return true
-				}
+		privileges := rule.Privileges()
+		if rule.Denied() {
+			denied |= privileges
+			if denyRule == "" && privileges&required != 0 {
+				denyRule = rule.ID()
 			}
+			continue
+		}
+
+		granted |= privileges
+		if allowRule == "" && privileges&required != 0 {
+			allowRule = rule.ID()
 		}
 	}
 
-	// server=read, write request
-	// server=none, read|write request
-	return false
+	decision := Decision{
+		Path:     rulePath,
+		Required: required,
+		Granted:  granted &^ denied,
+		Rule:     DecisionDefault,
+		Hidden:   hidden,
+	}
+	decision.Allowed = decision.Granted.Has(required)
+
+	switch {
+	case !decision.Allowed && denyRule != "":
+		decision.Rule = denyRule
+	case decision.Allowed && !defaults.Has(required) && allowRule != "":
+		decision.Rule = allowRule
+	}
+
+	return decision
+}
+
+// Privileges 返回用户对 requestPath 实际拥有的权限
+func (user AuthedUser) Privileges(share *config.Share, requestPath string) config.Privilege {
+	return user.Authorize(share, config.PrivilegeNone, requestPath).Granted
+}
+
+// CanSee 判断 requestPath 是否出现在用户的目录列表中：用户至少拥有 list 或者 read 权限，并且没有匹配的 hidden 规则，
+// 目录的 requestPath 需要以 / 结尾
+func (user AuthedUser) CanSee(share *config.Share, requestPath string) bool {
+	decision := user.Authorize(share, config.PrivilegeNone, requestPath)
+	return !decision.Hidden && decision.Granted&(config.PrivilegeList|config.PrivilegeRead) != 0
+}
+
+// HasPrivilege 判断用户对 requestPath 是否拥有 required 中的所有权限
+func (user AuthedUser) HasPrivilege(share *config.Share, required config.Privilege, requestPath string) bool {
+	return user.Authorize(share, required, requestPath).Allowed
 }
 
 var ErrNoSuchUser = errors.New("user not found")
@@ -0,0 +1,208 @@
+package htpasswd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/auth/password"
+	"github.com/mylxsw/webdav-server/internal/config"
+)
+
+// Auth 使用 Apache htpasswd 文件以及可选的用户组文件认证用户
+type Auth struct {
+	logger log.Logger
+	lock   sync.RWMutex
+	conf   config.Htpasswd
+	users  map[string]htpasswdUser
+	// version 上次加载时文件的修改时间以及大小，failed 为上次加载失败时的文件版本，避免重复加载以及输出错误日志
+	version   string
+	failed    string
+	listeners []func()
+}
+
+func New(conf *config.Config) auth.Author {
+	provider := &Auth{logger: log.Module("auth:htpasswd"), conf: conf.Htpasswd, users: make(map[string]htpasswdUser)}
+	if err := provider.load(conf.Htpasswd); err != nil {
+		provider.logger.Errorf("load htpasswd file failed: %v", err)
+	}
+
+	return provider
+}
+
+// load 读取 htpasswd 以及用户组文件替换当前的用户，读取失败时保留当前的用户
+func (provider *Auth) load(conf config.Htpasswd) error {
+	// 先获取文件版本再读取，读取过程中文件发生变化时，下次检查会重新加载
+	version := fileVersion(conf)
+
+	users, warnings, err := readUsers(conf.File)
+	if err != nil {
+		provider.setFailed(version)
+		return err
+	}
+
+	for _, warning := range warnings {
+		provider.logger.Warning(warning)
+	}
+
+	if conf.GroupFile != "" {
+		groups, err := readGroups(conf.GroupFile)
+		if err != nil {
+			provider.setFailed(version)
+			return err
+		}
+
+		for account, user := range users {
+			user.Groups = groups[account]
+			users[account] = user
+		}
+	}
+
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	provider.conf, provider.users, provider.version, provider.failed = conf, users, version, ""
+	return nil
+}
+
+func (provider *Auth) setFailed(version string) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	provider.failed = version
+}
+
+// fileVersion 返回 htpasswd 以及用户组文件的修改时间和大小，任意一个文件变化时返回值不同
+func fileVersion(conf config.Htpasswd) string {
+	var version string
+	for _, filename := range []string{conf.File, conf.GroupFile} {
+		if filename == "" {
+			continue
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			version += "-;"
+			continue
+		}
+
+		version += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+
+	return version
+}
+
+// Reload 使用新的配置重新加载 htpasswd 以及用户组文件
+func (provider *Auth) Reload(conf *config.Config) {
+	if err := provider.load(conf.Htpasswd); err != nil {
+		provider.logger.Errorf("reload htpasswd file failed, keep using the current users: %v", err)
+	}
+}
+
+// OnChange 注册 htpasswd 或者用户组文件修改并重新加载后执行的函数
+func (provider *Auth) OnChange(fn func()) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	provider.listeners = append(provider.listeners, fn)
+}
+
+// Watch 定期检查 htpasswd 以及用户组文件是否发生变化，变化后重新加载，直到 ctx 结束
+func (provider *Auth) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		provider.lock.RLock()
+		conf, loaded, failed := provider.conf, provider.version, provider.failed
+		provider.lock.RUnlock()
+
+		if version := fileVersion(conf); version == loaded || version == failed {
+			continue
+		}
+
+		if err := provider.load(conf); err != nil {
+			provider.logger.Errorf("reload htpasswd file failed, keep using the current users: %v", err)
+			continue
+		}
+
+		provider.lock.RLock()
+		count, listeners := len(provider.users), provider.listeners
+		provider.lock.RUnlock()
+
+		provider.logger.WithFields(log.Fields{"file": conf.File, "group_file": conf.GroupFile, "users": count}).Info("htpasswd file reloaded")
+		for _, fn := range listeners {
+			fn()
+		}
+	}
+}
+
+func (provider *Auth) user(username string) (htpasswdUser, bool) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
+	user, ok := provider.users[username]
+	return user, ok
+}
+
+func (provider *Auth) GetUser(username string) (*auth.AuthedUser, error) {
+	if user, ok := provider.user(username); ok {
+		return authedUser(user), nil
+	}
+
+	return nil, auth.ErrNoSuchUser
+}
+
+func (provider *Auth) Login(username, pass string) (*auth.AuthedUser, error) {
+	if user, ok := provider.user(username); ok {
+		if err := password.Verify(user.Algo, user.Password, pass); err != nil {
+			if !errors.Is(err, password.ErrMismatch) {
+				provider.logger.Errorf("verify password for %s failed: %v", user.Account, err)
+			}
+
+			return nil, auth.ErrInvalidPassword
+		}
+
+		return authedUser(user), nil
+	}
+
+	return nil, auth.ErrNoSuchUser
+}
+
+func (provider *Auth) Users() ([]auth.AuthedUser, error) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
+	users := make([]auth.AuthedUser, 0, len(provider.users))
+	for _, u := range provider.users {
+		users = append(users, *authedUser(u))
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Account < users[j].Account })
+	return users, nil
+}
+
+func authedUser(user htpasswdUser) *auth.AuthedUser {
+	groups := make([]string, 0, len(user.Groups))
+	groups = append(groups, user.Groups...)
+
+	return &auth.AuthedUser{
+		Type:    "htpasswd",
+		Account: user.Account,
+		Name:    user.Account,
+		Groups:  groups,
+		Status:  1,
+	}
+}
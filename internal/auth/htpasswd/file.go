@@ -0,0 +1,105 @@
+package htpasswd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mylxsw/webdav-server/internal/auth/password"
+)
+
+// htpasswdUser htpasswd 文件中的一个用户
+type htpasswdUser struct {
+	Account  string
+	Password string
+	Algo     string
+	Groups   []string
+}
+
+// detectAlgo 根据密码的前缀判断 htpasswd 中密码的算法
+//
+// 不支持 crypt(3) DES 以及明文密码（htpasswd -d、-p），这两种格式无法与其它格式可靠地区分
+func detectAlgo(hashed string) (string, bool) {
+	switch {
+	case strings.HasPrefix(hashed, "$2y$"), strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"):
+		return password.Bcrypt, true
+	case strings.HasPrefix(hashed, "{SHA}"):
+		return password.SSHA, true
+	case strings.HasPrefix(hashed, "$apr1$"):
+		return password.APR1, true
+	case strings.HasPrefix(hashed, "$6$"):
+		return password.SHA512Crypt, true
+	}
+
+	return "", false
+}
+
+// readUsers 读取 htpasswd 文件，格式为每行一个 account:password，忽略空行以及 # 开头的注释，
+// 密码格式不支持的用户跳过并返回警告
+func readUsers(filename string) (map[string]htpasswdUser, []string, error) {
+	users := make(map[string]htpasswdUser)
+	warnings := make([]string, 0)
+
+	err := readLines(filename, func(lineNo int, line string) error {
+		pos := strings.IndexByte(line, ':')
+		if pos <= 0 {
+			return fmt.Errorf("%s:%d: must be account:password", filename, lineNo)
+		}
+
+		account, hashed := line[:pos], line[pos+1:]
+		algo, ok := detectAlgo(hashed)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: unsupported password format for %s, only bcrypt, {SHA}, $apr1$ and $6$ are supported", filename, lineNo, account))
+			return nil
+		}
+
+		users[account] = htpasswdUser{Account: account, Password: hashed, Algo: algo}
+		return nil
+	})
+
+	return users, warnings, err
+}
+
+// readGroups 读取 Apache 用户组文件，格式为每行一个 group: user1 user2，返回每个用户所属的用户组
+func readGroups(filename string) (map[string][]string, error) {
+	groups := make(map[string][]string)
+
+	err := readLines(filename, func(lineNo int, line string) error {
+		pos := strings.IndexByte(line, ':')
+		if pos <= 0 {
+			return fmt.Errorf("%s:%d: must be group: user1 user2", filename, lineNo)
+		}
+
+		group := strings.TrimSpace(line[:pos])
+		for _, account := range strings.Fields(line[pos+1:]) {
+			groups[account] = append(groups[account], group)
+		}
+
+		return nil
+	})
+
+	return groups, err
+}
+
+func readLines(filename string, fn func(lineNo int, line string) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := fn(lineNo, line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,34 @@
+package htpasswd
+
+import (
+	"context"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/go-utils/str"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+)
+
+// watchInterval 检查 htpasswd 以及用户组文件是否发生变化的时间间隔
+const watchInterval = 5 * time.Second
+
+type Provider struct{}
+
+func (p Provider) Register(cc infra.Binder) {
+	cc.MustSingletonOverride(New)
+	log.Debugf("provider internal.auth.htpasswd loaded")
+}
+
+func (p Provider) ShouldLoad(config *config.Config) bool {
+	return str.InIgnoreCase(config.AuthType, []string{"htpasswd"})
+}
+
+func (p Provider) Daemon(ctx context.Context, resolver infra.Resolver) {
+	resolver.MustResolve(func(author auth.Author) {
+		if provider, ok := author.(*Auth); ok {
+			provider.Watch(ctx, watchInterval)
+		}
+	})
+}
@@ -1,10 +1,10 @@
 package ldap
 
 import (
-	"errors"
 	"fmt"
 	"github.com/mylxsw/go-utils/str"
 	"github.com/mylxsw/webdav-server/internal/config"
+	"sync"
 	"time"
 
 	lp "github.com/go-ldap/ldap/v3"
@@ -14,6 +14,7 @@ import (
 )
 
 type Auth struct {
+	lock     sync.RWMutex
 	conf     *config.LDAP
 	userConf *config.Users
 	users    map[string]config.LDAPUser
@@ -21,12 +22,34 @@ type Auth struct {
 }
 
 func New(conf *config.LDAP, userConfig *config.Users) auth.Author {
+	return &Auth{conf: conf, userConf: userConfig, logger: log.Module("auth:ldap"), users: ldapUsers(userConfig)}
+}
+
+func ldapUsers(userConfig *config.Users) map[string]config.LDAPUser {
 	users := make(map[string]config.LDAPUser)
 	for _, u := range userConfig.LDAP {
 		users[u.Account] = u
 	}
 
-	return &Auth{conf: conf, userConf: userConfig, logger: log.Module("auth:ldap"), users: users}
+	return users
+}
+
+// Reload 使用新的配置替换 LDAP 服务器配置以及 LDAP 用户的附加用户组
+func (provider *Auth) Reload(conf *config.Config) {
+	users := ldapUsers(&conf.Users)
+
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	provider.conf, provider.userConf, provider.users = &conf.LDAP, &conf.Users, users
+}
+
+// settings 返回当前生效的 LDAP 服务器配置以及 LDAP 用户
+func (provider *Auth) settings() (*config.LDAP, map[string]config.LDAPUser) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
+	return provider.conf, provider.users
 }
 
 func (provider *Auth) GetUser(username string) (*auth.AuthedUser, error) {
@@ -36,16 +59,17 @@ func (provider *Auth) GetUser(username string) (*auth.AuthedUser, error) {
 func (provider *Auth) getUser(username string, cb func(l *lp.Conn, user *auth.AuthedUser, entry *lp.Entry) error) (*auth.AuthedUser, error) {
 	log.WithFields(log.Fields{"username": username}).Debugf("ldap get user")
 
+	conf, _ := provider.settings()
 	res, err := provider.getConnection(func(l *lp.Conn) (interface{}, error) {
 		searchReq := lp.NewSearchRequest(
-			provider.conf.BaseDN,
+			conf.BaseDN,
 			lp.ScopeWholeSubtree,
 			lp.NeverDerefAliases,
 			0,
 			0,
 			false,
-			fmt.Sprintf("(&(objectClass=organizationalPerson)(%s=%s))", provider.conf.UID, lp.EscapeFilter(username)),
-			[]string{"objectguid", provider.conf.UID, provider.conf.DisplayName, "userAccountControl", "memberOf"},
+			fmt.Sprintf("(&(objectClass=organizationalPerson)(%s=%s))", conf.UID, lp.EscapeFilter(username)),
+			[]string{"objectguid", conf.UID, conf.DisplayName, "userAccountControl", "memberOf"},
 			nil,
 		)
 
@@ -55,12 +79,12 @@ func (provider *Auth) getUser(username string, cb func(l *lp.Conn, user *auth.Au
 		}
 
 		if len(sr.Entries) != 1 {
-			return nil, fmt.Errorf("用户不存在")
+			return nil, fmt.Errorf("LDAP 用户不存在: %w", auth.ErrNoSuchUser)
 		}
 
 		// 514-禁用 512-启用
 		if sr.Entries[0].GetAttributeValue("userAccountControl") == "514" {
-			return nil, errors.New("LDAP 用户账户已禁用")
+			return nil, fmt.Errorf("LDAP 用户账户已禁用: %w", auth.ErrNoSuchUser)
 		}
 
 		authedUser := provider.buildAuthedUserFromLDAPEntry(sr.Entries[0])
@@ -81,14 +105,15 @@ func (provider *Auth) getUser(username string, cb func(l *lp.Conn, user *auth.Au
 }
 
 func (provider *Auth) getConnection(cb func(l *lp.Conn) (interface{}, error)) (interface{}, error) {
-	l, err := lp.DialURL(provider.conf.URL)
+	conf, _ := provider.settings()
+	l, err := lp.DialURL(conf.URL)
 	if err != nil {
 		return nil, fmt.Errorf("无法连接 LDAP 服务器: %w", err)
 	}
 	defer l.Close()
 
 	l.SetTimeout(5 * time.Second)
-	if err := l.Bind(provider.conf.Username, provider.conf.Password); err != nil {
+	if err := l.Bind(conf.Username, conf.Password); err != nil {
 		return nil, fmt.Errorf("LDAP 服务器鉴权失败: %w", err)
 	}
 
@@ -102,6 +127,8 @@ func (provider *Auth) Login(username, password string) (*auth.AuthedUser, error)
 }
 
 func (provider *Auth) buildAuthedUserFromLDAPEntry(entry *lp.Entry) auth.AuthedUser {
+	conf, users := provider.settings()
+
 	userStatus := 1
 	if entry.GetAttributeValue("userAccountControl") == "514" {
 		userStatus = 0
@@ -110,13 +137,13 @@ func (provider *Auth) buildAuthedUserFromLDAPEntry(entry *lp.Entry) auth.AuthedU
 	authedUser := auth.AuthedUser{
 		Type:    "ldap",
 		UUID:    uuid.Must(uuid.FromBytes(entry.GetRawAttributeValue("objectGUID"))).String(),
-		Name:    entry.GetAttributeValue(provider.conf.DisplayName),
+		Name:    entry.GetAttributeValue(conf.DisplayName),
 		Account: entry.DN,
 		Groups:  entry.GetAttributeValues("memberOf"),
 		Status:  int8(userStatus),
 	}
 
-	if user, ok := provider.users[entry.DN]; ok {
+	if user, ok := users[entry.DN]; ok {
 		authedUser.Groups = str.Distinct(append(authedUser.Groups, user.GetUserGroups()...))
 	}
 
@@ -124,16 +151,17 @@ func (provider *Auth) buildAuthedUserFromLDAPEntry(entry *lp.Entry) auth.AuthedU
 }
 
 func (provider *Auth) Users() ([]auth.AuthedUser, error) {
+	conf, _ := provider.settings()
 	res, err := provider.getConnection(func(l *lp.Conn) (interface{}, error) {
 		searchReq := lp.NewSearchRequest(
-			provider.conf.BaseDN,
+			conf.BaseDN,
 			lp.ScopeWholeSubtree,
 			lp.NeverDerefAliases,
 			0,
 			0,
 			false,
-			fmt.Sprintf("(&(objectClass=organizationalPerson)(memberOf=%s))", lp.EscapeFilter(provider.conf.UserFilter)),
-			[]string{"objectguid", provider.conf.UID, provider.conf.DisplayName, "userAccountControl", "memberOf"},
+			fmt.Sprintf("(&(objectClass=organizationalPerson)(memberOf=%s))", lp.EscapeFilter(conf.UserFilter)),
+			[]string{"objectguid", conf.UID, conf.DisplayName, "userAccountControl", "memberOf"},
 			nil,
 		)
 
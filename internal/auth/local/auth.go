@@ -1,31 +1,60 @@
 package local
 
 import (
-	"encoding/base64"
+	"errors"
+	"sync"
+
 	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/auth/password"
 	"github.com/mylxsw/webdav-server/internal/config"
 
 	"github.com/mylxsw/asteria/log"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type Auth struct {
-	logger log.Logger
-	conf   *config.Users
-	users  map[string]config.LocalUser
+	logger     log.Logger
+	lock       sync.RWMutex
+	conf       *config.Users
+	configPath string
+	users      map[string]config.LocalUser
+
+	// upgradeLock 保证同一时间只有一个密码升级写入配置文件
+	upgradeLock sync.Mutex
+}
+
+func New(conf *config.Config) auth.Author {
+	return &Auth{logger: log.Module("auth:local"), conf: &conf.Users, configPath: conf.Path(), users: localUsers(&conf.Users)}
 }
 
-func New(conf *config.Users) auth.Author {
+func localUsers(conf *config.Users) map[string]config.LocalUser {
 	users := make(map[string]config.LocalUser)
 	for _, user := range conf.Local {
 		users[user.Account] = user
 	}
 
-	return &Auth{logger: log.Module("auth:local"), conf: conf, users: users}
+	return users
+}
+
+// Reload 使用新的配置替换本地用户
+func (provider *Auth) Reload(conf *config.Config) {
+	users := localUsers(&conf.Users)
+
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+
+	provider.conf, provider.configPath, provider.users = &conf.Users, conf.Path(), users
+}
+
+func (provider *Auth) user(username string) (config.LocalUser, bool) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
+	user, ok := provider.users[username]
+	return user, ok
 }
 
 func (provider *Auth) GetUser(username string) (*auth.AuthedUser, error) {
-	if user, ok := provider.users[username]; ok {
+	if user, ok := provider.user(username); ok {
 		return &auth.AuthedUser{
 			Type:    "local",
 			Account: user.Account,
@@ -38,26 +67,19 @@ func (provider *Auth) GetUser(username string) (*auth.AuthedUser, error) {
 	return nil, auth.ErrNoSuchUser
 }
 
-func (provider *Auth) Login(username, password string) (*auth.AuthedUser, error) {
+func (provider *Auth) Login(username, pass string) (*auth.AuthedUser, error) {
 
-	if user, ok := provider.users[username]; ok {
-		switch user.Algo {
-		case "base64":
-			savedPassword, err := base64.StdEncoding.DecodeString(user.Password)
-			if err != nil {
-				return nil, auth.ErrInvalidPassword
-			}
-			if string(savedPassword) != password {
-				return nil, auth.ErrInvalidPassword
-			}
-		case "bcrypt":
-			if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
-				return nil, auth.ErrInvalidPassword
-			}
-		default:
-			if user.Password != password {
-				return nil, auth.ErrInvalidPassword
+	if user, ok := provider.user(username); ok {
+		if err := password.Verify(user.Algo, user.Password, pass); err != nil {
+			if !errors.Is(err, password.ErrMismatch) {
+				provider.logger.Errorf("verify password for %s failed: %v", user.Account, err)
 			}
+
+			return nil, auth.ErrInvalidPassword
+		}
+
+		if provider.policy().ShouldUpgrade(user.Algo) {
+			provider.upgrade(user, pass)
 		}
 
 		return &auth.AuthedUser{
@@ -72,7 +94,80 @@ func (provider *Auth) Login(username, password string) (*auth.AuthedUser, error)
 	return nil, auth.ErrNoSuchUser
 }
 
+func (provider *Auth) policy() config.PasswordPolicy {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
+	return provider.conf.PasswordPolicy
+}
+
+// upgrade 使用密码策略中的算法重新加密用户的密码并写回配置文件，失败时只记录日志，不影响本次登录
+func (provider *Auth) upgrade(user config.LocalUser, pass string) {
+	provider.upgradeLock.Lock()
+	defer provider.upgradeLock.Unlock()
+
+	provider.lock.RLock()
+	current, ok := provider.users[user.Account]
+	configPath, policy := provider.configPath, provider.conf.PasswordPolicy
+	provider.lock.RUnlock()
+
+	// 同一用户并发登录时，密码可能已经被升级或者重新加载配置后已经修改
+	if !ok || configPath == "" || current.Password != user.Password || !policy.ShouldUpgrade(current.Algo) {
+		return
+	}
+
+	algo := policy.PreferredAlgo()
+	hashed, err := upgradePassword(configPath, user, pass, algo)
+	if err != nil {
+		provider.logger.Errorf("upgrade password for %s to %s failed: %v", user.Account, algo, err)
+		return
+	}
+
+	// 未开启 watch_config 时配置文件修改后不会自动重新加载，同时更新内存中的用户，避免每次登录都重新升级
+	provider.lock.Lock()
+	if current, ok := provider.users[user.Account]; ok && current.Password == user.Password {
+		current.Password, current.Algo = hashed, algo
+		provider.users[user.Account] = current
+	}
+	provider.lock.Unlock()
+
+	provider.logger.WithFields(log.Fields{"account": user.Account, "from": user.Algo, "to": algo}).Info("password upgraded")
+}
+
+// upgradePassword 修改配置文件中用户的密码，返回新的密码，配置文件中的密码已经被修改时放弃升级
+func upgradePassword(configPath string, user config.LocalUser, pass string, algo string) (string, error) {
+	hashed, err := password.Hash(algo, pass)
+	if err != nil {
+		return "", err
+	}
+
+	editor, err := config.OpenEditor(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	users, err := editor.LocalUsers()
+	if err != nil {
+		return "", err
+	}
+
+	for _, saved := range users {
+		if saved.Account == user.Account && (saved.Password != user.Password || saved.Algo != user.Algo) {
+			return "", errors.New("password in the config file has been changed, skip upgrading")
+		}
+	}
+
+	if err := editor.SetLocalUserPassword(user.Account, hashed, algo); err != nil {
+		return "", err
+	}
+
+	return hashed, editor.Save()
+}
+
 func (provider *Auth) Users() ([]auth.AuthedUser, error) {
+	provider.lock.RLock()
+	defer provider.lock.RUnlock()
+
 	users := make([]auth.AuthedUser, 0)
 	for _, u := range provider.users {
 		users = append(users, auth.AuthedUser{Type: "local", Account: u.Account, Name: u.Name, Status: 1, Groups: u.GetUserGroups()})
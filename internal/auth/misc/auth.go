@@ -15,8 +15,17 @@ type Auth struct {
 	localAuth auth.Author
 }
 
-func New(ldapConf *config.LDAP, localConf *config.Users) auth.Author {
-	return &Auth{logger: log.Module("auth:misc"), ldapAuth: ldap.New(ldapConf, localConf), localAuth: local.New(localConf)}
+func New(conf *config.Config) auth.Author {
+	return &Auth{logger: log.Module("auth:misc"), ldapAuth: ldap.New(&conf.LDAP, &conf.Users), localAuth: local.New(conf)}
+}
+
+// Reload 重新加载本地用户以及 LDAP 配置
+func (provider *Auth) Reload(conf *config.Config) {
+	for _, author := range []auth.Author{provider.localAuth, provider.ldapAuth} {
+		if reloadable, ok := author.(auth.Reloadable); ok {
+			reloadable.Reload(conf)
+		}
+	}
 }
 
 func (provider *Auth) GetUser(username string) (*auth.AuthedUser, error) {
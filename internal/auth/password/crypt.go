@@ -0,0 +1,343 @@
+package password
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ssha 为 OpenLDAP slappasswd 生成的 {SSHA}base64(sha1(password + salt) + salt)，同时支持不加盐的 {SHA}base64(sha1(password))
+
+const sshaSaltSize = 8
+
+func hashSSHA(password string) (string, error) {
+	s, err := salt(sshaSaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha1.Sum(append([]byte(password), s...))
+	return "{SSHA}" + base64.StdEncoding.EncodeToString(append(digest[:], s...)), nil
+}
+
+func verifySSHA(hashed string, password string) error {
+	var s []byte
+	switch {
+	case len(hashed) > 6 && strings.EqualFold(hashed[:6], "{SSHA}"):
+		decoded, err := base64.StdEncoding.DecodeString(hashed[6:])
+		if err != nil || len(decoded) <= sha1.Size {
+			return fmt.Errorf("invalid ssha password: must be {SSHA}base64(sha1(password + salt) + salt)")
+		}
+
+		hashed, s = string(decoded[:sha1.Size]), decoded[sha1.Size:]
+	case len(hashed) > 5 && strings.EqualFold(hashed[:5], "{SHA}"):
+		decoded, err := base64.StdEncoding.DecodeString(hashed[5:])
+		if err != nil || len(decoded) != sha1.Size {
+			return fmt.Errorf("invalid ssha password: must be {SHA}base64(sha1(password))")
+		}
+
+		hashed = string(decoded)
+	default:
+		return fmt.Errorf("invalid ssha password: must start with {SSHA} or {SHA}")
+	}
+
+	digest := sha1.Sum(append([]byte(password), s...))
+	return compare([]byte(hashed), digest[:])
+}
+
+// sha512-crypt 为 glibc crypt(3) 中 $6$ 开头的密码，与 /etc/shadow、mkpasswd -m sha-512 生成的密码格式相同
+//
+//	$6$<salt>$<hash>
+//	$6$rounds=<rounds>$<salt>$<hash>
+
+const (
+	sha512CryptPrefix        = "$6$"
+	sha512CryptRoundsPrefix  = "rounds="
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptSaltSize      = 16
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func hashSHA512Crypt(password string) (string, error) {
+	raw, err := salt(sha512CryptSaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	s := make([]byte, sha512CryptSaltSize)
+	for i, b := range raw {
+		s[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+
+	return sha512Crypt([]byte(password), s, sha512CryptDefaultRounds, false), nil
+}
+
+func verifySHA512Crypt(hashed string, password string) error {
+	if !strings.HasPrefix(hashed, sha512CryptPrefix) {
+		return fmt.Errorf("invalid sha512-crypt password: must start with %s", sha512CryptPrefix)
+	}
+
+	rest := strings.TrimPrefix(hashed, sha512CryptPrefix)
+	rounds, customRounds := sha512CryptDefaultRounds, false
+	if strings.HasPrefix(rest, sha512CryptRoundsPrefix) {
+		pos := strings.IndexByte(rest, '$')
+		if pos < 0 {
+			return fmt.Errorf("invalid sha512-crypt password: missing salt")
+		}
+
+		parsed, err := strconv.Atoi(rest[len(sha512CryptRoundsPrefix):pos])
+		if err != nil {
+			return fmt.Errorf("invalid sha512-crypt password: invalid rounds")
+		}
+
+		rounds, customRounds, rest = parsed, true, rest[pos+1:]
+	}
+
+	pos := strings.LastIndexByte(rest, '$')
+	if pos < 0 {
+		return fmt.Errorf("invalid sha512-crypt password: missing hash")
+	}
+
+	expected := sha512Crypt([]byte(password), []byte(rest[:pos]), rounds, customRounds)
+	return compare([]byte(hashed), []byte(expected))
+}
+
+// sha512Crypt 按照 Ulrich Drepper 的 "Unix crypt using SHA-256 and SHA-512" 规范计算密码
+func sha512Crypt(password []byte, s []byte, rounds int, customRounds bool) string {
+	if len(s) > sha512CryptSaltSize {
+		s = s[:sha512CryptSaltSize]
+	}
+
+	if rounds < sha512CryptMinRounds {
+		rounds = sha512CryptMinRounds
+	}
+
+	if rounds > sha512CryptMaxRounds {
+		rounds = sha512CryptMaxRounds
+	}
+
+	alternate := sha512.New()
+	alternate.Write(password)
+	alternate.Write(s)
+	alternate.Write(password)
+	alternateSum := alternate.Sum(nil)
+
+	digest := sha512.New()
+	digest.Write(password)
+	digest.Write(s)
+	for i := len(password); i > 0; i -= sha512.Size {
+		if i > sha512.Size {
+			digest.Write(alternateSum)
+		} else {
+			digest.Write(alternateSum[:i])
+		}
+	}
+
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write(alternateSum)
+		} else {
+			digest.Write(password)
+		}
+	}
+	sum := digest.Sum(nil)
+
+	passwordDigest := sha512.New()
+	for i := 0; i < len(password); i++ {
+		passwordDigest.Write(password)
+	}
+	p := repeatBytes(passwordDigest.Sum(nil), len(password))
+
+	saltDigest := sha512.New()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		saltDigest.Write(s)
+	}
+	saltBytes := repeatBytes(saltDigest.Sum(nil), len(s))
+
+	for i := 0; i < rounds; i++ {
+		round := sha512.New()
+		if i&1 != 0 {
+			round.Write(p)
+		} else {
+			round.Write(sum)
+		}
+
+		if i%3 != 0 {
+			round.Write(saltBytes)
+		}
+
+		if i%7 != 0 {
+			round.Write(p)
+		}
+
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(p)
+		}
+
+		sum = round.Sum(nil)
+	}
+
+	var result strings.Builder
+	result.WriteString(sha512CryptPrefix)
+	if customRounds {
+		result.WriteString(sha512CryptRoundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	result.Write(s)
+	result.WriteByte('$')
+
+	for _, group := range sha512CryptOrder {
+		encodeCrypt64(&result, uint(sum[group[0]])<<16|uint(sum[group[1]])<<8|uint(sum[group[2]]), 4)
+	}
+	encodeCrypt64(&result, uint(sum[63]), 2)
+
+	return result.String()
+}
+
+// sha512CryptOrder 输出 hash 时每 3 个字节一组的字节顺序
+var sha512CryptOrder = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+// apr1 为 Apache htpasswd 默认使用的 MD5 密码（htpasswd -m），算法与 crypt(3) 的 $1$ 相同，只是前缀不同
+//
+//	$apr1$<salt>$<hash>
+
+const (
+	apr1Prefix   = "$apr1$"
+	apr1SaltSize = 8
+	apr1Rounds   = 1000
+)
+
+func hashAPR1(password string) (string, error) {
+	raw, err := salt(apr1SaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	s := make([]byte, apr1SaltSize)
+	for i, b := range raw {
+		s[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+
+	return md5Crypt([]byte(password), s, apr1Prefix), nil
+}
+
+func verifyAPR1(hashed string, password string) error {
+	if !strings.HasPrefix(hashed, apr1Prefix) {
+		return fmt.Errorf("invalid apr1 password: must start with %s", apr1Prefix)
+	}
+
+	rest := strings.TrimPrefix(hashed, apr1Prefix)
+	pos := strings.IndexByte(rest, '$')
+	if pos < 0 {
+		return fmt.Errorf("invalid apr1 password: missing hash")
+	}
+
+	expected := md5Crypt([]byte(password), []byte(rest[:pos]), apr1Prefix)
+	return compare([]byte(hashed), []byte(expected))
+}
+
+// md5Crypt 按照 Poul-Henning Kamp 的 MD5 crypt 算法计算密码
+func md5Crypt(password []byte, s []byte, prefix string) string {
+	if len(s) > apr1SaltSize {
+		s = s[:apr1SaltSize]
+	}
+
+	alternate := md5.New()
+	alternate.Write(password)
+	alternate.Write(s)
+	alternate.Write(password)
+	alternateSum := alternate.Sum(nil)
+
+	digest := md5.New()
+	digest.Write(password)
+	digest.Write([]byte(prefix))
+	digest.Write(s)
+	for i := len(password); i > 0; i -= md5.Size {
+		if i > md5.Size {
+			digest.Write(alternateSum)
+		} else {
+			digest.Write(alternateSum[:i])
+		}
+	}
+
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write(password[:1])
+		}
+	}
+	sum := digest.Sum(nil)
+
+	for i := 0; i < apr1Rounds; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(password)
+		} else {
+			round.Write(sum)
+		}
+
+		if i%3 != 0 {
+			round.Write(s)
+		}
+
+		if i%7 != 0 {
+			round.Write(password)
+		}
+
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(password)
+		}
+
+		sum = round.Sum(nil)
+	}
+
+	var result strings.Builder
+	result.WriteString(prefix)
+	result.Write(s)
+	result.WriteByte('$')
+
+	for _, group := range md5CryptOrder {
+		encodeCrypt64(&result, uint(sum[group[0]])<<16|uint(sum[group[1]])<<8|uint(sum[group[2]]), 4)
+	}
+	encodeCrypt64(&result, uint(sum[11]), 2)
+
+	return result.String()
+}
+
+// md5CryptOrder 输出 hash 时每 3 个字节一组的字节顺序
+var md5CryptOrder = [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}}
+
+func encodeCrypt64(result *strings.Builder, value uint, n int) {
+	for i := 0; i < n; i++ {
+		result.WriteByte(cryptAlphabet[value&0x3f])
+		value >>= 6
+	}
+}
+
+func repeatBytes(data []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(data) {
+			n = len(data)
+		}
+		result = append(result, data[:n]...)
+	}
+
+	return result
+}
@@ -0,0 +1,125 @@
+// Package password 本地用户密码的加密以及校验
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/mylxsw/go-utils/str"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 本地用户 algo 支持的算法
+const (
+	Plain       = "plain"
+	Base64      = "base64"
+	Bcrypt      = "bcrypt"
+	Argon2id    = "argon2id"
+	Scrypt      = "scrypt"
+	SSHA        = "ssha"
+	SHA512Crypt = "sha512-crypt"
+	APR1        = "apr1"
+)
+
+// Algorithms 所有支持的算法，algo 为空时等同于 plain
+var Algorithms = []string{Plain, Base64, Bcrypt, Argon2id, Scrypt, SSHA, SHA512Crypt, APR1}
+
+// HashAlgorithms 可以用于加密新密码的算法，ssha 只使用一次 SHA1、apr1 基于 MD5，仅用于从其它系统导入密码
+var HashAlgorithms = []string{Bcrypt, Argon2id, Scrypt, SHA512Crypt}
+
+// ErrMismatch 密码不匹配
+var ErrMismatch = errors.New("password mismatch")
+
+// IsPlaintext 判断算法是否以明文（或者可以直接还原为明文的方式）保存密码
+func IsPlaintext(algo string) bool {
+	return algo == "" || algo == Plain || algo == Base64
+}
+
+// Supported 判断是否支持该算法
+func Supported(algo string) bool {
+	return algo == "" || str.In(algo, Algorithms)
+}
+
+// Hashable 判断算法是否可以用于加密新密码
+func Hashable(algo string) bool {
+	return str.In(algo, HashAlgorithms)
+}
+
+// Hash 使用 algo 加密密码，返回保存在配置文件中的密码
+func Hash(algo string, password string) (string, error) {
+	switch algo {
+	case "", Plain:
+		return password, nil
+	case Base64:
+		return base64.StdEncoding.EncodeToString([]byte(password)), nil
+	case Bcrypt:
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hashed), err
+	case Argon2id:
+		return hashArgon2id(password)
+	case Scrypt:
+		return hashScrypt(password)
+	case SSHA:
+		return hashSSHA(password)
+	case SHA512Crypt:
+		return hashSHA512Crypt(password)
+	case APR1:
+		return hashAPR1(password)
+	}
+
+	return "", fmt.Errorf("unsupported password algorithm %s", algo)
+}
+
+// Verify 校验密码，密码匹配时返回 nil，不匹配时返回 ErrMismatch，保存的密码格式不正确时返回其它错误
+func Verify(algo string, hashed string, password string) error {
+	switch algo {
+	case "", Plain:
+		return compare([]byte(hashed), []byte(password))
+	case Base64:
+		saved, err := base64.StdEncoding.DecodeString(hashed)
+		if err != nil {
+			return fmt.Errorf("invalid base64 password: %v", err)
+		}
+
+		return compare(saved, []byte(password))
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatch
+		}
+
+		return err
+	case Argon2id:
+		return verifyArgon2id(hashed, password)
+	case Scrypt:
+		return verifyScrypt(hashed, password)
+	case SSHA:
+		return verifySSHA(hashed, password)
+	case SHA512Crypt:
+		return verifySHA512Crypt(hashed, password)
+	case APR1:
+		return verifyAPR1(hashed, password)
+	}
+
+	return fmt.Errorf("unsupported password algorithm %s", algo)
+}
+
+func compare(expected []byte, actual []byte) error {
+	if subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return ErrMismatch
+	}
+
+	return nil
+}
+
+func salt(size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,121 @@
+package password
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestVerifyKnownVectors 使用其它实现生成的密码校验：sha512-crypt 为 glibc crypt(3) 以及 Drepper 规范中的测试向量，
+// apr1 由 openssl passwd -apr1 生成，bcrypt 为 OpenBSD 的测试向量，argon2id 为参考实现的测试向量，
+// scrypt 为 RFC 7914 的测试向量
+func TestVerifyKnownVectors(t *testing.T) {
+	tests := []struct {
+		algo     string
+		hashed   string
+		password string
+	}{
+		{algo: Plain, hashed: "secret", password: "secret"},
+		{algo: "", hashed: "secret", password: "secret"},
+		{algo: Base64, hashed: "c2VjcmV0", password: "secret"},
+		{algo: SHA512Crypt, hashed: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", password: "Hello world!"},
+		{algo: SHA512Crypt, hashed: "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", password: "Hello world!"},
+		{algo: SHA512Crypt, hashed: "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0", password: "This is just a test"},
+		{algo: SHA512Crypt, hashed: "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1", password: "a very much longer text to encrypt.  This one even stretches over morethan one line."},
+		{algo: SHA512Crypt, hashed: "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.", password: "the minimum number is still observed"},
+		{algo: APR1, hashed: "$apr1$rtP9aJdy$vLamVL9TxiP2SroN6nOoj/", password: "Hello world!"},
+		{algo: APR1, hashed: "$apr1$12345678$0NJU6izOW5MGH4BL2C/sK/", password: "pässwörd"},
+		{algo: SSHA, hashed: "{SSHA}A4Nhhw+nNx5Po+RFjQIHvHl5tp6KEwceVbKQTA==", password: "secret"},
+		{algo: SSHA, hashed: "{ssha}A4Nhhw+nNx5Po+RFjQIHvHl5tp6KEwceVbKQTA==", password: "secret"},
+		{algo: SSHA, hashed: "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", password: "secret"},
+		{algo: Bcrypt, hashed: "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", password: "U*U"},
+		{algo: Argon2id, hashed: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", password: "password"},
+		{algo: Scrypt, hashed: "$scrypt$ln=10,r=8,p=16$TmFDbA$/bq+HJ00cgB4VucZDQHp/nxq18vII3gw53N2Y0s3MWIurzDZLiKjiG/xCSedmDDaxyevuUqD7m2DYMvfoswGQA", password: "password"},
+		// passlib 生成的 scrypt 密码使用 . 代替 +
+		{algo: Scrypt, hashed: "$scrypt$ln=10,r=8,p=16$TmFDbA$/bq.HJ00cgB4VucZDQHp/nxq18vII3gw53N2Y0s3MWIurzDZLiKjiG/xCSedmDDaxyevuUqD7m2DYMvfoswGQA", password: "password"},
+		{algo: Scrypt, hashed: "$scrypt$ln=4,r=8,p=1$AAECAwQFBgcICQoLDA0ODw$YS0n/chNhzpLhADNCgDufxTTrJzNvexT9eayccEeaLc", password: "hunter2"},
+	}
+
+	for _, tt := range tests {
+		if err := Verify(tt.algo, tt.hashed, tt.password); err != nil {
+			t.Errorf("Verify(%q, %q): %v", tt.algo, tt.hashed, err)
+		}
+
+		if err := Verify(tt.algo, tt.hashed, tt.password+"x"); !errors.Is(err, ErrMismatch) {
+			t.Errorf("Verify(%q, %q) with wrong password: got %v, want %v", tt.algo, tt.hashed, err, ErrMismatch)
+		}
+	}
+}
+
+// TestSHA512CryptRounds rounds 小于 1000 时按照 1000 计算
+func TestSHA512CryptRounds(t *testing.T) {
+	want := "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."
+	if got := sha512Crypt([]byte("the minimum number is still observed"), []byte("roundstoolow"), 10, true); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, algo := range Algorithms {
+		hashed, err := Hash(algo, "pässwörd")
+		if err != nil {
+			t.Errorf("Hash(%q): %v", algo, err)
+			continue
+		}
+
+		if err := Verify(algo, hashed, "pässwörd"); err != nil {
+			t.Errorf("Verify(%q, %q): %v", algo, hashed, err)
+		}
+
+		if err := Verify(algo, hashed, "password"); !errors.Is(err, ErrMismatch) {
+			t.Errorf("Verify(%q, %q) with wrong password: got %v, want %v", algo, hashed, err, ErrMismatch)
+		}
+
+		// 每次加密使用不同的 salt
+		if again, _ := Hash(algo, "pässwörd"); !IsPlaintext(algo) && again == hashed {
+			t.Errorf("Hash(%q) returns the same result twice: %s", algo, hashed)
+		}
+	}
+
+	if _, err := Hash("md5", "secret"); err == nil {
+		t.Error("Hash with unsupported algorithm should fail")
+	}
+}
+
+// TestVerifyMalformed 保存的密码格式不正确时返回错误，而不是 ErrMismatch
+func TestVerifyMalformed(t *testing.T) {
+	tests := []struct {
+		algo   string
+		hashed string
+	}{
+		{algo: "md5", hashed: "5ebe2294ecd0e0f08eab7690d2a6ee69"},
+		{algo: Base64, hashed: "not base64!"},
+		{algo: Bcrypt, hashed: "$2a$05$short"},
+		{algo: Bcrypt, hashed: "secret"},
+		{algo: SSHA, hashed: "secret"},
+		{algo: SSHA, hashed: "{SSHA}not base64!"},
+		{algo: SSHA, hashed: "{SSHA}c2hvcnQ="},
+		{algo: SSHA, hashed: "{SHA}c2hvcnQ="},
+		{algo: SHA512Crypt, hashed: "$5$saltstring$hash"},
+		{algo: SHA512Crypt, hashed: "$6$saltstring"},
+		{algo: SHA512Crypt, hashed: "$6$rounds=abc$saltstring$hash"},
+		{algo: SHA512Crypt, hashed: "$6$rounds=5000"},
+		{algo: APR1, hashed: "$1$rtP9aJdy$vLamVL9TxiP2SroN6nOoj/"},
+		{algo: APR1, hashed: "$apr1$rtP9aJdy"},
+		{algo: Argon2id, hashed: "$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{algo: Argon2id, hashed: "$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{algo: Argon2id, hashed: "$argon2id$v=19$m=65536,t=2$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{algo: Argon2id, hashed: "$argon2id$v=19$m=65536,t=2,p=256$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{algo: Argon2id, hashed: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$"},
+		{algo: Argon2id, hashed: "$argon2id$v=19$m=65536,t=2,p=1$!!!$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{algo: Scrypt, hashed: "$scrypt$ln=4,r=8$AAECAwQFBgcICQoLDA0ODw$YS0n/chNhzpLhADNCgDufxTTrJzNvexT9eayccEeaLc"},
+		{algo: Scrypt, hashed: "$scrypt$ln=32,r=8,p=1$AAECAwQFBgcICQoLDA0ODw$YS0n/chNhzpLhADNCgDufxTTrJzNvexT9eayccEeaLc"},
+		{algo: Scrypt, hashed: "$scrypt$ln=4,r=8,p=1,x$AAECAwQFBgcICQoLDA0ODw$YS0n/chNhzpLhADNCgDufxTTrJzNvexT9eayccEeaLc"},
+		{algo: Scrypt, hashed: "$scrypt$ln=4,r=8,p=1$AAECAwQFBgcICQoLDA0ODw"},
+	}
+
+	for _, tt := range tests {
+		if err := Verify(tt.algo, tt.hashed, "secret"); err == nil || errors.Is(err, ErrMismatch) {
+			t.Errorf("Verify(%q, %q): got %v, want a format error", tt.algo, tt.hashed, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package password
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// argon2id 以及 scrypt 使用 PHC 字符串格式保存，salt 以及 hash 使用不带填充的 base64 编码
+//
+//	$argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+//	$scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//
+// 兼容 passlib 生成的 scrypt 密码（base64 中使用 . 代替 +）
+
+const (
+	argon2Memory  = 64 * 1024
+	argon2Time    = 1
+	argon2Threads = 4
+
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	phcSaltSize = 16
+	phcKeySize  = 32
+)
+
+func hashArgon2id(password string) (string, error) {
+	s, err := salt(phcSaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), s, argon2Time, argon2Memory, argon2Threads, phcKeySize)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads, encodePHC(s), encodePHC(key),
+	), nil
+}
+
+func verifyArgon2id(hashed string, password string) error {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != Argon2id {
+		return fmt.Errorf("invalid argon2id password: must be $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>")
+	}
+
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return fmt.Errorf("invalid argon2id password: unsupported version %s", parts[2])
+	}
+
+	params, err := phcParams(parts[3], "m", "t", "p")
+	if err != nil {
+		return fmt.Errorf("invalid argon2id password: %v", err)
+	}
+
+	if params["p"] > 255 {
+		return fmt.Errorf("invalid argon2id password: p must be less than 256")
+	}
+
+	s, key, err := decodeSaltAndKey(parts[4], parts[5])
+	if err != nil {
+		return fmt.Errorf("invalid argon2id password: %v", err)
+	}
+
+	actual := argon2.IDKey([]byte(password), s, uint32(params["t"]), uint32(params["m"]), uint8(params["p"]), uint32(len(key)))
+	return compare(key, actual)
+}
+
+func hashScrypt(password string) (string, error) {
+	s, err := salt(phcSaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), s, 1<<scryptLogN, scryptR, scryptP, phcKeySize)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", scryptLogN, scryptR, scryptP, encodePHC(s), encodePHC(key)), nil
+}
+
+func verifyScrypt(hashed string, password string) error {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != Scrypt {
+		return fmt.Errorf("invalid scrypt password: must be $scrypt$ln=<log2 N>,r=<block size>,p=<parallelism>$<salt>$<hash>")
+	}
+
+	params, err := phcParams(parts[2], "ln", "r", "p")
+	if err != nil {
+		return fmt.Errorf("invalid scrypt password: %v", err)
+	}
+
+	if params["ln"] >= 32 {
+		return fmt.Errorf("invalid scrypt password: ln must be less than 32")
+	}
+
+	s, key, err := decodeSaltAndKey(parts[3], parts[4])
+	if err != nil {
+		return fmt.Errorf("invalid scrypt password: %v", err)
+	}
+
+	actual, err := scrypt.Key([]byte(password), s, 1<<params["ln"], int(params["r"]), int(params["p"]), len(key))
+	if err != nil {
+		return fmt.Errorf("invalid scrypt password: %v", err)
+	}
+
+	return compare(key, actual)
+}
+
+// phcParams 解析 m=65536,t=1,p=4 格式的参数，names 中的参数都是必须的
+func phcParams(encoded string, names ...string) (map[string]uint64, error) {
+	params := make(map[string]uint64)
+	for _, param := range strings.Split(encoded, ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid parameter %q", param)
+		}
+
+		value, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter %q", param)
+		}
+
+		params[kv[0]] = value
+	}
+
+	for _, name := range names {
+		if params[name] == 0 {
+			return nil, fmt.Errorf("parameter %s is required", name)
+		}
+	}
+
+	return params, nil
+}
+
+func decodeSaltAndKey(encodedSalt string, encodedKey string) ([]byte, []byte, error) {
+	s, err := decodePHC(encodedSalt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid salt: %v", err)
+	}
+
+	key, err := decodePHC(encodedKey)
+	if err != nil || len(key) == 0 {
+		return nil, nil, fmt.Errorf("invalid hash")
+	}
+
+	return s, key, nil
+}
+
+func encodePHC(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
+
+func decodePHC(encoded string) ([]byte, error) {
+	encoded = strings.ReplaceAll(strings.TrimRight(encoded, "="), ".", "+")
+	return base64.RawStdEncoding.DecodeString(encoded)
+}
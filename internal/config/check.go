@@ -0,0 +1,110 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// invalidFieldPattern 配置校验错误的格式为 invalid <配置项>: <原因>
+var invalidFieldPattern = regexp.MustCompile(`^invalid (\S+):`)
+
+// ruleWarningPattern 规则警告以规则在配置文件中的位置开头，如 shares[1].rules[2]
+var ruleWarningPattern = regexp.MustCompile(`^((shares\[\d+\]\.)?rules\[\d+\])`)
+
+var fieldSegmentPattern = regexp.MustCompile(`([^.\[\]]+)|\[(\d+)\]`)
+
+// Check 对配置文件执行完整的检查，返回配置错误以及警告，错误以及警告中包含所在的行号
+//
+// 警告包括未知的配置项（通常是拼写错误，服务启动时会被忽略）以及 Warnings 中可能存在问题的规则
+func Check(configPath string) ([]string, error) {
+	conf, err := LoadConfFromFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := make([]string, 0)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&Config{}); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, err
+		}
+
+		warnings = append(warnings, typeErr.Errors...)
+	}
+
+	return append(warnings, conf.Warnings()...), nil
+}
+
+// withRuleLine 在规则警告中添加规则所在的行号
+func withRuleLine(data []byte, warning string) string {
+	if matched := ruleWarningPattern.FindStringSubmatch(warning); matched != nil {
+		if line := fieldLine(data, matched[1]); line > 0 {
+			return fmt.Sprintf("line %d: %s", line, warning)
+		}
+	}
+
+	return warning
+}
+
+// withFieldLine 在配置校验错误中添加出错的配置项所在的行号
+func withFieldLine(data []byte, err error) error {
+	matched := invalidFieldPattern.FindStringSubmatch(err.Error())
+	if matched == nil {
+		return err
+	}
+
+	if line := fieldLine(data, matched[1]); line > 0 {
+		return fmt.Errorf("line %d: %w", line, err)
+	}
+
+	return err
+}
+
+// fieldLine 返回配置项（如 shares[1].rules[2].path）在配置文件中的行号，配置项不存在时（如使用默认值的配置项）
+// 返回最近的上级配置项的行号，无法确定时返回 0
+func fieldLine(data []byte, field string) int {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return 0
+	}
+
+	node, line := doc.Content[0], 0
+	for _, segment := range fieldSegmentPattern.FindAllStringSubmatch(field, -1) {
+		var next *yaml.Node
+		switch {
+		case segment[2] != "" && node.Kind == yaml.SequenceNode:
+			if index, _ := strconv.Atoi(segment[2]); index < len(node.Content) {
+				next = node.Content[index]
+			}
+		case segment[1] != "" && node.Kind == yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == segment[1] {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		node, line = next, next.Line
+	}
+
+	return line
+}
@@ -5,20 +5,35 @@ import (
 	"fmt"
 	"github.com/mylxsw/go-utils/file"
 	"github.com/mylxsw/go-utils/str"
+	"github.com/mylxsw/webdav-server/internal/auth/password"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"os"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// access_mode 预设的权限组合，对应的权限见 accessModePresets
 const (
-	AccessModeNone  = "none"
-	AccessModeRead  = "read"
-	AccessModeWrite = "write"
+	AccessModeNone   = "none"
+	AccessModeRead   = "read"
+	AccessModeWrite  = "write"
+	AccessModeUpload = "upload"
+	AccessModeAppend = "append"
 )
 
 type Config struct {
+	// path 加载配置的文件路径，用于重新加载配置
+	path string
+	// warnings 加载配置时发现的规则警告，包含规则所在的行号
+	warnings []string
+
 	Verbose bool `json:"verbose" yaml:"verbose,omitempty"`
+	// WatchConfig 监听配置文件的变化，配置文件修改后自动重新加载，也可以通过 SIGHUP 信号手动重新加载
+	WatchConfig bool `json:"watch_config" yaml:"watch_config,omitempty"`
 
 	Listen             string `json:"listen" yaml:"listen,omitempty"`
 	HTTPS              bool   `json:"https" yaml:"https"`
@@ -27,39 +42,392 @@ type Config struct {
 	ClientRealIPHeader string `json:"client_ip_header" yaml:"client_ip_header,omitempty"`
 
 	LogPath     string `json:"log_path" yaml:"log_path,omitempty"`
+	DataDir     string `json:"data_dir" yaml:"data_dir,omitempty"`
 	CacheDriver string `json:"cache_driver" yaml:"cache_driver"`
+	LockDriver  string `json:"lock_driver" yaml:"lock_driver,omitempty"`
+	PropsDriver string `json:"props_driver" yaml:"props_driver,omitempty"`
 	AuthType    string `json:"auth_type" yaml:"auth_type"`
 
-	Server Server `json:"server" yaml:"server"`
-	Rules  []Rule `json:"rules" yaml:"rules"`
+	Server Server  `json:"server" yaml:"server"`
+	Rules  []Rule  `json:"rules" yaml:"rules"`
+	Shares []Share `json:"shares,omitempty" yaml:"shares,omitempty"`
+
+	LDAP     LDAP     `json:"ldap" yaml:"ldap,omitempty"`
+	Htpasswd Htpasswd `json:"htpasswd" yaml:"htpasswd,omitempty"`
+	Users    Users    `json:"users,omitempty" yaml:"users,omitempty"`
+	Redis    Redis    `json:"redis" yaml:"redis,omitempty"`
+	Quotas   Quotas   `json:"quotas,omitempty" yaml:"quotas,omitempty"`
+}
+
+// Quotas 用户以及用户组的存储配额，用户的用量为其在所有共享中上传的文件总和，用户组的用量为组内成员用量之和
+type Quotas struct {
+	Users  map[string]Quota `json:"users,omitempty" yaml:"users,omitempty"`
+	Groups map[string]Quota `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+// Quota 存储配额，Bytes 支持 KB、MB、GB、TB 等单位（按 1024 进制计算），值为空或者 0 表示不限制
+type Quota struct {
+	bytes int64
+
+	Bytes string `json:"bytes,omitempty" yaml:"bytes,omitempty"`
+	Files int64  `json:"files,omitempty" yaml:"files,omitempty"`
+}
+
+// Limit 返回配额限制的字节数以及文件数，0 表示不限制
+func (quota Quota) Limit() (bytes int64, files int64) {
+	return quota.bytes, quota.Files
+}
 
-	LDAP  LDAP  `json:"ldap" yaml:"ldap,omitempty"`
-	Users Users `json:"users,omitempty" yaml:"users,omitempty"`
+// IsLimited 判断是否配置了配额限制
+func (quota Quota) IsLimited() bool {
+	return quota.bytes > 0 || quota.Files > 0
 }
 
-type UserGroupRules struct {
-	Users  map[string][]Rule
-	Groups map[string][]Rule
+func (quota Quota) validate() error {
+	if _, err := ParseByteSize(quota.Bytes); err != nil {
+		return err
+	}
+
+	if quota.Files < 0 {
+		return fmt.Errorf("files must not be negative")
+	}
+
+	return nil
 }
 
+func (quota Quota) populate() Quota {
+	quota.bytes, _ = ParseByteSize(quota.Bytes)
+	return quota
+}
+
+// QuotaEnabled 判断是否配置了任意的存储配额
+func (conf Config) QuotaEnabled() bool {
+	for _, share := range conf.Shares {
+		if share.Quota.IsLimited() {
+			return true
+		}
+	}
+
+	for _, quota := range conf.Quotas.Users {
+		if quota.IsLimited() {
+			return true
+		}
+	}
+
+	for _, quota := range conf.Quotas.Groups {
+		if quota.IsLimited() {
+			return true
+		}
+	}
+
+	return false
+}
+
+var byteSizePattern = regexp.MustCompile(`^(\d+)\s*([kmgtp]?)(i?b)?$`)
+
+// ParseByteSize 解析 10GB、512MiB、1024 这样的字节数
+func ParseByteSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+
+	matches := byteSizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(size)))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+
+	val, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if matches[2] == "" {
+		return val, nil
+	}
+
+	return val << (10 * (strings.Index("kmgtp", matches[2]) + 1)), nil
+}
+
+// Redis 连接配置
+type Redis struct {
+	Addr      string `json:"addr" yaml:"addr,omitempty"`
+	Password  string `json:"-" yaml:"password,omitempty"`
+	DB        int    `json:"db" yaml:"db,omitempty"`
+	KeyPrefix string `json:"key_prefix" yaml:"key_prefix,omitempty"`
+}
+
+const (
+	RuleEffectAllow = "allow"
+	RuleEffectDeny  = "deny"
+)
+
+// Rule 访问规则
+//
+// 规则按照 deny 优先的方式计算：用户的权限为共享默认权限与所有匹配的 allow 规则授予权限的并集，
+// 再去掉所有匹配的 deny 规则拒绝的权限，与规则的先后顺序无关
 type Rule struct {
-	pattern *regexp.Regexp
+	id         string
+	pattern    *regexp.Regexp
+	privileges *Privilege
+
+	// Path 匹配的路径，语法由 Match 决定，匹配的是相对于共享根目录的规范化路径，与共享的 prefix 无关，
+	// 例如 prefix 为 /builds 的共享中，请求 /builds/app/v1 时匹配的路径为 /app/v1，目录的路径以 / 结尾
+	Path string `json:"path" yaml:"path"`
+	// Match Path 的语法，regex（默认，POSIX 正则表达式）、glob（支持 *、?、[abc]、**）、prefix（路径前缀）
+	Match string `json:"match,omitempty" yaml:"match,omitempty"`
+	// Effect 规则的效果，allow（默认）授予 access_mode 中的权限，deny 拒绝 access_mode 中的权限
+	Effect string `json:"effect,omitempty" yaml:"effect,omitempty"`
+	// AccessMode 规则授予或者拒绝的权限，支持预设的 none|read|write|upload|append 以及逗号分隔的权限列表，
+	// allow 规则默认为 read，deny 规则默认为 write（拒绝所有权限）
+	AccessMode string `json:"access_mode" yaml:"access_mode"`
+	// Users、Groups 规则适用的用户以及用户组，* 表示所有用户
+	Users  []string `json:"users,omitempty" yaml:"users,omitempty"`
+	Groups []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+	// Hidden 匹配的文件以及目录不出现在目录列表中，仍然可以通过路径直接访问
+	Hidden bool `json:"hidden,omitempty" yaml:"hidden,omitempty"`
+}
 
-	Path       string   `json:"path" yaml:"path"`
-	AccessMode string   `json:"access_mode" yaml:"access_mode"`
-	Users      []string `json:"users,omitempty" yaml:"users,omitempty"`
-	Groups     []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+// ID 返回规则在配置文件中的位置，如 rules[0]、shares[1].rules[2]，用于日志输出
+func (rule Rule) ID() string {
+	return rule.id
 }
 
 func (rule Rule) Matched(path string) bool {
 	return rule.pattern.MatchString(path)
 }
 
+// Denied 判断是否为 deny 规则
+func (rule Rule) Denied() bool {
+	return rule.Effect == RuleEffectDeny
+}
+
+// AppliesTo 判断规则是否适用于用户
+func (rule Rule) AppliesTo(account string, groups []string) bool {
+	for _, user := range rule.Users {
+		if user == "*" || user == account {
+			return true
+		}
+	}
+
+	for _, group := range rule.Groups {
+		if group == "*" || str.In(group, groups) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate 规则合法性检查，错误信息中包含规则在配置文件中的位置
+func (rule Rule) validate() error {
+	if !str.In(rule.Match, []string{RuleMatchRegex, RuleMatchGlob, RuleMatchPrefix}) {
+		return fmt.Errorf("invalid %s.match: must be one of regex|glob|prefix", rule.ID())
+	}
+
+	if _, err := compileRulePattern(rule.Match, rule.Path); err != nil {
+		return fmt.Errorf("invalid %s.path: %v", rule.ID(), err)
+	}
+
+	if _, err := ParseAccessMode(rule.AccessMode); err != nil {
+		return fmt.Errorf("invalid %s.access_mode: %v", rule.ID(), err)
+	}
+
+	if !str.In(rule.Effect, []string{RuleEffectAllow, RuleEffectDeny}) {
+		return fmt.Errorf("invalid %s.effect: must be one of allow|deny", rule.ID())
+	}
+
+	return nil
+}
+
+// Privileges 返回规则授予或者拒绝的权限
+func (rule Rule) Privileges() Privilege {
+	if rule.privileges == nil {
+		privileges, _ := ParseAccessMode(rule.AccessMode)
+		return privileges
+	}
+
+	return *rule.privileges
+}
+
+// Server 单目录共享配置，未配置 shares 时作为名为 default 的共享使用
 type Server struct {
-	Scope      string `json:"scope" yaml:"scope"`
-	Prefix     string `json:"prefix" yaml:"prefix"`
-	NoSniff    bool   `json:"no_sniff" yaml:"no_sniff"`
+	Scope      string   `json:"scope" yaml:"scope"`
+	Prefix     string   `json:"prefix" yaml:"prefix"`
+	NoSniff    bool     `json:"no_sniff" yaml:"no_sniff"`
+	AccessMode string   `json:"access_mode" yaml:"access_mode,omitempty"`
+	AtomicPut  bool     `json:"atomic_put,omitempty" yaml:"atomic_put,omitempty"`
+	Trash      Trash    `json:"trash,omitempty" yaml:"trash,omitempty"`
+	Versions   Versions `json:"versions,omitempty" yaml:"versions,omitempty"`
+}
+
+// ScopeVariables 共享目录模板中支持的变量
+var ScopeVariables = []string{"account", "name", "uuid", "group"}
+
+var scopeVariablePattern = regexp.MustCompile(`{([^{}]*)}`)
+
+// Share 共享目录配置，每个共享拥有独立的目录、URL 前缀、默认访问权限以及规则
+type Share struct {
+	effectiveRules []Rule
+	ruleIndex      *ruleIndex
+	privileges     *Privilege
+
+	Name    string `json:"name" yaml:"name"`
+	Scope   string `json:"scope" yaml:"scope"`
+	Prefix  string `json:"prefix" yaml:"prefix"`
+	NoSniff bool   `json:"no_sniff" yaml:"no_sniff"`
+	// AccessMode 所有用户默认拥有的权限，支持预设的 none|read|write|upload|append 以及逗号分隔的权限列表
 	AccessMode string `json:"access_mode" yaml:"access_mode,omitempty"`
+	Rules      []Rule `json:"rules,omitempty" yaml:"rules,omitempty"`
+
+	// AutoCreate 目录不存在时自动创建，主要用于 scope 为模板（如 /data/home/{account}）的用户主目录
+	AutoCreate bool `json:"auto_create,omitempty" yaml:"auto_create,omitempty"`
+	// DirPerm 自动创建目录时使用的权限，八进制表示，默认 0700
+	DirPerm string `json:"dir_perm,omitempty" yaml:"dir_perm,omitempty"`
+	// AtomicPut 上传的文件先写入同一目录下的临时文件，上传成功后再替换目标文件，上传失败时原文件保持不变
+	AtomicPut bool `json:"atomic_put,omitempty" yaml:"atomic_put,omitempty"`
+	// Trash 回收站，开启后删除以及被覆盖的文件移动到回收站中
+	Trash Trash `json:"trash,omitempty" yaml:"trash,omitempty"`
+	// Versions 文件历史版本，开启后被覆盖的文件保存为历史版本
+	Versions Versions `json:"versions,omitempty" yaml:"versions,omitempty"`
+	// Quota 共享的存储配额，scope 为模板时，每个用户的目录单独计算
+	Quota Quota `json:"quota,omitempty" yaml:"quota,omitempty"`
+}
+
+// Trash 回收站配置
+type Trash struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Retention 文件在回收站中的保留时间，例如 720h，默认 720h（30 天），0 表示永久保留
+	Retention string `json:"retention,omitempty" yaml:"retention,omitempty"`
+}
+
+// RetentionDuration 返回回收站的保留时间，0 表示永久保留
+func (trash Trash) RetentionDuration() time.Duration {
+	retention, _ := time.ParseDuration(trash.Retention)
+	return retention
+}
+
+// Versions 文件历史版本配置
+type Versions struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// MaxVersions 每个文件最多保留的历史版本数量，默认 10
+	MaxVersions int `json:"max_versions,omitempty" yaml:"max_versions,omitempty"`
+	// MaxAge 历史版本的保留时间，例如 720h，为空表示不限制
+	MaxAge string `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+}
+
+// MaxAgeDuration 返回历史版本的保留时间，0 表示不限制
+func (versions Versions) MaxAgeDuration() time.Duration {
+	maxAge, _ := time.ParseDuration(versions.MaxAge)
+	return maxAge
+}
+
+// IsTemplate 判断共享目录是否为模板，模板目录需要根据当前登录用户解析
+func (share Share) IsTemplate() bool {
+	return scopeVariablePattern.MatchString(share.Scope)
+}
+
+// ResolveScope 使用变量替换共享目录模板中的占位符
+func (share Share) ResolveScope(vars map[string]string) (string, error) {
+	var resolveErr error
+	resolved := scopeVariablePattern.ReplaceAllStringFunc(share.Scope, func(placeholder string) string {
+		val, ok := vars[strings.Trim(placeholder, "{}")]
+		if !ok || val == "" || val == "." || val == ".." || strings.ContainsAny(val, "/\\\x00") {
+			resolveErr = fmt.Errorf("can not resolve %s in scope %s", placeholder, share.Scope)
+			return ""
+		}
+
+		return val
+	})
+
+	return resolved, resolveErr
+}
+
+// ScopeGlob 将共享目录模板中的占位符替换为通配符，用于查找所有用户已经创建的目录
+func (share Share) ScopeGlob() string {
+	return scopeVariablePattern.ReplaceAllString(share.Scope, "*")
+}
+
+// DirFileMode 返回自动创建目录时使用的权限
+func (share Share) DirFileMode() os.FileMode {
+	perm, err := strconv.ParseUint(share.DirPerm, 8, 32)
+	if err != nil {
+		return 0700
+	}
+
+	return os.FileMode(perm) & os.ModePerm
+}
+
+// EffectiveRules 返回共享实际生效的规则：共享自身的规则在前，全局规则在后
+func (share Share) EffectiveRules(globalRules []Rule) []Rule {
+	rules := make([]Rule, 0, len(share.Rules)+len(globalRules))
+	return append(append(rules, share.Rules...), globalRules...)
+}
+
+// Privileges 返回共享默认的访问权限
+func (share Share) Privileges() Privilege {
+	if share.privileges == nil {
+		privileges, _ := ParseAccessMode(share.AccessMode)
+		return privileges
+	}
+
+	return *share.privileges
+}
+
+// AppliedRules 返回共享实际生效的规则，包括全局规则
+func (share Share) AppliedRules() []Rule {
+	if share.effectiveRules == nil {
+		return share.Rules
+	}
+
+	return share.effectiveRules
+}
+
+// MatchedRules 返回匹配 rulePath（相对于共享根目录的规范化路径）的规则，包括全局规则
+func (share Share) MatchedRules(rulePath string) []Rule {
+	if share.ruleIndex == nil {
+		share.ruleIndex = newRuleIndex(share.AppliedRules())
+	}
+
+	return share.ruleIndex.Match(rulePath)
+}
+
+// CanonicalPath 返回规范化的请求路径：以 / 开头，合并重复的 /，解析 . 以及 .. 路径段，
+// 路径以 / 结尾（目录）时保留结尾的 /，requestPath 需要是已经完成百分号解码的路径
+func CanonicalPath(requestPath string) string {
+	cleaned := path.Clean("/" + requestPath)
+	if cleaned != "/" && strings.HasSuffix(requestPath, "/") {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// RelativePath 返回请求路径相对于共享根目录的规范化路径，规则使用该路径进行匹配，
+// 例如共享前缀为 /builds 时，/builds/app/../v1/ 返回 /v1/
+func (share Share) RelativePath(requestPath string) string {
+	canonical := CanonicalPath(requestPath)
+	if share.Prefix == "/" || share.Prefix == "" {
+		return canonical
+	}
+
+	if canonical == share.Prefix {
+		return "/"
+	}
+
+	if strings.HasPrefix(canonical, share.Prefix+"/") {
+		return canonical[len(share.Prefix):]
+	}
+
+	return canonical
+}
+
+// Contains 判断请求路径是否属于当前共享
+func (share Share) Contains(requestPath string) bool {
+	if share.Prefix == "/" || requestPath == share.Prefix {
+		return true
+	}
+
+	return strings.HasPrefix(requestPath, share.Prefix+"/")
 }
 
 // populateDefault 填充默认值
@@ -76,6 +444,26 @@ func (conf Config) populateDefault() Config {
 		conf.Listen = ":8080"
 	}
 
+	if conf.DataDir == "" {
+		conf.DataDir = "./data"
+	}
+
+	if conf.LockDriver == "" {
+		conf.LockDriver = "memory"
+	}
+
+	if conf.PropsDriver == "" {
+		conf.PropsDriver = "bolt"
+	}
+
+	if conf.Redis.Addr == "" {
+		conf.Redis.Addr = "127.0.0.1:6379"
+	}
+
+	if conf.Redis.KeyPrefix == "" {
+		conf.Redis.KeyPrefix = "webdav-server"
+	}
+
 	if conf.LDAP.DisplayName == "" {
 		conf.LDAP.DisplayName = "displayName"
 	}
@@ -93,20 +481,118 @@ func (conf Config) populateDefault() Config {
 	}
 	conf.Server.AccessMode = strings.ToLower(conf.Server.AccessMode)
 
-	for i, rule := range conf.Rules {
-		conf.Rules[i].pattern = regexp.MustCompilePOSIX(rule.Path)
-		if rule.AccessMode == "" {
-			conf.Rules[i].AccessMode = AccessModeRead
+	conf.Rules = populateRules(conf.Rules, "rules")
+
+	for account, quota := range conf.Quotas.Users {
+		conf.Quotas.Users[account] = quota.populate()
+	}
+
+	for group, quota := range conf.Quotas.Groups {
+		conf.Quotas.Groups[group] = quota.populate()
+	}
+
+	// 未配置 shares 时，使用 server 配置作为唯一的共享
+	if len(conf.Shares) == 0 {
+		conf.Shares = []Share{{
+			Name:       "default",
+			Scope:      conf.Server.Scope,
+			Prefix:     conf.Server.Prefix,
+			NoSniff:    conf.Server.NoSniff,
+			AccessMode: conf.Server.AccessMode,
+			AtomicPut:  conf.Server.AtomicPut,
+			Trash:      conf.Server.Trash,
+			Versions:   conf.Server.Versions,
+		}}
+	}
+
+	for i, share := range conf.Shares {
+		if share.Scope == "" {
+			conf.Shares[i].Scope = "."
+		}
+
+		conf.Shares[i].Prefix = path.Clean("/" + share.Prefix)
+
+		if share.AccessMode == "" {
+			conf.Shares[i].AccessMode = AccessModeRead
 		}
+
+		if share.DirPerm == "" {
+			conf.Shares[i].DirPerm = "0700"
+		}
+
+		if share.Trash.Retention == "" {
+			conf.Shares[i].Trash.Retention = "720h"
+		}
+
+		if share.Versions.MaxVersions == 0 {
+			conf.Shares[i].Versions.MaxVersions = 10
+		}
+
+		conf.Shares[i].Quota = share.Quota.populate()
+		conf.Shares[i].AccessMode = strings.ToLower(conf.Shares[i].AccessMode)
+		if privileges, err := ParseAccessMode(conf.Shares[i].AccessMode); err == nil {
+			conf.Shares[i].privileges = &privileges
+		}
+
+		// 全局规则对所有共享生效，优先级低于共享自身的规则
+		conf.Shares[i].Rules = populateRules(share.Rules, fmt.Sprintf("shares[%d].rules", i))
+		conf.Shares[i].effectiveRules = conf.Shares[i].EffectiveRules(conf.Rules)
+		conf.Shares[i].ruleIndex = newRuleIndex(conf.Shares[i].effectiveRules)
 	}
 
 	return conf
 }
 
+// populateRules 填充规则默认值，prefix 为规则在配置文件中的位置
+func populateRules(rules []Rule, prefix string) []Rule {
+	for i, rule := range rules {
+		rules[i].id = fmt.Sprintf("%s[%d]", prefix, i)
+
+		rules[i].Match = strings.ToLower(rule.Match)
+		if rules[i].Match == "" {
+			rules[i].Match = RuleMatchRegex
+		}
+
+		if pattern, err := compileRulePattern(rules[i].Match, rule.Path); err == nil {
+			rules[i].pattern = pattern
+		}
+
+		rules[i].Effect = strings.ToLower(rule.Effect)
+		if rules[i].Effect == "" {
+			rules[i].Effect = RuleEffectAllow
+		}
+
+		if rule.AccessMode == "" {
+			rules[i].AccessMode = AccessModeRead
+			if rules[i].Denied() {
+				rules[i].AccessMode = AccessModeWrite
+			}
+		}
+
+		if privileges, err := ParseAccessMode(rules[i].AccessMode); err == nil {
+			rules[i].privileges = &privileges
+		}
+	}
+
+	return rules
+}
+
 // validate 配置合法性检查
 func (conf Config) validate() error {
-	if !str.In(conf.AuthType, []string{"misc", "ldap", "local"}) {
-		return fmt.Errorf("invalid auth_type: must be one of misc|local|ldap")
+	if !str.In(conf.AuthType, []string{"misc", "ldap", "local", "htpasswd"}) {
+		return fmt.Errorf("invalid auth_type: must be one of misc|local|ldap|htpasswd")
+	}
+
+	if conf.AuthType == "htpasswd" && conf.Htpasswd.File == "" {
+		return fmt.Errorf("invalid htpasswd.file: file is required when auth_type=htpasswd")
+	}
+
+	if !str.In(conf.LockDriver, []string{"memory", "bolt", "redis"}) {
+		return fmt.Errorf("invalid lock_driver: must be one of memory|bolt|redis")
+	}
+
+	if !str.In(conf.PropsDriver, []string{"none", "bolt"}) {
+		return fmt.Errorf("invalid props_driver: must be one of none|bolt")
 	}
 
 	if conf.HTTPS {
@@ -119,13 +605,105 @@ func (conf Config) validate() error {
 		}
 	}
 
-	if !str.In(conf.Server.AccessMode, []string{AccessModeNone, AccessModeRead, AccessModeWrite}) {
-		return fmt.Errorf("invalid server.access_mode: must be one of none|read|write")
+	if _, err := ParseAccessMode(conf.Server.AccessMode); err != nil {
+		return fmt.Errorf("invalid server.access_mode: %v", err)
 	}
 
-	for i, rule := range conf.Rules {
-		if _, err := regexp.CompilePOSIX(rule.Path); err != nil {
-			return fmt.Errorf("invalid rules[%d].path: %v", i, err)
+	for _, rule := range conf.Rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	if !password.Hashable(conf.Users.PasswordPolicy.PreferredAlgo()) {
+		return fmt.Errorf("invalid users.password_policy.preferred: must be one of %s", strings.Join(password.HashAlgorithms, "|"))
+	}
+
+	accounts := make(map[string]bool)
+	for i, user := range conf.Users.Local {
+		if user.Account == "" {
+			return fmt.Errorf("invalid users.local[%d].account: account is required", i)
+		}
+
+		if accounts[user.Account] {
+			return fmt.Errorf("invalid users.local[%d].account: duplicate account %s", i, user.Account)
+		}
+		accounts[user.Account] = true
+
+		if !password.Supported(user.Algo) {
+			return fmt.Errorf("invalid users.local[%d].algo: must be one of %s", i, strings.Join(password.Algorithms, "|"))
+		}
+
+		if conf.Users.PasswordPolicy.RejectPlaintext && password.IsPlaintext(user.Algo) {
+			return fmt.Errorf("invalid users.local[%d].algo: plaintext password of %s is rejected by users.password_policy.reject_plaintext, run the encrypt action of the tool to hash it", i, user.Account)
+		}
+	}
+
+	for account, quota := range conf.Quotas.Users {
+		if err := quota.validate(); err != nil {
+			return fmt.Errorf("invalid quotas.users.%s: %v", account, err)
+		}
+	}
+
+	for group, quota := range conf.Quotas.Groups {
+		if err := quota.validate(); err != nil {
+			return fmt.Errorf("invalid quotas.groups.%s: %v", group, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for i, share := range conf.Shares {
+		if share.Name == "" {
+			return fmt.Errorf("invalid shares[%d].name: name is required", i)
+		}
+
+		if names[share.Name] {
+			return fmt.Errorf("invalid shares[%d].name: duplicate share name %s", i, share.Name)
+		}
+		names[share.Name] = true
+
+		if prefixes[share.Prefix] {
+			return fmt.Errorf("invalid shares[%d].prefix: duplicate share prefix %s", i, share.Prefix)
+		}
+		prefixes[share.Prefix] = true
+
+		if _, err := ParseAccessMode(share.AccessMode); err != nil {
+			return fmt.Errorf("invalid shares[%d].access_mode: %v", i, err)
+		}
+
+		for _, placeholder := range scopeVariablePattern.FindAllStringSubmatch(share.Scope, -1) {
+			if !str.In(placeholder[1], ScopeVariables) {
+				return fmt.Errorf("invalid shares[%d].scope: unknown variable {%s}, must be one of %s", i, placeholder[1], strings.Join(ScopeVariables, "|"))
+			}
+		}
+
+		if perm, err := strconv.ParseUint(share.DirPerm, 8, 32); err != nil || perm > 0777 {
+			return fmt.Errorf("invalid shares[%d].dir_perm: must be an octal permission such as 0700", i)
+		}
+
+		if err := share.Quota.validate(); err != nil {
+			return fmt.Errorf("invalid shares[%d].quota: %v", i, err)
+		}
+
+		if retention, err := time.ParseDuration(share.Trash.Retention); err != nil || retention < 0 {
+			return fmt.Errorf("invalid shares[%d].trash.retention: must be a duration such as 720h", i)
+		}
+
+		if share.Versions.MaxVersions < 0 {
+			return fmt.Errorf("invalid shares[%d].versions.max_versions: must not be negative", i)
+		}
+
+		if share.Versions.MaxAge != "" {
+			if maxAge, err := time.ParseDuration(share.Versions.MaxAge); err != nil || maxAge < 0 {
+				return fmt.Errorf("invalid shares[%d].versions.max_age: must be a duration such as 720h", i)
+			}
+		}
+
+		for _, rule := range share.Rules {
+			if err := rule.validate(); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -143,11 +721,45 @@ type LDAP struct {
 	UserFilter  string `json:"user_filter" yaml:"user_filter,omitempty"`
 }
 
+// Htpasswd Apache htpasswd 文件认证配置，文件修改后自动重新加载
+type Htpasswd struct {
+	// File htpasswd 文件路径，支持 bcrypt、{SHA}、$apr1$ 以及 $6$ 格式的密码
+	File string `json:"file" yaml:"file,omitempty"`
+	// GroupFile 可选的 Apache 用户组文件（AuthGroupFile），每行格式为 group: user1 user2
+	GroupFile string `json:"group_file" yaml:"group_file,omitempty"`
+}
+
 // Users 用户配置
 type Users struct {
 	IgnoreAccountSuffix string      `json:"ignore_account_suffix" yaml:"ignore_account_suffix,omitempty"`
 	Local               []LocalUser `json:"local,omitempty" yaml:"local,omitempty"`
 	LDAP                []LDAPUser  `json:"ldap,omitempty" yaml:"ldap,omitempty"`
+	// PasswordPolicy 本地用户的密码策略
+	PasswordPolicy PasswordPolicy `json:"password_policy" yaml:"password_policy,omitempty"`
+}
+
+// PasswordPolicy 本地用户密码策略
+type PasswordPolicy struct {
+	// Preferred 新密码以及升级密码时使用的算法，支持 bcrypt|argon2id|scrypt|sha512-crypt，默认为 bcrypt
+	Preferred string `json:"preferred" yaml:"preferred,omitempty"`
+	// RejectPlaintext 为 true 时，algo 为空、plain 或者 base64 的本地用户会导致配置校验失败
+	RejectPlaintext bool `json:"reject_plaintext" yaml:"reject_plaintext,omitempty"`
+	// Upgrade 为 true 时，本地用户登录成功后，将使用其它算法保存的密码按照 Preferred 算法重新加密并写回配置文件
+	Upgrade bool `json:"upgrade" yaml:"upgrade,omitempty"`
+}
+
+// PreferredAlgo 返回新密码使用的算法
+func (policy PasswordPolicy) PreferredAlgo() string {
+	if policy.Preferred == "" {
+		return password.Bcrypt
+	}
+
+	return policy.Preferred
+}
+
+// ShouldUpgrade 判断使用 algo 保存的密码登录成功后是否需要升级
+func (policy PasswordPolicy) ShouldUpgrade(algo string) bool {
+	return policy.Upgrade && algo != policy.PreferredAlgo()
 }
 
 // LDAPUser ldap 用户配置
@@ -206,6 +818,22 @@ func LoadConfFromFile(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	conf, err := loadConf(data)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.path = configPath
+	return conf, nil
+}
+
+// Path 返回加载配置的文件路径
+func (conf Config) Path() string {
+	return conf.path
+}
+
+// loadConf 解析配置内容，填充默认值并检查配置是否合法
+func loadConf(data []byte) (*Config, error) {
 	var conf Config
 	if err := yaml.Unmarshal(data, &conf); err != nil {
 		return nil, err
@@ -213,8 +841,17 @@ func LoadConfFromFile(configPath string) (*Config, error) {
 
 	conf = conf.populateDefault()
 	if err := conf.validate(); err != nil {
-		return nil, err
+		return nil, withFieldLine(data, err)
+	}
+
+	for _, warning := range conf.RuleWarnings() {
+		conf.warnings = append(conf.warnings, withRuleLine(data, warning))
 	}
 
 	return &conf, nil
 }
+
+// Warnings 返回加载配置时发现的规则警告，警告以规则所在的行号开头，配置仍然可以正常使用
+func (conf Config) Warnings() []string {
+	return conf.warnings
+}
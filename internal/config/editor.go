@@ -0,0 +1,658 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Editor 直接修改配置文件中的 yaml 节点，保留注释以及配置项的顺序，不会写入 populateDefault 填充的默认值
+//
+// 保存时只替换配置文件中 users.local 所在的内容，文件的其它部分保持不变
+type Editor struct {
+	path string
+	data []byte
+	doc  yaml.Node
+	// dirty 添加以及修改过的用户节点，保存时重新生成，其它用户保留配置文件中原来的内容
+	dirty map[*yaml.Node]bool
+}
+
+// OpenEditor 打开配置文件用于编辑
+func OpenEditor(configPath string) (*Editor, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&Editor{path: configPath, data: data}).parse()
+}
+
+func (editor *Editor) parse() (*Editor, error) {
+	if err := yaml.Unmarshal(editor.data, &editor.doc); err != nil {
+		return nil, err
+	}
+
+	if len(editor.doc.Content) == 0 {
+		editor.doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	if editor.doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file %s is not a yaml mapping", editor.path)
+	}
+
+	return editor, nil
+}
+
+// LocalUsers 返回配置文件中 users.local 的所有用户
+func (editor *Editor) LocalUsers() ([]LocalUser, error) {
+	users := make([]LocalUser, 0)
+
+	local := editor.localUsersNode(false)
+	if local == nil {
+		return users, nil
+	}
+
+	if err := local.Decode(&users); err != nil {
+		return nil, fmt.Errorf("invalid users.local: %v", err)
+	}
+
+	return users, nil
+}
+
+// PasswordPolicy 返回配置文件中 users.password_policy 的密码策略
+func (editor *Editor) PasswordPolicy() (PasswordPolicy, error) {
+	var policy PasswordPolicy
+
+	users := mappingValue(editor.doc.Content[0], "users")
+	if users == nil || users.Kind != yaml.MappingNode {
+		return policy, nil
+	}
+
+	if node := mappingValue(users, "password_policy"); node != nil {
+		if err := node.Decode(&policy); err != nil {
+			return policy, fmt.Errorf("invalid users.password_policy: %v", err)
+		}
+	}
+
+	return policy, nil
+}
+
+// AddLocalUser 在 users.local 的末尾添加用户
+func (editor *Editor) AddLocalUser(user LocalUser) error {
+	if user.Account == "" {
+		return errors.New("account is required")
+	}
+
+	if _, node := editor.findLocalUser(user.Account); node != nil {
+		return fmt.Errorf("user %s already exists", user.Account)
+	}
+
+	var node yaml.Node
+	if err := node.Encode(user); err != nil {
+		return err
+	}
+
+	local := editor.localUsersNode(true)
+	// local: [] 添加第一个用户时改为块格式，与其它配置的格式保持一致
+	if len(local.Content) == 0 {
+		local.Style &^= yaml.FlowStyle
+	}
+	local.Content = append(local.Content, &node)
+	editor.markDirty(&node)
+
+	return nil
+}
+
+// RemoveLocalUser 从 users.local 中删除用户
+func (editor *Editor) RemoveLocalUser(account string) error {
+	index, _ := editor.findLocalUser(account)
+	if index < 0 {
+		return fmt.Errorf("user %s not found", account)
+	}
+
+	local := editor.localUsersNode(false)
+	local.Content = append(local.Content[:index], local.Content[index+1:]...)
+
+	return nil
+}
+
+// SetLocalUserPassword 修改用户的密码，password 为按照 algo 处理后的密码
+func (editor *Editor) SetLocalUserPassword(account string, password string, algo string) error {
+	_, node := editor.findLocalUser(account)
+	if node == nil {
+		return fmt.Errorf("user %s not found", account)
+	}
+
+	setMappingValue(node, "password", stringNode(password))
+	setMappingValue(node, "algo", stringNode(algo))
+	editor.markDirty(node)
+
+	return nil
+}
+
+// SetLocalUserGroups 修改用户所属的用户组，使用 groups 列表保存，同时删除旧的 group 配置
+func (editor *Editor) SetLocalUserGroups(account string, groups []string) error {
+	_, node := editor.findLocalUser(account)
+	if node == nil {
+		return fmt.Errorf("user %s not found", account)
+	}
+
+	editor.markDirty(node)
+	if len(groups) == 0 {
+		removeMappingKey(node, "group")
+		removeMappingKey(node, "groups")
+		return nil
+	}
+
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, group := range groups {
+		seq.Content = append(seq.Content, stringNode(group))
+	}
+
+	// 只有 group 配置时在原来的位置替换为 groups，保持配置项的顺序
+	if mappingValue(node, "groups") == nil && mappingValue(node, "group") != nil {
+		setMappingValue(node, "group", seq)
+		renameMappingKey(node, "group", "groups")
+		return nil
+	}
+
+	removeMappingKey(node, "group")
+	if mappingValue(node, "groups") == nil {
+		insertMappingValue(node, "groups", seq, "algo")
+		return nil
+	}
+
+	setMappingValue(node, "groups", seq)
+	return nil
+}
+
+// Save 检查修改后的配置，配置合法时写回配置文件
+//
+// 配置文件中 users.local 为块格式的列表时只替换列表所在的行：未修改的用户保留原来的内容，添加以及修改的用户
+// 按照配置文件原来的缩进生成，文件的其它部分保持不变；否则按照原来的缩进重新生成整个文件
+//
+// 先写入同一目录下的临时文件再重命名，写入过程中服务重新加载配置或者程序退出都不会读取到不完整的文件，
+// 配置文件中包含用户密码，权限设置为 0600
+func (editor *Editor) Save() error {
+	data, ok := editor.spliceLocalUsers()
+	if !ok {
+		encoded, err := encodeYAML(&editor.doc, detectIndent(editor.doc.Content[0]))
+		if err != nil {
+			return err
+		}
+
+		data = encoded
+	}
+
+	if _, err := loadConf(data); err != nil {
+		return fmt.Errorf("config is invalid after edit, nothing saved: %w", err)
+	}
+
+	return writeFileAtomic(editor.path, data, 0600)
+}
+
+func (editor *Editor) markDirty(node *yaml.Node) {
+	if editor.dirty == nil {
+		editor.dirty = make(map[*yaml.Node]bool)
+	}
+
+	editor.dirty[node] = true
+}
+
+// spliceLocalUsers 将修改后的 users.local 替换到原来的配置文件中，无法替换或者替换后的用户与修改后的用户不一致时返回 false
+//
+// 原来的 users.local 为非空的块格式列表并且修改后仍然有用户时，只替换列表项，否则替换 local: 所在的配置项
+func (editor *Editor) spliceLocalUsers() ([]byte, bool) {
+	local := editor.localUsersNode(false)
+	original, err := (&Editor{data: editor.data}).parse()
+	if local == nil || err != nil {
+		return nil, false
+	}
+
+	users := mappingValue(original.doc.Content[0], "users")
+	if users == nil || users.Kind != yaml.MappingNode {
+		return nil, false
+	}
+
+	key, seq := mappingKey(users, "local"), mappingValue(users, "local")
+	if key == nil || seq == nil {
+		return nil, false
+	}
+
+	lines := bytes.SplitAfter(editor.data, []byte("\n"))
+	width, compact := detectIndent(original.doc.Content[0]), compactSequence(original.doc.Content[0])
+
+	newline := []byte("\n")
+	if bytes.Contains(editor.data, []byte("\r\n")) {
+		newline = []byte("\r\n")
+	}
+
+	var middle bytes.Buffer
+	writeLines := func(data ...[]byte) {
+		for _, line := range data {
+			middle.Write(line)
+		}
+
+		if middle.Len() > 0 && !bytes.HasSuffix(middle.Bytes(), []byte("\n")) {
+			middle.Write(newline)
+		}
+	}
+
+	// render 按照配置文件的缩进生成节点，marker 为列表项的 - 以及之后的空格，后续的行与 marker 之后的内容对齐
+	render := func(node *yaml.Node, indent int, marker string) bool {
+		rendered, err := encodeYAML(node, width)
+		if err != nil {
+			return false
+		}
+
+		if compact {
+			rendered = compactNestedSequences(rendered, width)
+		}
+
+		// 节点后的注释保留在原来的位置
+		renderedLines := bytes.SplitAfter(rendered, []byte("\n"))
+		for len(renderedLines) > 0 && isBlankOrComment(renderedLines[len(renderedLines)-1]) {
+			renderedLines = renderedLines[:len(renderedLines)-1]
+		}
+
+		prefix := strings.Repeat(" ", indent) + marker
+		for _, line := range renderedLines {
+			writeLines([]byte(prefix), bytes.TrimSuffix(line, []byte("\n")))
+			prefix = strings.Repeat(" ", indent+len(marker))
+		}
+
+		return true
+	}
+
+	var from, to int
+	// local: [] 等流格式的列表与 local: 在同一行
+	if seq.Kind == yaml.SequenceNode && len(seq.Content) > 0 && seq.Line > key.Line && len(local.Content) > 0 {
+		indent := seq.Column - 1
+		ranges := sequenceItems(lines, seq)
+		from, to = ranges[seq.Content[0].Line].head, ranges[seq.Content[len(seq.Content)-1].Line].end
+
+		// 列表项的内容与 - 之间可能有多个空格，如 -   name: a
+		marker := "- "
+		if first := seq.Content[0]; first.Line == seq.Line && first.Column > seq.Column+1 {
+			marker = "-" + strings.Repeat(" ", first.Column-seq.Column-1)
+		}
+
+		for _, item := range local.Content {
+			r, ok := ranges[item.Line]
+			if ok && item.Line > 0 && !editor.dirty[item] {
+				writeLines(lines[r.head:r.end]...)
+				continue
+			}
+
+			// 列表项前后的注释保留原来的内容
+			if ok {
+				writeLines(lines[r.head:r.line]...)
+			}
+
+			copied := *item
+			copied.HeadComment, copied.FootComment = "", ""
+			if !render(&copied, indent, marker) {
+				return nil, false
+			}
+
+			if ok {
+				writeLines(lines[r.tail:r.end]...)
+			}
+		}
+	} else {
+		indent := key.Column - 1
+		from, to = key.Line-1, sequenceEnd(lines, key.Line, indent)
+
+		copied := *key
+		copied.HeadComment = ""
+		if !render(&yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{&copied, local}}, indent, "") {
+			return nil, false
+		}
+	}
+
+	data := append(append(bytes.Join(lines[:from], nil), middle.Bytes()...), bytes.Join(lines[to:], nil)...)
+
+	// 确认替换后的文件中 users.local 与修改后的用户一致
+	expected, err := editor.LocalUsers()
+	if err != nil {
+		return nil, false
+	}
+
+	spliced, err := (&Editor{data: data}).parse()
+	if err != nil {
+		return nil, false
+	}
+
+	if actual, err := spliced.LocalUsers(); err != nil || !reflect.DeepEqual(actual, expected) {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// itemRange 列表项在配置文件中所在的行（从 0 开始）：head 为列表项前的注释，line 为 - 所在的行，
+// tail 之后为列表项后的空行以及注释，到 end 为止
+type itemRange struct {
+	head, line, tail, end int
+}
+
+// sequenceItems 返回块格式列表中每个列表项所在的行，按照列表项的行号（从 1 开始）索引
+func sequenceItems(lines [][]byte, seq *yaml.Node) map[int]itemRange {
+	indent := seq.Column - 1
+	end := sequenceEnd(lines, seq.Content[len(seq.Content)-1].Line, indent)
+
+	ranges := make(map[int]itemRange)
+	for i := len(seq.Content) - 1; i >= 0; i-- {
+		item := seq.Content[i]
+		r := itemRange{head: item.Line - 1, line: item.Line - 1, end: end}
+
+		prev := seq.Line - 2
+		if i > 0 {
+			prev = seq.Content[i-1].Line - 1
+		}
+
+		for r.head-1 > prev && isComment(lines[r.head-1]) {
+			r.head--
+		}
+
+		r.tail = r.end
+		for r.tail-1 > r.line && isBlankOrComment(lines[r.tail-1]) {
+			r.tail--
+		}
+
+		ranges[item.Line], end = r, r.head
+	}
+
+	return ranges
+}
+
+// sequenceEnd 返回从第 line 行（从 1 开始）之后缩进为 indent 的列表结束的位置（从 0 开始），
+// 列表后的空行以及注释保留在原来的位置
+func sequenceEnd(lines [][]byte, line int, indent int) int {
+	end := line
+	for end < len(lines) && inBlockSequence(lines[end], indent) {
+		end++
+	}
+
+	for end > line && isBlankOrComment(lines[end-1]) {
+		end--
+	}
+
+	return end
+}
+
+// inBlockSequence 判断行是否属于缩进为 indent 的块格式列表，空行、注释以及缩进更深的行属于列表
+func inBlockSequence(line []byte, indent int) bool {
+	trimmed := bytes.TrimLeft(line, " ")
+	if len(bytes.TrimSpace(trimmed)) == 0 {
+		return true
+	}
+
+	switch n := len(line) - len(trimmed); {
+	case n > indent:
+		return true
+	case n == indent:
+		return trimmed[0] == '#' || trimmed[0] == '-' && (len(trimmed) == 1 || trimmed[1] == ' ' || trimmed[1] == '\n' || trimmed[1] == '\r')
+	}
+
+	return false
+}
+
+func isComment(line []byte) bool {
+	trimmed := bytes.TrimSpace(line)
+	return len(trimmed) > 0 && trimmed[0] == '#'
+}
+
+func isBlankOrComment(line []byte) bool {
+	trimmed := bytes.TrimSpace(line)
+	return len(trimmed) == 0 || trimmed[0] == '#'
+}
+
+// detectIndent 返回配置文件中嵌套配置项的缩进，无法确定时使用两个空格
+func detectIndent(node *yaml.Node) int {
+	if indent := nestedIndent(node); indent > 0 {
+		return indent
+	}
+
+	return 2
+}
+
+func nestedIndent(node *yaml.Node) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if value.Kind != yaml.MappingNode || value.Style&yaml.FlowStyle != 0 || len(value.Content) == 0 {
+			continue
+		}
+
+		if indent := value.Content[0].Column - key.Column; indent > 0 && value.Content[0].Line > key.Line {
+			return indent
+		}
+
+		if indent := nestedIndent(value); indent > 0 {
+			return indent
+		}
+	}
+
+	return 0
+}
+
+// compactSequence 判断配置文件中配置项下的列表是否与配置项使用相同的缩进，如
+//
+//	rules:
+//	- path: /
+func compactSequence(node *yaml.Node) bool {
+	var walk func(node *yaml.Node) (bool, bool)
+	walk = func(node *yaml.Node) (bool, bool) {
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				if value.Kind == yaml.SequenceNode && value.Style&yaml.FlowStyle == 0 && len(value.Content) > 0 && value.Line > key.Line {
+					return value.Column == key.Column, true
+				}
+
+				if compact, found := walk(value); found {
+					return compact, true
+				}
+			}
+		case yaml.SequenceNode:
+			for _, item := range node.Content {
+				if compact, found := walk(item); found {
+					return compact, true
+				}
+			}
+		}
+
+		return false, false
+	}
+
+	compact, _ := walk(node)
+	return compact
+}
+
+// compactNestedSequences 将 yaml.v3 生成的配置项下缩进 indent 的列表改为与配置项相同的缩进
+func compactNestedSequences(data []byte, indent int) []byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for i := 0; i+1 < len(lines); i++ {
+		trimmed := bytes.TrimLeft(lines[i], " ")
+		column := len(lines[i]) - len(trimmed)
+		if !bytes.HasSuffix(bytes.TrimSpace(trimmed), []byte(":")) || !bytes.HasPrefix(lines[i+1], []byte(strings.Repeat(" ", column+indent)+"- ")) {
+			continue
+		}
+
+		for j := i + 1; j < len(lines) && bytes.HasPrefix(lines[j], []byte(strings.Repeat(" ", column+indent))); j++ {
+			lines[j] = lines[j][indent:]
+		}
+	}
+
+	return bytes.Join(lines, nil)
+}
+
+func encodeYAML(node *yaml.Node, indent int) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(indent)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeFileAtomic 通过临时文件以及重命名写入文件
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+// localUsersNode 返回 users.local 节点，create 为 true 时不存在则创建
+func (editor *Editor) localUsersNode(create bool) *yaml.Node {
+	root := editor.doc.Content[0]
+
+	users := mappingValue(root, "users")
+	if users == nil || users.Kind != yaml.MappingNode {
+		if !create {
+			return nil
+		}
+
+		users = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setMappingValue(root, "users", users)
+	}
+
+	local := mappingValue(users, "local")
+	if local == nil || local.Kind != yaml.SequenceNode {
+		if !create {
+			return nil
+		}
+
+		local = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		setMappingValue(users, "local", local)
+	}
+
+	return local
+}
+
+// findLocalUser 查找账号为 account 的用户节点，不存在时返回 -1, nil
+func (editor *Editor) findLocalUser(account string) (int, *yaml.Node) {
+	local := editor.localUsersNode(false)
+	if local == nil {
+		return -1, nil
+	}
+
+	for i, node := range local.Content {
+		if node.Kind != yaml.MappingNode {
+			continue
+		}
+
+		if value := mappingValue(node, "account"); value != nil && value.Value == account {
+			return i, node
+		}
+	}
+
+	return -1, nil
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func mappingKey(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i]
+		}
+	}
+
+	return nil
+}
+
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// setMappingValue 替换 key 对应的值，类型相同时保留原来的注释，key 不存在时添加到末尾
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			if old := mapping.Content[i+1]; old.Kind == value.Kind {
+				value.LineComment, value.HeadComment, value.FootComment = old.LineComment, old.HeadComment, old.FootComment
+			}
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+
+	mapping.Content = append(mapping.Content, stringNode(key), value)
+}
+
+// insertMappingValue 在 before 之前添加 key，before 不存在时添加到末尾
+func insertMappingValue(mapping *yaml.Node, key string, value *yaml.Node, before string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == before {
+			content := append([]*yaml.Node{stringNode(key), value}, mapping.Content[i:]...)
+			mapping.Content = append(mapping.Content[:i], content...)
+			return
+		}
+	}
+
+	mapping.Content = append(mapping.Content, stringNode(key), value)
+}
+
+func renameMappingKey(mapping *yaml.Node, key string, newKey string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i].Value = newKey
+			return
+		}
+	}
+}
+
+func removeMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
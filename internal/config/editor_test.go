@@ -0,0 +1,271 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// editConfig 将 content 写入临时的配置文件，修改并保存后返回新的配置文件内容
+func editConfig(t *testing.T, content string, edit func(editor *Editor) error) string {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	editor, err := OpenEditor(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := edit(editor); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := editor.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// changedLines 去掉相同的开头以及结尾后，返回修改前后不同的行
+func changedLines(before, after string) ([]string, []string) {
+	a, b := strings.SplitAfter(before, "\n"), strings.SplitAfter(after, "\n")
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	return a[prefix : len(a)-suffix], b[prefix : len(b)-suffix]
+}
+
+// TestEditorKeepsFormatting 修改示例配置文件中的用户时，只修改对应用户所在的行
+func TestEditorKeepsFormatting(t *testing.T) {
+	sample, err := os.ReadFile("../../webdav-server.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		edit    func(editor *Editor) error
+		removed []string
+		added   []string
+	}{
+		{
+			name: "add",
+			edit: func(editor *Editor) error {
+				return editor.AddLocalUser(LocalUser{Name: "测试", Account: "tester", Password: "c2VjcmV0", Groups: []string{"vistor", "editor"}, Algo: "base64"})
+			},
+			added: []string{
+				"  - name: 测试\n",
+				"    account: tester\n",
+				"    password: c2VjcmV0\n",
+				"    groups:\n",
+				"    - vistor\n",
+				"    - editor\n",
+				"    algo: base64\n",
+			},
+		},
+		{
+			name: "remove",
+			edit: func(editor *Editor) error {
+				return editor.RemoveLocalUser("basic")
+			},
+			removed: []string{
+				"  - name: 基础用户\n",
+				"    account: basic\n",
+				"    password: YmFzaWM=\n",
+				"    groups:\n",
+				"    - vistor\n",
+				"    algo: base64\n",
+			},
+		},
+		{
+			name: "password",
+			edit: func(editor *Editor) error {
+				return editor.SetLocalUserPassword("basic", "c2VjcmV0", "base64")
+			},
+			removed: []string{"    password: YmFzaWM=\n"},
+			added:   []string{"    password: c2VjcmV0\n"},
+		},
+		{
+			name: "groups",
+			edit: func(editor *Editor) error {
+				return editor.SetLocalUserGroups("editor", []string{"editor", "admin"})
+			},
+			added: []string{"    - admin\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		removed, added := changedLines(string(sample), editConfig(t, string(sample), tt.edit))
+		if len(removed) != len(tt.removed) || len(added) != len(tt.added) ||
+			len(removed) > 0 && !reflect.DeepEqual(removed, tt.removed) || len(added) > 0 && !reflect.DeepEqual(added, tt.added) {
+			t.Errorf("%s: got -%q +%q, want -%q +%q", tt.name, removed, added, tt.removed, tt.added)
+		}
+	}
+}
+
+func TestEditorIndentation(t *testing.T) {
+	addUser := func(editor *Editor) error {
+		return editor.AddLocalUser(LocalUser{Name: "b", Account: "b", Password: "b", Groups: []string{"g2"}, Algo: "plain"})
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		edit   func(editor *Editor) error
+		want   string
+	}{
+		{
+			name: "four spaces",
+			config: `users:
+    # local users
+    local:
+        -   name: a
+            account: a
+            password: a
+            groups:
+                - g1
+            algo: plain
+
+    ldap: []
+shares:
+    -   name: main
+        scope: /tmp
+        prefix: /
+`,
+			edit: func(editor *Editor) error {
+				if err := addUser(editor); err != nil {
+					return err
+				}
+
+				return editor.SetLocalUserGroups("a", []string{"g1", "g3"})
+			},
+			want: `users:
+    # local users
+    local:
+        -   name: a
+            account: a
+            password: a
+            groups:
+                - g1
+                - g3
+            algo: plain
+        -   name: b
+            account: b
+            password: b
+            groups:
+                - g2
+            algo: plain
+
+    ldap: []
+shares:
+    -   name: main
+        scope: /tmp
+        prefix: /
+`,
+		},
+		{
+			name: "comments",
+			config: `users:
+  local:
+  # first user
+  - name: a
+    account: a
+    password: a
+    algo: plain
+    # end of first user
+  # second user
+  - name: c
+    account: c
+    password: c
+    algo: plain
+shares:
+- name: main
+  scope: /tmp
+  prefix: /
+`,
+			edit: func(editor *Editor) error {
+				if err := editor.SetLocalUserPassword("a", "YQ==", "base64"); err != nil {
+					return err
+				}
+
+				return editor.SetLocalUserPassword("c", "Yw==", "base64")
+			},
+			want: `users:
+  local:
+  # first user
+  - name: a
+    account: a
+    password: YQ==
+    algo: base64
+    # end of first user
+  # second user
+  - name: c
+    account: c
+    password: Yw==
+    algo: base64
+shares:
+- name: main
+  scope: /tmp
+  prefix: /
+`,
+		},
+		{
+			name: "empty list",
+			config: `users:
+  local: [] # no users
+  ldap: []
+shares:
+- name: main
+  scope: /tmp
+  prefix: /
+`,
+			edit: addUser,
+			want: `users:
+  local:
+  - name: b
+    account: b
+    password: b
+    groups:
+    - g2
+    algo: plain
+  ldap: []
+shares:
+- name: main
+  scope: /tmp
+  prefix: /
+`,
+		},
+		{
+			name:   "crlf",
+			config: "users:\r\n  local:\r\n  - name: a\r\n    account: a\r\n    password: a\r\n    algo: plain\r\nshares:\r\n- name: main\r\n  scope: /tmp\r\n  prefix: /\r\n",
+			edit:   addUser,
+			want:   "users:\r\n  local:\r\n  - name: a\r\n    account: a\r\n    password: a\r\n    algo: plain\r\n  - name: b\r\n    account: b\r\n    password: b\r\n    groups:\r\n    - g2\r\n    algo: plain\r\nshares:\r\n- name: main\r\n  scope: /tmp\r\n  prefix: /\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := editConfig(t, tt.config, tt.edit); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Privilege 访问权限，多个权限按位组合
+type Privilege uint16
+
+const (
+	// PrivilegeList 列出目录内容，读取文件以及目录的属性（PROPFIND、SEARCH）
+	PrivilegeList Privilege = 1 << iota
+	// PrivilegeRead 读取文件内容
+	PrivilegeRead
+	// PrivilegeCreate 创建新的文件或者目录
+	PrivilegeCreate
+	// PrivilegeOverwrite 覆盖已经存在的文件，修改资源的属性
+	PrivilegeOverwrite
+	// PrivilegeDelete 删除文件或者目录
+	PrivilegeDelete
+	// PrivilegeMove 移动或者重命名文件以及目录
+	PrivilegeMove
+	// PrivilegeLock 锁定以及解锁资源
+	PrivilegeLock
+
+	PrivilegeNone Privilege = 0
+	PrivilegeAll            = PrivilegeList | PrivilegeRead | PrivilegeCreate | PrivilegeOverwrite | PrivilegeDelete | PrivilegeMove | PrivilegeLock
+)
+
+var privilegeNames = []struct {
+	name      string
+	privilege Privilege
+}{
+	{"list", PrivilegeList},
+	{"read", PrivilegeRead},
+	{"create", PrivilegeCreate},
+	{"overwrite", PrivilegeOverwrite},
+	{"delete", PrivilegeDelete},
+	{"move", PrivilegeMove},
+	{"lock", PrivilegeLock},
+}
+
+// accessModePresets access_mode 支持的预设权限组合
+var accessModePresets = map[string]Privilege{
+	AccessModeNone:  PrivilegeNone,
+	AccessModeRead:  PrivilegeList | PrivilegeRead,
+	AccessModeWrite: PrivilegeAll,
+	// upload 只能上传新文件，不能查看、覆盖以及删除，适用于收件箱
+	AccessModeUpload: PrivilegeCreate | PrivilegeLock,
+	// append 可以查看以及上传新文件，不能覆盖以及删除已有文件，适用于只追加的日志目录
+	AccessModeAppend: PrivilegeList | PrivilegeRead | PrivilegeCreate | PrivilegeLock,
+}
+
+// ParseAccessMode 解析 access_mode，支持预设的 none|read|write|upload|append 以及逗号分隔的权限列表，
+// 如 list,read,create，预设与权限可以混合使用
+func ParseAccessMode(mode string) (Privilege, error) {
+	var privilege Privilege
+	for _, item := range strings.Split(mode, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if preset, ok := accessModePresets[item]; ok {
+			privilege |= preset
+			continue
+		}
+
+		found := false
+		for _, p := range privilegeNames {
+			if p.name == item {
+				privilege |= p.privilege
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return PrivilegeNone, fmt.Errorf("unknown privilege %q, must be one of none|read|write|upload|append or a comma separated list of list|read|create|overwrite|delete|move|lock", item)
+		}
+	}
+
+	return privilege, nil
+}
+
+// Has 判断是否拥有 required 中的所有权限
+func (p Privilege) Has(required Privilege) bool {
+	return p&required == required
+}
+
+// String 返回逗号分隔的权限名称
+func (p Privilege) String() string {
+	if p == PrivilegeNone {
+		return AccessModeNone
+	}
+
+	names := make([]string, 0, len(privilegeNames))
+	for _, item := range privilegeNames {
+		if p.Has(item.privilege) {
+			names = append(names, item.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// MarshalText 实现 encoding.TextMarshaler，日志中输出权限名称
+func (p Privilege) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
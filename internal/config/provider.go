@@ -1,45 +1,80 @@
 package config
 
 import (
+	"context"
+	"time"
+
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/graceful"
 )
 
+// watchInterval 检查配置文件是否发生变化的时间间隔
+const watchInterval = 5 * time.Second
+
 type Provider struct{}
 
 func (pro Provider) Register(binder infra.Binder) {
 	binder.MustSingletonOverride(func(conf *Config) *LDAP { return &conf.LDAP })
 	binder.MustSingletonOverride(func(conf *Config) *Users { return &conf.Users })
 	binder.MustSingletonOverride(func(conf *Config) *Server { return &conf.Server })
-	binder.MustSingletonOverride(func(conf *Config) *UserGroupRules {
-		userGroupRules := UserGroupRules{
-			Users:  map[string][]Rule{},
-			Groups: map[string][]Rule{},
+	binder.MustSingletonOverride(func(conf *Config) *Redis { return &conf.Redis })
+	binder.MustSingletonOverride(NewReloader)
+}
+
+func (pro Provider) Boot(resolver infra.Resolver) {
+	resolver.MustResolve(func(conf *Config, reloader *Reloader, gf graceful.Graceful) {
+		log.With(conf).Debugf("boot configuration")
+		logRuleWarnings(conf)
+
+		gf.AddReloadHandler(func() { reload(reloader, "signal") })
+	})
+}
+
+func (pro Provider) Daemon(ctx context.Context, resolver infra.Resolver) {
+	resolver.MustResolve(func(conf *Config, reloader *Reloader) {
+		if !conf.WatchConfig {
+			return
 		}
 
-		for _, rule := range conf.Rules {
-			for _, user := range rule.Users {
-				if _, ok := userGroupRules.Users[user]; !ok {
-					userGroupRules.Users[user] = make([]Rule, 0)
-				}
+		modTime, size, _ := reloader.Modified()
 
-				userGroupRules.Users[user] = append(userGroupRules.Users[user], rule)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 			}
-			for _, group := range rule.Groups {
-				if _, ok := userGroupRules.Groups[group]; !ok {
-					userGroupRules.Groups[group] = make([]Rule, 0)
-				}
 
-				userGroupRules.Groups[group] = append(userGroupRules.Groups[group], rule)
+			// 配置文件被删除或者正在写入时跳过，下次变化时再重新加载
+			newModTime, newSize, err := reloader.Modified()
+			if err != nil || newModTime.Equal(modTime) && newSize == size {
+				continue
 			}
-		}
 
-		return &userGroupRules
+			modTime, size = newModTime, newSize
+			reload(reloader, "file changed")
+		}
 	})
 }
 
-func (pro Provider) Boot(resolver infra.Resolver) {
-	resolver.MustResolve(func(conf *Config) {
-		log.With(conf).Debugf("boot configuration")
-	})
+// reload 重新加载配置，失败时保留当前配置继续运行
+func reload(reloader *Reloader, trigger string) {
+	conf, err := reloader.Reload()
+	if err != nil {
+		log.WithFields(log.Fields{"trigger": trigger}).Errorf("reload configuration failed, keep running with the current configuration: %v", err)
+		return
+	}
+
+	log.WithFields(log.Fields{"trigger": trigger, "shares": len(conf.Shares), "rules": len(conf.Rules)}).Info("configuration reloaded")
+	logRuleWarnings(conf)
+}
+
+func logRuleWarnings(conf *Config) {
+	for _, warning := range conf.Warnings() {
+		log.Warningf("rule warning: %s", warning)
+	}
 }
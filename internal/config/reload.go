@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader 持有当前生效的配置
+//
+// 重新加载配置文件时，新的配置校验通过后原子替换当前配置，再依次通知所有监听者（共享、用户认证、登录缓存等），
+// 配置文件不合法或者修改了只能在重启后生效的配置项时，拒绝新的配置，当前配置继续生效
+type Reloader struct {
+	current   atomic.Value
+	lock      sync.Mutex
+	listeners []func(conf *Config)
+}
+
+// NewReloader 创建配置重新加载器，conf 为启动时加载的配置
+func NewReloader(conf *Config) *Reloader {
+	reloader := &Reloader{}
+	reloader.current.Store(conf)
+
+	return reloader
+}
+
+// Config 返回当前生效的配置
+func (reloader *Reloader) Config() *Config {
+	return reloader.current.Load().(*Config)
+}
+
+// OnReload 注册配置重新加载成功后的回调，回调按照注册顺序执行
+func (reloader *Reloader) OnReload(listener func(conf *Config)) {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+
+	reloader.listeners = append(reloader.listeners, listener)
+}
+
+// Reload 重新加载配置文件，失败时当前配置保持不变
+func (reloader *Reloader) Reload() (*Config, error) {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+
+	current := reloader.Config()
+	conf, err := LoadConfFromFile(current.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conf.reloadable(current); err != nil {
+		return nil, err
+	}
+
+	reloader.current.Store(conf)
+	for _, listener := range reloader.listeners {
+		listener(conf)
+	}
+
+	return conf, nil
+}
+
+// Modified 返回配置文件的修改时间以及大小，用于检测配置文件是否发生变化
+func (reloader *Reloader) Modified() (time.Time, int64, error) {
+	info, err := os.Stat(reloader.Config().path)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	return info.ModTime(), info.Size(), nil
+}
+
+// reloadable 检查新的配置是否只修改了可以在运行时重新加载的配置项
+func (conf Config) reloadable(current *Config) error {
+	restartRequired := []struct {
+		name    string
+		changed bool
+	}{
+		{"listen", conf.Listen != current.Listen},
+		{"https", conf.HTTPS != current.HTTPS || conf.CertFile != current.CertFile || conf.KeyFile != current.KeyFile},
+		{"log_path", conf.LogPath != current.LogPath},
+		{"data_dir", conf.DataDir != current.DataDir},
+		{"cache_driver", conf.CacheDriver != current.CacheDriver},
+		{"lock_driver", conf.LockDriver != current.LockDriver},
+		{"props_driver", conf.PropsDriver != current.PropsDriver},
+		{"auth_type", conf.AuthType != current.AuthType},
+		{"redis", conf.Redis != current.Redis},
+		{"quotas", conf.QuotaEnabled() != current.QuotaEnabled()},
+	}
+
+	for _, item := range restartRequired {
+		if item.changed {
+			return fmt.Errorf("invalid %s: can not be changed without restart", item.name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,339 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mylxsw/go-utils/str"
+)
+
+const (
+	RuleMatchRegex  = "regex"
+	RuleMatchGlob   = "glob"
+	RuleMatchPrefix = "prefix"
+)
+
+// compileRulePattern 将规则的 path 编译为正则表达式
+//
+//	regex   POSIX 正则表达式，不会自动添加 ^、$，未锚定时可以匹配路径中的任意位置
+//	glob    * 匹配路径段中的任意字符，? 匹配单个字符，[abc] 匹配字符集合，** 匹配任意层级的路径，
+//	        结尾的 /** 同时匹配目录本身，如 /build/** 匹配 /build、/build/app/v1
+//	prefix  匹配该路径本身以及其下的所有路径，按路径段匹配，/build 不匹配 /builder
+func compileRulePattern(match, rulePath string) (*regexp.Regexp, error) {
+	switch match {
+	case RuleMatchGlob:
+		if !strings.HasPrefix(rulePath, "/") {
+			return nil, fmt.Errorf("glob must start with /")
+		}
+
+		expr, err := globToRegexp(rulePath)
+		if err != nil {
+			return nil, err
+		}
+
+		return regexp.Compile(expr)
+	case RuleMatchPrefix:
+		if !strings.HasPrefix(rulePath, "/") {
+			return nil, fmt.Errorf("prefix must start with /")
+		}
+
+		prefix := strings.TrimSuffix(CanonicalPath(rulePath), "/")
+		return regexp.Compile("^" + regexp.QuoteMeta(prefix) + "(/.*)?$")
+	}
+
+	return regexp.CompilePOSIX(rulePath)
+}
+
+// globToRegexp 将 glob 转换为锚定的正则表达式，目录路径结尾的 / 可选
+func globToRegexp(glob string) (string, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				switch {
+				case i+1 == len(glob) && strings.HasSuffix(expr.String(), "/"):
+					// 结尾的 /** 匹配目录本身以及其下的所有路径
+					trimmed := strings.TrimSuffix(expr.String(), "/")
+					expr.Reset()
+					expr.WriteString(trimmed + "(/.*)?$")
+					return expr.String(), nil
+				case i+1 < len(glob) && glob[i+1] == '/' && strings.HasSuffix(expr.String(), "/"):
+					// /**/ 匹配零个或者多个路径段
+					i++
+					expr.WriteString("(.*/)?")
+				default:
+					expr.WriteString(".*")
+				}
+				continue
+			}
+			expr.WriteString("[^/]*")
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("missing closing ] in %q", glob)
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if strings.HasSuffix(glob, "/") {
+		return expr.String() + "$", nil
+	}
+
+	return expr.String() + "/?$", nil
+}
+
+// ruleBase 返回规则匹配的所有路径共同所在的目录（不以 / 结尾，根目录为空字符串），无法确定时返回空字符串
+func ruleBase(rule Rule) string {
+	var literal string
+	switch rule.Match {
+	case RuleMatchPrefix:
+		return strings.TrimSuffix(CanonicalPath(rule.Path), "/")
+	case RuleMatchGlob:
+		literal = rule.Path
+		if pos := strings.IndexAny(literal, `*?[\`); pos >= 0 {
+			literal = literal[:pos]
+		}
+	default:
+		if !strings.HasPrefix(rule.Path, "^") || rule.pattern == nil {
+			return ""
+		}
+		literal, _ = rule.pattern.LiteralPrefix()
+	}
+
+	// 只保留完整的路径段
+	if pos := strings.LastIndex(literal, "/"); pos > 0 {
+		return literal[:pos]
+	}
+
+	return ""
+}
+
+// ruleCover 返回规则匹配其下所有路径的目录，如 prefix /build、glob /build/**、regex ^/build/，
+// 规则不是这种形式时返回 false
+func ruleCover(rule Rule) (string, bool) {
+	switch rule.Match {
+	case RuleMatchPrefix:
+		return ruleBase(rule), true
+	case RuleMatchGlob:
+		dir := strings.TrimSuffix(rule.Path, "/**")
+		if dir != rule.Path && !strings.ContainsAny(dir, `*?[\`) {
+			return strings.TrimSuffix(CanonicalPath(dir), "/"), true
+		}
+	default:
+		if expr := strings.TrimPrefix(rule.Path, "^"); expr == ".*" || expr == "/.*" || rule.Path == "^/" {
+			return "", true
+		}
+
+		dir := strings.TrimSuffix(strings.TrimSuffix(rule.Path, ".*"), "/")
+		if strings.HasPrefix(dir, "^/") && dir != rule.Path && regexp.QuoteMeta(dir[1:]) == dir[1:] {
+			return dir[1:], true
+		}
+	}
+
+	return "", false
+}
+
+// ruleIndex 按照路径段组织的规则前缀树，规则挂在其匹配路径共同所在的目录节点上，
+// 查找时只需要检查请求路径经过的节点上的规则，避免对每个请求逐条执行所有规则的正则表达式
+type ruleIndex struct {
+	rules []Rule
+	root  *ruleNode
+}
+
+type ruleNode struct {
+	rules    []int
+	children map[string]*ruleNode
+}
+
+func newRuleIndex(rules []Rule) *ruleIndex {
+	index := &ruleIndex{rules: rules, root: &ruleNode{}}
+	for i, rule := range rules {
+		node := index.root
+		for _, segment := range pathSegments(ruleBase(rule)) {
+			if node.children == nil {
+				node.children = make(map[string]*ruleNode)
+			}
+
+			child, ok := node.children[segment]
+			if !ok {
+				child = &ruleNode{}
+				node.children[segment] = child
+			}
+			node = child
+		}
+
+		node.rules = append(node.rules, i)
+	}
+
+	return index
+}
+
+// Match 返回匹配 rulePath 的规则，保持规则在配置中的顺序
+func (index *ruleIndex) Match(rulePath string) []Rule {
+	candidates := append([]int(nil), index.root.rules...)
+	node := index.root
+	for _, segment := range pathSegments(rulePath) {
+		if node = node.children[segment]; node == nil {
+			break
+		}
+		candidates = append(candidates, node.rules...)
+	}
+
+	sort.Ints(candidates)
+
+	matched := make([]Rule, 0, len(candidates))
+	for _, i := range candidates {
+		if index.rules[i].Matched(rulePath) {
+			matched = append(matched, index.rules[i])
+		}
+	}
+
+	return matched
+}
+
+func pathSegments(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, "/")
+}
+
+// shadows 判断 rule 是否使 other 不起作用：rule 匹配 other 匹配的所有路径、适用于 other 适用的所有用户，
+// 并且授予（deny 规则为拒绝）了 other 中的所有权限，deny 优先，因此 deny 规则可以使任意规则不起作用
+func (rule Rule) shadows(other Rule) bool {
+	if !rule.Denied() && other.Denied() || other.Hidden && !rule.Hidden {
+		return false
+	}
+
+	if !rule.coversSubjects(other) || !rule.Privileges().Has(other.Privileges()) {
+		return false
+	}
+
+	cover, ok := ruleCover(rule)
+	if !ok {
+		return false
+	}
+
+	base := ruleBase(other)
+	return cover == "" || base == cover || strings.HasPrefix(base, cover+"/")
+}
+
+// coversSubjects 判断 rule 适用的用户是否包含 other 适用的所有用户
+func (rule Rule) coversSubjects(other Rule) bool {
+	for _, subjects := range [][]string{rule.Users, rule.Groups} {
+		for _, subject := range subjects {
+			if subject == "*" {
+				return true
+			}
+		}
+	}
+
+	return isSubset(other.Users, rule.Users) && isSubset(other.Groups, rule.Groups)
+}
+
+// sharesSubjects 判断两条规则是否适用于同一个用户或者用户组
+func (rule Rule) sharesSubjects(other Rule) bool {
+	if rule.coversSubjects(other) || other.coversSubjects(rule) {
+		return true
+	}
+
+	for _, user := range rule.Users {
+		if str.In(user, other.Users) {
+			return true
+		}
+	}
+
+	for _, group := range rule.Groups {
+		if str.In(group, other.Groups) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSubset(items []string, set []string) bool {
+	for _, item := range items {
+		if !str.In(item, set) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RuleWarnings 检查规则中可能存在的问题：未锚定的正则表达式、与其它规则路径相同、被其它规则完全覆盖而不起作用的规则
+func (conf Config) RuleWarnings() []string {
+	warnings := make([]string, 0)
+	reported := make(map[string]bool)
+	report := func(format string, args ...interface{}) {
+		if warning := fmt.Sprintf(format, args...); !reported[warning] {
+			reported[warning] = true
+			warnings = append(warnings, warning)
+		}
+	}
+
+	for _, share := range conf.Shares {
+		rules := share.AppliedRules()
+		shadowed := make(map[string]bool)
+		for _, rule := range rules {
+			if rule.Match == RuleMatchRegex && !strings.HasPrefix(rule.Path, "^") && !strings.HasPrefix(rule.Path, ".*") {
+				report("%s: regex %q is not anchored with ^ and matches anywhere in the path, consider match: prefix or glob", rule.ID(), rule.Path)
+			}
+		}
+
+		for i, rule := range rules {
+			for j, other := range rules {
+				if i == j {
+					continue
+				}
+
+				if rule.Match == other.Match && rule.Path == other.Path {
+					if i < j && rule.sharesSubjects(other) {
+						report("%s overlaps %s: both match %s %q", other.ID(), rule.ID(), rule.Match, rule.Path)
+					}
+					continue
+				}
+
+				// 两条规则相互覆盖时只报告后一条，被多条规则覆盖时只报告第一条
+				if shadowed[other.ID()] || !rule.shadows(other) || other.shadows(rule) && j < i {
+					continue
+				}
+				shadowed[other.ID()] = true
+
+				if rule.Denied() {
+					report("%s is shadowed by deny rule %s and has no effect", other.ID(), rule.ID())
+				} else {
+					report("%s is shadowed by %s which already grants %s to the same users", other.ID(), rule.ID(), other.Privileges())
+				}
+			}
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileRulePattern(t *testing.T) {
+	tests := []struct {
+		match   string
+		rule    string
+		path    string
+		matched bool
+	}{
+		// ** 匹配任意层级，结尾的 /** 同时匹配目录本身
+		{match: RuleMatchGlob, rule: "/build/**", path: "/build", matched: true},
+		{match: RuleMatchGlob, rule: "/build/**", path: "/build/", matched: true},
+		{match: RuleMatchGlob, rule: "/build/**", path: "/build/app/v1/a.zip", matched: true},
+		{match: RuleMatchGlob, rule: "/build/**", path: "/builder/a.zip"},
+		{match: RuleMatchGlob, rule: "/build/**/*.zip", path: "/build/a.zip", matched: true},
+		{match: RuleMatchGlob, rule: "/build/**/*.zip", path: "/build/app/v1/a.zip", matched: true},
+		{match: RuleMatchGlob, rule: "/build/**/*.zip", path: "/build/app/a.tgz"},
+		{match: RuleMatchGlob, rule: "/build/**/*.zip", path: "/builds/a.zip"},
+		{match: RuleMatchGlob, rule: "/**/secret/", path: "/secret/", matched: true},
+		{match: RuleMatchGlob, rule: "/**/secret/", path: "/a/b/secret/", matched: true},
+		{match: RuleMatchGlob, rule: "/**/secret/", path: "/a/b/secret"},
+		// * 只匹配一个路径段
+		{match: RuleMatchGlob, rule: "/build/*", path: "/build/app", matched: true},
+		{match: RuleMatchGlob, rule: "/build/*", path: "/build/app/", matched: true},
+		{match: RuleMatchGlob, rule: "/build/*", path: "/build/app/v1"},
+		{match: RuleMatchGlob, rule: "/build/*.zip", path: "/build/.zip", matched: true},
+		{match: RuleMatchGlob, rule: "/build/*.zip", path: "/build/app/a.zip"},
+		// ? 匹配单个字符，不匹配 /
+		{match: RuleMatchGlob, rule: "/build/v?", path: "/build/v1", matched: true},
+		{match: RuleMatchGlob, rule: "/build/v?", path: "/build/v10"},
+		{match: RuleMatchGlob, rule: "/build/v?/a", path: "/build/v//a"},
+		{match: RuleMatchGlob, rule: "/logs/[!a]*", path: "/logs/b.log", matched: true},
+		{match: RuleMatchGlob, rule: "/logs/[!a]*", path: "/logs/a.log"},
+		{match: RuleMatchGlob, rule: `/a\*b`, path: "/a*b", matched: true},
+		{match: RuleMatchGlob, rule: `/a\*b`, path: "/axb"},
+		{match: RuleMatchGlob, rule: "/a.b", path: "/axb"},
+		// 以 / 结尾的 glob 只匹配目录
+		{match: RuleMatchGlob, rule: "/docs/", path: "/docs/", matched: true},
+		{match: RuleMatchGlob, rule: "/docs/", path: "/docs"},
+		// prefix 按路径段匹配
+		{match: RuleMatchPrefix, rule: "/build", path: "/build", matched: true},
+		{match: RuleMatchPrefix, rule: "/build", path: "/build/", matched: true},
+		{match: RuleMatchPrefix, rule: "/build", path: "/build/app/v1", matched: true},
+		{match: RuleMatchPrefix, rule: "/build/", path: "/build", matched: true},
+		{match: RuleMatchPrefix, rule: "/build", path: "/builder"},
+		{match: RuleMatchPrefix, rule: "/build", path: "/a/build"},
+		{match: RuleMatchPrefix, rule: "/a.b", path: "/axb"},
+		{match: RuleMatchPrefix, rule: "/", path: "/anything", matched: true},
+		// regex 不会自动锚定
+		{match: RuleMatchRegex, rule: "^/build/", path: "/build/app", matched: true},
+		{match: RuleMatchRegex, rule: "^/build/", path: "/build"},
+		{match: RuleMatchRegex, rule: "/build/", path: "/a/build/app", matched: true},
+	}
+
+	for _, tt := range tests {
+		pattern, err := compileRulePattern(tt.match, tt.rule)
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.match, tt.rule, err)
+			continue
+		}
+
+		if got := pattern.MatchString(tt.path); got != tt.matched {
+			t.Errorf("%s %q matches %q = %v, want %v", tt.match, tt.rule, tt.path, got, tt.matched)
+		}
+	}
+}
+
+func TestCompileRulePatternInvalid(t *testing.T) {
+	tests := []struct {
+		match string
+		rule  string
+	}{
+		{match: RuleMatchGlob, rule: "build/**"},
+		{match: RuleMatchGlob, rule: "/build/[a"},
+		{match: RuleMatchPrefix, rule: "build"},
+		{match: RuleMatchRegex, rule: "^/build/(a"},
+	}
+
+	for _, tt := range tests {
+		if _, err := compileRulePattern(tt.match, tt.rule); err == nil {
+			t.Errorf("%s %q: expected an error", tt.match, tt.rule)
+		}
+	}
+}
+
+// TestRuleIndexMatch 前缀树返回的规则与逐条匹配所有规则的结果相同
+func TestRuleIndexMatch(t *testing.T) {
+	definitions := []struct {
+		match string
+		path  string
+	}{
+		{RuleMatchRegex, "^/"},
+		{RuleMatchRegex, ".*"},
+		{RuleMatchRegex, "\\.zip$"},
+		{RuleMatchRegex, "^/build/app/"},
+		{RuleMatchRegex, "^/build/(app|web)/v[0-9]+/"},
+		{RuleMatchRegex, "^/build"},
+		{RuleMatchRegex, "^/docs/a\\.txt$"},
+		{RuleMatchGlob, "/build/**"},
+		{RuleMatchGlob, "/build/*/v?/**"},
+		{RuleMatchGlob, "/**/secret/**"},
+		{RuleMatchGlob, "/docs/*.txt"},
+		{RuleMatchGlob, "/[bd]*/**"},
+		{RuleMatchGlob, "/docs/"},
+		{RuleMatchPrefix, "/"},
+		{RuleMatchPrefix, "/build"},
+		{RuleMatchPrefix, "/build/app/v1/"},
+		{RuleMatchPrefix, "/builder"},
+		{RuleMatchPrefix, "/docs/a.txt"},
+	}
+
+	rules := make([]Rule, 0, len(definitions))
+	for i, def := range definitions {
+		pattern, err := compileRulePattern(def.match, def.path)
+		if err != nil {
+			t.Fatalf("%s %q: %v", def.match, def.path, err)
+		}
+
+		rules = append(rules, Rule{id: fmt.Sprintf("rules[%d]", i), Match: def.match, Path: def.path, pattern: pattern})
+	}
+
+	paths := []string{
+		"/", "/build", "/build/", "/builder/", "/builds/a.zip",
+		"/build/app/", "/build/app/v1/", "/build/app/v1/a.zip", "/build/web/v22/b/c",
+		"/docs/", "/docs/a.txt", "/docs/b.txt", "/docs/sub/a.txt",
+		"/secret/", "/a/secret/b", "/x/y/z.zip",
+	}
+
+	index := newRuleIndex(rules)
+	for _, p := range paths {
+		want := make([]Rule, 0)
+		for _, rule := range rules {
+			if rule.Matched(p) {
+				want = append(want, rule)
+			}
+		}
+
+		if got := index.Match(p); !reflect.DeepEqual(got, want) {
+			t.Errorf("Match(%q): got %v, want %v", p, ruleIDs(got), ruleIDs(want))
+		}
+	}
+}
+
+func ruleIDs(rules []Rule) []string {
+	ids := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		ids = append(ids, rule.ID())
+	}
+
+	return ids
+}
+
+// TestCheckRuleWarnings 重叠以及被覆盖的规则作为警告返回，并且包含规则所在的行号
+func TestCheckRuleWarnings(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(`
+shares:
+- name: main
+  scope: /tmp
+  prefix: /
+  access_mode: read
+  rules:
+  - path: /build
+    match: prefix
+    access_mode: write
+    users: ["*"]
+  - path: /build
+    match: prefix
+    access_mode: read
+    users: [alice]
+  - path: /build/app/**
+    match: glob
+    access_mode: read
+    groups: [editor]
+  - path: ^/docs/
+    access_mode: write
+    users: [bob]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	warnings, err := Check(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"line 12: shares[0].rules[1] overlaps shares[0].rules[0]",
+		"line 16: shares[0].rules[2] is shadowed by shares[0].rules[0]",
+	}
+	for _, expected := range want {
+		found := false
+		for _, warning := range warnings {
+			found = found || strings.Contains(warning, expected)
+		}
+
+		if !found {
+			t.Errorf("warnings %q should contain %q", warnings, expected)
+		}
+	}
+
+	for _, warning := range warnings {
+		if strings.Contains(warning, "rules[3]") {
+			t.Errorf("unexpected warning for shares[0].rules[3]: %s", warning)
+		}
+	}
+}
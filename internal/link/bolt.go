@@ -0,0 +1,122 @@
+package link
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var linksBucket = []byte("links")
+
+type boltStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltStore 创建基于 bbolt 的分享链接存储，链接保存在 dbPath 中
+func NewBoltStore(dbPath string) (Store, error) {
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(linksBucket)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Create(link Link) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return put(tx, link)
+	})
+}
+
+func (s *boltStore) Get(token string) (link Link, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		link, err = get(tx, token)
+		return err
+	})
+
+	return link, err
+}
+
+func (s *boltStore) List(account string) ([]Link, error) {
+	links := make([]Link, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(linksBucket).ForEach(func(k, v []byte) error {
+			var link Link
+			if err := json.Unmarshal(v, &link); err != nil {
+				return err
+			}
+
+			if link.Owner.Account == account {
+				links = append(links, link)
+			}
+
+			return nil
+		})
+	})
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+
+	return links, err
+}
+
+func (s *boltStore) Delete(token string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := get(tx, token); err != nil {
+			return err
+		}
+
+		return tx.Bucket(linksBucket).Delete([]byte(token))
+	})
+}
+
+func (s *boltStore) Consume(token string) (link Link, err error) {
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		link, err = get(tx, token)
+		if err != nil {
+			return err
+		}
+
+		if link.Expired() {
+			return ErrExpired
+		}
+
+		if link.Exhausted() {
+			return ErrExhausted
+		}
+
+		link.Downloads++
+		return put(tx, link)
+	})
+
+	return link, err
+}
+
+func get(tx *bbolt.Tx, token string) (Link, error) {
+	var link Link
+	data := tx.Bucket(linksBucket).Get([]byte(token))
+	if data == nil {
+		return link, ErrNotFound
+	}
+
+	return link, json.Unmarshal(data, &link)
+}
+
+func put(tx *bbolt.Tx, link Link) error {
+	data, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(linksBucket).Put([]byte(link.Token), data)
+}
@@ -0,0 +1,118 @@
+package link
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// ModeRead 只读分享，可以下载文件或者目录中的文件
+	ModeRead = "read"
+	// ModeUpload 只能上传，向分享的目录中上传新文件，不能读取目录内容
+	ModeUpload = "upload"
+)
+
+var (
+	ErrNotFound  = errors.New("link not found")
+	ErrExpired   = errors.New("link expired")
+	ErrExhausted = errors.New("link download limit reached")
+)
+
+// Link 匿名访问的分享链接
+type Link struct {
+	Token string `json:"token"`
+	// Share 共享名称，Path 为共享内的资源路径
+	Share string `json:"share"`
+	Path  string `json:"path"`
+	Mode  string `json:"mode"`
+	// Owner 创建链接的用户，匿名访问时以该用户的身份以及权限访问共享
+	Owner auth.AuthedUser `json:"owner"`
+	// Login 创建者登录时使用的用户名，用于重新查询创建者当前的用户信息，
+	// LDAP 用户的 Owner.Account 为 DN，不能用于查询
+	Login        string `json:"login,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	// ExpiresAt 为空时永不过期
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// MaxDownloads 最大下载次数（上传模式为最大上传次数），0 表示不限制
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Expired 判断链接是否已经过期
+func (l Link) Expired() bool {
+	return l.ExpiresAt != nil && time.Now().After(*l.ExpiresAt)
+}
+
+// OwnerLogin 返回用于查询创建者的用户名，旧版本创建的链接没有 Login，使用 Owner.Account
+func (l Link) OwnerLogin() string {
+	if l.Login != "" {
+		return l.Login
+	}
+
+	return l.Owner.Account
+}
+
+// Exhausted 判断链接的下载次数是否已经用完
+func (l Link) Exhausted() bool {
+	return l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads
+}
+
+// HasPassword 判断链接是否设置了访问密码
+func (l Link) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+// CheckPassword 校验访问密码，未设置密码时总是返回 true
+func (l Link) CheckPassword(password string) bool {
+	if !l.HasPassword() {
+		return true
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) == nil
+}
+
+// SetPassword 设置访问密码，password 为空时清除密码
+func (l *Link) SetPassword(password string) error {
+	if password == "" {
+		l.PasswordHash = ""
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	l.PasswordHash = string(hash)
+	return nil
+}
+
+// Store 分享链接存储
+type Store interface {
+	// Create 保存新创建的链接
+	Create(link Link) error
+	// Get 查询链接，不检查是否过期
+	Get(token string) (Link, error)
+	// List 返回用户创建的所有链接
+	List(account string) ([]Link, error)
+	// Delete 撤销链接
+	Delete(token string) error
+	// Consume 检查链接是否可用并且增加一次下载次数，链接过期返回 ErrExpired，次数用完返回 ErrExhausted
+	Consume(token string) (Link, error)
+}
+
+// NewToken 生成随机的链接 token
+func NewToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
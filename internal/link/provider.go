@@ -0,0 +1,22 @@
+package link
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/webdav-server/internal/config"
+)
+
+type Provider struct{}
+
+func (p Provider) Register(binder infra.Binder) {
+	binder.MustSingletonOverride(func(conf *config.Config) (Store, error) {
+		if err := os.MkdirAll(conf.DataDir, 0700); err != nil {
+			return nil, fmt.Errorf("create data dir failed: %w", err)
+		}
+
+		return NewBoltStore(filepath.Join(conf.DataDir, "links.db"))
+	})
+}
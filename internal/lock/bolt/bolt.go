@@ -0,0 +1,82 @@
+package bolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/lock"
+	"go.etcd.io/bbolt"
+)
+
+type boltStore struct {
+	db *bbolt.DB
+}
+
+// New 创建基于 bbolt 嵌入式数据库的锁管理器，锁信息保存在 data_dir/locks.db 中
+func New(conf *config.Config) (lock.Manager, error) {
+	if err := os.MkdirAll(conf.DataDir, 0700); err != nil {
+		return nil, fmt.Errorf("create data dir failed: %w", err)
+	}
+
+	db, err := bbolt.Open(filepath.Join(conf.DataDir, "locks.db"), 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open lock database failed: %w", err)
+	}
+
+	return lock.NewManager(&boltStore{db: db}), nil
+}
+
+func (s *boltStore) Update(namespace string, fn func(records map[string]lock.Record) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+
+		original := make(map[string]string)
+		records := make(map[string]lock.Record)
+		if err := bucket.ForEach(func(k, v []byte) error {
+			var rec lock.Record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+
+			original[string(k)] = string(v)
+			records[string(k)] = rec
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err := fn(records); err != nil {
+			return err
+		}
+
+		for token := range original {
+			if _, ok := records[token]; !ok {
+				if err := bucket.Delete([]byte(token)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for token, rec := range records {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+
+			if original[token] != string(data) {
+				if err := bucket.Put([]byte(token), data); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,167 @@
+package lock_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/lock"
+	"github.com/mylxsw/webdav-server/internal/lock/bolt"
+	"github.com/mylxsw/webdav-server/internal/lock/memory"
+	"github.com/mylxsw/webdav-server/internal/lock/redis"
+	"golang.org/x/net/webdav"
+)
+
+// TestConformance 所有锁存储的行为与 webdav.NewMemLS 保持一致
+func TestConformance(t *testing.T) {
+	drivers := map[string]func(t *testing.T) lock.Manager{
+		"memory": func(t *testing.T) lock.Manager {
+			return memory.New()
+		},
+		"bolt": func(t *testing.T) lock.Manager {
+			manager, err := bolt.New(&config.Config{DataDir: t.TempDir()})
+			if err != nil {
+				t.Fatalf("create bolt lock manager failed: %v", err)
+			}
+
+			return manager
+		},
+		"redis": func(t *testing.T) lock.Manager {
+			addr := os.Getenv("WEBDAV_TEST_REDIS_ADDR")
+			if addr == "" {
+				addr = "127.0.0.1:6379"
+			}
+
+			client := goredis.NewClient(&goredis.Options{Addr: addr})
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := client.Ping(ctx).Err(); err != nil {
+				t.Skipf("redis %s is unavailable: %v", addr, err)
+			}
+
+			return redis.New(&config.Redis{Addr: addr, KeyPrefix: fmt.Sprintf("webdav-server-test-%d", time.Now().UnixNano())})
+		},
+	}
+
+	for name, create := range drivers {
+		t.Run(name, func(t *testing.T) {
+			manager := create(t)
+			for caseName, fn := range conformanceCases {
+				t.Run(caseName, func(t *testing.T) {
+					fn(t, manager.LockSystem(t.Name()))
+				})
+			}
+		})
+	}
+}
+
+var conformanceCases = map[string]func(t *testing.T, ls webdav.LockSystem){
+	"conflict": func(t *testing.T, ls webdav.LockSystem) {
+		now := time.Now()
+		createLock(t, ls, now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute})
+
+		for _, tc := range []struct {
+			root      string
+			zeroDepth bool
+			err       error
+		}{
+			{root: "/a/b", err: webdav.ErrLocked},
+			{root: "/a/b/c", err: webdav.ErrLocked},
+			{root: "/a", zeroDepth: false, err: webdav.ErrLocked},
+			{root: "/a", zeroDepth: true, err: nil},
+			{root: "/a/bc", err: nil},
+		} {
+			token, err := ls.Create(now, webdav.LockDetails{Root: tc.root, Duration: time.Minute, ZeroDepth: tc.zeroDepth})
+			if err != tc.err {
+				t.Errorf("create %s (zero depth %v): got %v, want %v", tc.root, tc.zeroDepth, err, tc.err)
+			}
+
+			if err == nil {
+				if err := ls.Unlock(now, token); err != nil {
+					t.Errorf("unlock %s failed: %v", tc.root, err)
+				}
+			}
+		}
+	},
+	"confirm": func(t *testing.T, ls webdav.LockSystem) {
+		now := time.Now()
+		token := createLock(t, ls, now, webdav.LockDetails{Root: "/dir", Duration: time.Minute})
+
+		if _, err := ls.Confirm(now, "/other", "", webdav.Condition{Token: token}); err != webdav.ErrConfirmationFailed {
+			t.Errorf("confirm uncovered path: got %v, want %v", err, webdav.ErrConfirmationFailed)
+		}
+
+		release, err := ls.Confirm(now, "/dir/file", "", webdav.Condition{Token: token})
+		if err != nil {
+			t.Fatalf("confirm covered path failed: %v", err)
+		}
+
+		if _, err := ls.Confirm(now, "/dir/file", "", webdav.Condition{Token: token}); err != webdav.ErrConfirmationFailed {
+			t.Errorf("confirm held lock: got %v, want %v", err, webdav.ErrConfirmationFailed)
+		}
+
+		if err := ls.Unlock(now, token); err != webdav.ErrLocked {
+			t.Errorf("unlock held lock: got %v, want %v", err, webdav.ErrLocked)
+		}
+
+		release()
+		if err := ls.Unlock(now, token); err != nil {
+			t.Errorf("unlock released lock failed: %v", err)
+		}
+	},
+	"expiry": func(t *testing.T, ls webdav.LockSystem) {
+		now := time.Now()
+		token := createLock(t, ls, now, webdav.LockDetails{Root: "/file", Duration: time.Minute})
+
+		if _, err := ls.Refresh(now.Add(30*time.Second), token, 2*time.Minute); err != nil {
+			t.Fatalf("refresh failed: %v", err)
+		}
+
+		if _, err := ls.Create(now.Add(time.Minute+time.Second), webdav.LockDetails{Root: "/file", Duration: time.Minute}); err != webdav.ErrLocked {
+			t.Errorf("create on refreshed lock: got %v, want %v", err, webdav.ErrLocked)
+		}
+
+		later := now.Add(3 * time.Minute)
+		if _, err := ls.Refresh(later, token, time.Minute); err != webdav.ErrNoSuchLock {
+			t.Errorf("refresh expired lock: got %v, want %v", err, webdav.ErrNoSuchLock)
+		}
+
+		createLock(t, ls, later, webdav.LockDetails{Root: "/file", Duration: time.Minute})
+	},
+	"infinite": func(t *testing.T, ls webdav.LockSystem) {
+		// 与 webdav.Handler 在 PUT 等请求期间创建的临时锁相同
+		now := time.Now()
+		token := createLock(t, ls, now, webdav.LockDetails{Root: "/file", Duration: -1, ZeroDepth: true})
+
+		if _, err := ls.Create(time.Now(), webdav.LockDetails{Root: "/file", Duration: time.Minute}); err != webdav.ErrLocked {
+			t.Errorf("create on infinite lock: got %v, want %v", err, webdav.ErrLocked)
+		}
+
+		if err := ls.Unlock(time.Now(), token); err != nil {
+			t.Fatalf("unlock infinite lock failed: %v", err)
+		}
+
+		if err := ls.Unlock(time.Now(), token); err != webdav.ErrNoSuchLock {
+			t.Errorf("unlock twice: got %v, want %v", err, webdav.ErrNoSuchLock)
+		}
+
+		createLock(t, ls, time.Now(), webdav.LockDetails{Root: "/file", Duration: time.Minute})
+	},
+}
+
+func createLock(t *testing.T, ls webdav.LockSystem, now time.Time, details webdav.LockDetails) string {
+	t.Helper()
+
+	token, err := ls.Create(now, details)
+	if err != nil {
+		t.Fatalf("create lock %s failed: %v", details.Root, err)
+	}
+
+	return token
+}
@@ -0,0 +1,11 @@
+package lock
+
+import (
+	"golang.org/x/net/webdav"
+)
+
+// Manager 锁管理器，为每个共享目录提供独立的 webdav.LockSystem
+type Manager interface {
+	// LockSystem 返回命名空间对应的 webdav.LockSystem，相同的命名空间总是返回相同的锁数据
+	LockSystem(namespace string) webdav.LockSystem
+}
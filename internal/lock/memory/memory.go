@@ -0,0 +1,32 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/mylxsw/webdav-server/internal/lock"
+	"golang.org/x/net/webdav"
+)
+
+type memoryManager struct {
+	lock    sync.Mutex
+	systems map[string]webdav.LockSystem
+}
+
+// New 创建基于内存的锁管理器，锁信息在重启后丢失
+func New() lock.Manager {
+	return &memoryManager{systems: make(map[string]webdav.LockSystem)}
+}
+
+func (m *memoryManager) LockSystem(namespace string) webdav.LockSystem {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if ls, ok := m.systems[namespace]; ok {
+		return ls
+	}
+
+	ls := webdav.NewMemLS()
+	m.systems[namespace] = ls
+
+	return ls
+}
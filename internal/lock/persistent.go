@@ -0,0 +1,353 @@
+package lock
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mylxsw/asteria/log"
+	"golang.org/x/net/webdav"
+)
+
+// infiniteLease 永不过期的锁（包括 webdav.Handler 在 PUT、DELETE 等请求期间创建的临时锁）在存储中的租期，
+// 创建锁的进程定期续期，进程异常退出后锁在租期结束后自动失效，不会一直锁定资源
+const infiniteLease = 5 * time.Minute
+
+// Record 持久化存储的锁信息
+type Record struct {
+	Token     string        `json:"token"`
+	Root      string        `json:"root"`
+	Duration  time.Duration `json:"duration"`
+	OwnerXML  string        `json:"owner_xml,omitempty"`
+	ZeroDepth bool          `json:"zero_depth,omitempty"`
+	// Expiry 过期时间，Duration 为负数时为续期的租期
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+func (rec Record) details() webdav.LockDetails {
+	return webdav.LockDetails{
+		Root:      rec.Root,
+		Duration:  rec.Duration,
+		OwnerXML:  rec.OwnerXML,
+		ZeroDepth: rec.ZeroDepth,
+	}
+}
+
+// expired 判断锁是否过期，旧版本保存的没有过期时间的锁同样视为已过期
+func (rec Record) expired(now time.Time) bool {
+	return !now.Before(rec.Expiry)
+}
+
+// covers 判断锁是否作用于 name 所代表的资源
+func (rec Record) covers(name string) bool {
+	if name == rec.Root {
+		return true
+	}
+
+	if rec.ZeroDepth {
+		return false
+	}
+
+	return isDescendant(name, rec.Root)
+}
+
+// Store 锁信息的持久化存储
+type Store interface {
+	// Update 读取命名空间下所有的锁并交给 fn 修改，fn 返回 nil 时将修改后的结果写回存储，
+	// 实现需要保证整个过程的原子性
+	Update(namespace string, fn func(records map[string]Record) error) error
+}
+
+type persistentManager struct {
+	store Store
+
+	lock    sync.Mutex
+	systems map[string]webdav.LockSystem
+}
+
+// NewManager 创建一个基于持久化存储的锁管理器
+func NewManager(store Store) Manager {
+	return &persistentManager{store: store, systems: make(map[string]webdav.LockSystem)}
+}
+
+func (m *persistentManager) LockSystem(namespace string) webdav.LockSystem {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if ls, ok := m.systems[namespace]; ok {
+		return ls
+	}
+
+	ls := &persistentLS{store: m.store, namespace: namespace, held: make(map[string]bool), owned: make(map[string]bool)}
+	m.systems[namespace] = ls
+
+	return ls
+}
+
+// persistentLS 基于 Store 实现的 webdav.LockSystem，语义与 webdav.NewMemLS 保持一致
+//
+// 锁信息保存在 Store 中，可以在重启后恢复以及在多个实例之间共享；
+// 锁的 held 状态（Confirm 后尚未 release）只在当前进程中维护
+type persistentLS struct {
+	store     Store
+	namespace string
+
+	mu   sync.Mutex
+	held map[string]bool
+	// owned 当前进程创建的永不过期的锁，renewing 为 true 时续期的 goroutine 正在运行
+	owned    map[string]bool
+	renewing bool
+}
+
+func (ls *persistentLS) update(now time.Time, fn func(records map[string]Record) error) error {
+	return ls.store.Update(ls.namespace, func(records map[string]Record) error {
+		for token, rec := range records {
+			if rec.expired(now) {
+				delete(records, token)
+			}
+		}
+
+		return fn(records)
+	})
+}
+
+func (ls *persistentLS) lookup(records map[string]Record, name string, conditions ...webdav.Condition) string {
+	// TODO: support Condition.Not and Condition.ETag.
+	for _, c := range conditions {
+		rec, ok := records[c.Token]
+		if !ok || ls.held[c.Token] {
+			continue
+		}
+
+		if rec.covers(name) {
+			return c.Token
+		}
+	}
+
+	return ""
+}
+
+func (ls *persistentLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var token0, token1 string
+	err := ls.update(now, func(records map[string]Record) error {
+		if name0 != "" {
+			if token0 = ls.lookup(records, slashClean(name0), conditions...); token0 == "" {
+				return webdav.ErrConfirmationFailed
+			}
+		}
+
+		if name1 != "" {
+			if token1 = ls.lookup(records, slashClean(name1), conditions...); token1 == "" {
+				return webdav.ErrConfirmationFailed
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't hold the same lock twice.
+	if token1 == token0 {
+		token1 = ""
+	}
+
+	for _, token := range []string{token0, token1} {
+		if token != "" {
+			ls.held[token] = true
+		}
+	}
+
+	return func() {
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+
+		delete(ls.held, token0)
+		delete(ls.held, token1)
+	}, nil
+}
+
+func (ls *persistentLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	rec := Record{
+		Token:     "opaquelocktoken:" + uuid.New().String(),
+		Root:      slashClean(details.Root),
+		Duration:  details.Duration,
+		OwnerXML:  details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+	}
+	rec.Expiry = expiry(now, rec.Duration)
+
+	err := ls.update(now, func(records map[string]Record) error {
+		for _, exist := range records {
+			if conflicts(exist, rec) {
+				return webdav.ErrLocked
+			}
+		}
+
+		records[rec.Token] = rec
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if rec.Duration < 0 {
+		ls.own(rec.Token)
+	}
+
+	return rec.Token, nil
+}
+
+func (ls *persistentLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var details webdav.LockDetails
+	err := ls.update(now, func(records map[string]Record) error {
+		rec, ok := records[token]
+		if !ok {
+			return webdav.ErrNoSuchLock
+		}
+
+		if ls.held[token] {
+			return webdav.ErrLocked
+		}
+
+		rec.Duration = duration
+		rec.Expiry = expiry(now, duration)
+
+		records[token] = rec
+		details = rec.details()
+		return nil
+	})
+	if err != nil {
+		return details, err
+	}
+
+	if duration < 0 {
+		ls.own(token)
+	} else {
+		delete(ls.owned, token)
+	}
+
+	return details, nil
+}
+
+func (ls *persistentLS) Unlock(now time.Time, token string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	err := ls.update(now, func(records map[string]Record) error {
+		if _, ok := records[token]; !ok {
+			return webdav.ErrNoSuchLock
+		}
+
+		if ls.held[token] {
+			return webdav.ErrLocked
+		}
+
+		delete(records, token)
+		return nil
+	})
+	if err != webdav.ErrLocked {
+		delete(ls.owned, token)
+	}
+
+	return err
+}
+
+// own 记录当前进程创建的永不过期的锁，并在需要时启动续期，调用时需要持有 ls.mu
+func (ls *persistentLS) own(token string) {
+	ls.owned[token] = true
+	if !ls.renewing {
+		ls.renewing = true
+		go ls.renew()
+	}
+}
+
+// renew 定期为当前进程持有的永不过期的锁续期，所有锁都释放后退出
+func (ls *persistentLS) renew() {
+	ticker := time.NewTicker(infiniteLease / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ls.mu.Lock()
+		if len(ls.owned) == 0 {
+			ls.renewing = false
+			ls.mu.Unlock()
+			return
+		}
+
+		now := time.Now()
+		err := ls.update(now, func(records map[string]Record) error {
+			for token := range ls.owned {
+				rec, ok := records[token]
+				if !ok || rec.Duration >= 0 {
+					delete(ls.owned, token)
+					continue
+				}
+
+				rec.Expiry = expiry(now, rec.Duration)
+				records[token] = rec
+			}
+
+			return nil
+		})
+		ls.mu.Unlock()
+
+		if err != nil {
+			log.Module("lock").Errorf("renew locks in %s failed: %v", ls.namespace, err)
+		}
+	}
+}
+
+// expiry 返回锁的过期时间，duration 为负数时返回租期的结束时间
+func expiry(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return now.Add(infiniteLease)
+	}
+
+	return now.Add(duration)
+}
+
+// conflicts 判断新创建的锁 rec 是否与已经存在的锁 exist 冲突
+func conflicts(exist Record, rec Record) bool {
+	// The target resource is already locked.
+	if exist.Root == rec.Root {
+		return true
+	}
+
+	// The requested lock depth is infinite, and a descendant of the target resource is locked.
+	if !rec.ZeroDepth && isDescendant(exist.Root, rec.Root) {
+		return true
+	}
+
+	// An ancestor of the target resource is locked with infinite depth.
+	return !exist.ZeroDepth && isDescendant(rec.Root, exist.Root)
+}
+
+// isDescendant 判断 name 是否为 root 的子孙资源
+func isDescendant(name, root string) bool {
+	if name == root {
+		return false
+	}
+
+	return root == "/" || strings.HasPrefix(name, root+"/")
+}
+
+func slashClean(name string) string {
+	if name == "" || name[0] != '/' {
+		name = "/" + name
+	}
+
+	return path.Clean(name)
+}
@@ -0,0 +1,64 @@
+package lock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+type mapStore struct {
+	lock    sync.Mutex
+	records map[string]map[string]Record
+}
+
+func (s *mapStore) Update(namespace string, fn func(records map[string]Record) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records := make(map[string]Record)
+	for token, rec := range s.records[namespace] {
+		records[token] = rec
+	}
+
+	if err := fn(records); err != nil {
+		return err
+	}
+
+	s.records[namespace] = records
+	return nil
+}
+
+// TestInfiniteLockLease 进程退出后没有释放的临时锁在租期结束后失效
+func TestInfiniteLockLease(t *testing.T) {
+	store := &mapStore{records: make(map[string]map[string]Record)}
+	now := time.Now()
+
+	crashed := NewManager(store).LockSystem("share")
+	if _, err := crashed.Create(now, webdav.LockDetails{Root: "/file", Duration: -1, ZeroDepth: true}); err != nil {
+		t.Fatalf("create lock failed: %v", err)
+	}
+
+	restarted := NewManager(store).LockSystem("share")
+	details := webdav.LockDetails{Root: "/file", Duration: time.Minute}
+	if _, err := restarted.Create(now.Add(infiniteLease-time.Second), details); err != webdav.ErrLocked {
+		t.Errorf("create before lease ends: got %v, want %v", err, webdav.ErrLocked)
+	}
+
+	if _, err := restarted.Create(now.Add(infiniteLease), details); err != nil {
+		t.Errorf("create after lease ends failed: %v", err)
+	}
+}
+
+// TestLegacyInfiniteLock 旧版本保存的没有过期时间的锁不再永久锁定资源
+func TestLegacyInfiniteLock(t *testing.T) {
+	store := &mapStore{records: map[string]map[string]Record{
+		"share": {"opaquelocktoken:legacy": {Token: "opaquelocktoken:legacy", Root: "/file", Duration: -1, ZeroDepth: true}},
+	}}
+
+	ls := NewManager(store).LockSystem("share")
+	if _, err := ls.Create(time.Now(), webdav.LockDetails{Root: "/file", Duration: time.Minute}); err != nil {
+		t.Errorf("create on legacy lock failed: %v", err)
+	}
+}
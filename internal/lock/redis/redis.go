@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/lock"
+)
+
+// maxRetries 乐观锁冲突时的最大重试次数
+const maxRetries = 10
+
+var ErrTooManyRetries = errors.New("lock store: too many retries")
+
+type redisStore struct {
+	client    *redis.Client
+	keyPrefix string
+}
+
+// New 创建基于 Redis 的锁管理器，用于多实例部署时共享锁信息
+func New(conf *config.Redis) lock.Manager {
+	client := redis.NewClient(&redis.Options{
+		Addr:     conf.Addr,
+		Password: conf.Password,
+		DB:       conf.DB,
+	})
+
+	return lock.NewManager(&redisStore{client: client, keyPrefix: conf.KeyPrefix})
+}
+
+func (s *redisStore) Update(namespace string, fn func(records map[string]lock.Record) error) error {
+	ctx := context.Background()
+	key := s.keyPrefix + ":locks:" + namespace
+
+	for i := 0; i < maxRetries; i++ {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			original, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+
+			records := make(map[string]lock.Record)
+			for token, raw := range original {
+				var rec lock.Record
+				if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+					return err
+				}
+
+				records[token] = rec
+			}
+
+			if err := fn(records); err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for token := range original {
+					if _, ok := records[token]; !ok {
+						pipe.HDel(ctx, key, token)
+					}
+				}
+
+				for token, rec := range records {
+					data, err := json.Marshal(rec)
+					if err != nil {
+						return err
+					}
+
+					if original[token] != string(data) {
+						pipe.HSet(ctx, key, token, data)
+					}
+				}
+
+				return nil
+			})
+
+			return err
+		}, key)
+
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		return err
+	}
+
+	return ErrTooManyRetries
+}
@@ -0,0 +1,185 @@
+package props
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/net/webdav"
+)
+
+type boltStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltStore 创建基于 bbolt 嵌入式数据库的 dead property 存储，每个命名空间对应一个 bucket
+func NewBoltStore(dbPath string) (Store, error) {
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(namespace, name string) (map[xml.Name]webdav.Property, error) {
+	var properties map[xml.Name]webdav.Property
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+
+		var err error
+		properties, err = decodeProperties(bucket.Get([]byte(name)))
+		return err
+	})
+
+	return properties, err
+}
+
+func (s *boltStore) Patch(namespace, name string, patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusOK}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+
+		properties, err := decodeProperties(bucket.Get([]byte(name)))
+		if err != nil {
+			return err
+		}
+
+		for _, patch := range patches {
+			for _, p := range patch.Props {
+				pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+				if patch.Remove {
+					delete(properties, p.XMLName)
+					continue
+				}
+
+				properties[p.XMLName] = p
+			}
+		}
+
+		if len(properties) == 0 {
+			return bucket.Delete([]byte(name))
+		}
+
+		data, err := encodeProperties(properties)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(name), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []webdav.Propstat{pstat}, nil
+}
+
+func (s *boltStore) Move(namespace, oldName, newName string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+
+		return eachDescendant(bucket, oldName, true, func(key string, value []byte) error {
+			if err := bucket.Put([]byte(newName+strings.TrimPrefix(key, oldName)), value); err != nil {
+				return err
+			}
+
+			return bucket.Delete([]byte(key))
+		})
+	})
+}
+
+func (s *boltStore) Copy(namespace, src, dst string, recursive bool) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+
+		return eachDescendant(bucket, src, recursive, func(key string, value []byte) error {
+			return bucket.Put([]byte(dst+strings.TrimPrefix(key, src)), value)
+		})
+	})
+}
+
+func (s *boltStore) Delete(namespace, name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+
+		return eachDescendant(bucket, name, true, func(key string, value []byte) error {
+			return bucket.Delete([]byte(key))
+		})
+	})
+}
+
+// eachDescendant 遍历 name 以及其子孙资源（recursive 为 true 时）的记录，遍历前先收集所有记录，因此 fn 中可以修改 bucket
+func eachDescendant(bucket *bbolt.Bucket, name string, recursive bool, fn func(key string, value []byte) error) error {
+	type record struct {
+		key   string
+		value []byte
+	}
+
+	records := make([]record, 0)
+	if value := bucket.Get([]byte(name)); value != nil {
+		records = append(records, record{key: name, value: append([]byte{}, value...)})
+	}
+
+	if recursive {
+		prefix := []byte(strings.TrimSuffix(name, "/") + "/")
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			records = append(records, record{key: string(k), value: append([]byte{}, v...)})
+		}
+	}
+
+	for _, rec := range records {
+		if err := fn(rec.key, rec.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeProperties(data []byte) (map[xml.Name]webdav.Property, error) {
+	properties := make(map[xml.Name]webdav.Property)
+	if data == nil {
+		return properties, nil
+	}
+
+	var list []webdav.Property
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	for _, p := range list {
+		properties[p.XMLName] = p
+	}
+
+	return properties, nil
+}
+
+func encodeProperties(properties map[xml.Name]webdav.Property) ([]byte, error) {
+	list := make([]webdav.Property, 0, len(properties))
+	for _, p := range properties {
+		list = append(list, p)
+	}
+
+	return json.Marshal(list)
+}
@@ -0,0 +1,49 @@
+package props
+
+import (
+	"encoding/xml"
+
+	"golang.org/x/net/webdav"
+)
+
+// Store WebDAV dead property 存储
+//
+// name 为共享内的资源路径（以 / 开头），Move、Copy、Delete 同时作用于 name 及其所有子孙资源
+type Store interface {
+	// Get 获取资源的所有 dead property
+	Get(namespace, name string) (map[xml.Name]webdav.Property, error)
+	// Patch 修改资源的 dead property，语义与 webdav.DeadPropsHolder 的 Patch 一致
+	Patch(namespace, name string, patches []webdav.Proppatch) ([]webdav.Propstat, error)
+	// Move 将资源的 dead property 移动到新的路径
+	Move(namespace, oldName, newName string) error
+	// Copy 将资源的 dead property 复制到新的路径，recursive 为 false 时只复制资源自身
+	Copy(namespace, src, dst string, recursive bool) error
+	// Delete 删除资源的 dead property
+	Delete(namespace, name string) error
+}
+
+type nopStore struct{}
+
+// NewNopStore 创建一个不保存任何 dead property 的存储
+func NewNopStore() Store {
+	return nopStore{}
+}
+
+func (nopStore) Get(namespace, name string) (map[xml.Name]webdav.Property, error) {
+	return nil, nil
+}
+
+func (nopStore) Patch(namespace, name string, patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: 403}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+
+	return []webdav.Propstat{pstat}, nil
+}
+
+func (nopStore) Move(namespace, oldName, newName string) error   { return nil }
+func (nopStore) Copy(namespace, src, dst string, rec bool) error { return nil }
+func (nopStore) Delete(namespace, name string) error             { return nil }
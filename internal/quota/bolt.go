@@ -0,0 +1,321 @@
+package quota
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	usageBucket   = []byte("usage")
+	filesBucket   = []byte("files")
+	scannedBucket = []byte("scanned")
+)
+
+// fileRecord 文件所有者信息，用于在文件被覆盖或者删除时扣减对应用户以及用户组的用量
+type fileRecord struct {
+	Owner  string   `json:"owner"`
+	Groups []string `json:"groups,omitempty"`
+	Size   int64    `json:"size"`
+}
+
+type boltManager struct {
+	reloader *config.Reloader
+	db       *bbolt.DB
+}
+
+// NewBoltManager 创建基于 bbolt 的配额管理器，用量信息保存在 dbPath 中，用户以及用户组的配额使用 reloader 中当前生效的配置
+func NewBoltManager(reloader *config.Reloader, dbPath string) (Manager, error) {
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{usageBucket, filesBucket, scannedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &boltManager{reloader: reloader, db: db}, nil
+}
+
+func (m *boltManager) Enabled() bool {
+	return true
+}
+
+func (m *boltManager) Init(namespace string, scope string) error {
+	var scanned bool
+	if err := m.db.View(func(tx *bbolt.Tx) error {
+		scanned = tx.Bucket(scannedBucket).Get([]byte(namespace)) != nil
+		return nil
+	}); err != nil || scanned {
+		return err
+	}
+
+	var usage Usage
+	startTime := time.Now()
+	if err := filepath.Walk(scope, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if p == scope {
+			return nil
+		}
+
+		// 共享目录中的 .webdav 为服务端保留的目录，只有回收站中文件的内容（.webdav/trash/<account>/<id>/data）计入用量，
+		// 与文件删除到回收站时保持一致
+		rel, _ := filepath.Rel(scope, p)
+		if segs := strings.Split(filepath.ToSlash(rel), "/"); segs[0] == ".webdav" {
+			if len(segs) < 5 || segs[1] != "trash" || segs[4] != "data" {
+				if info.IsDir() && (len(segs) == 2 && segs[1] != "trash" || len(segs) == 5) {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+		}
+
+		usage.Files++
+		if info.Mode().IsRegular() {
+			usage.Bytes += info.Size()
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"namespace": namespace,
+		"bytes":     usage.Bytes,
+		"files":     usage.Files,
+		"elapse":    time.Since(startTime).String(),
+	}).Info("quota usage initialized")
+
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		if err := putUsage(tx, shareSubject(namespace), usage); err != nil {
+			return err
+		}
+
+		return tx.Bucket(scannedBucket).Put([]byte(namespace), []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+func (m *boltManager) Check(share *config.Share, namespace string, user *auth.AuthedUser, delta Usage) error {
+	return m.db.View(func(tx *bbolt.Tx) error {
+		for _, lim := range limits(m.reloader.Config(), share, namespace, user) {
+			usage := getUsage(tx, lim.subject)
+			limitBytes, limitFiles := lim.quota.Limit()
+			if limitBytes > 0 && delta.Bytes > 0 && usage.Bytes+delta.Bytes > limitBytes {
+				return ErrQuotaExceeded
+			}
+
+			if limitFiles > 0 && delta.Files > 0 && usage.Files+delta.Files > limitFiles {
+				return ErrQuotaExceeded
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m *boltManager) Available(share *config.Share, namespace string, user *auth.AuthedUser) (available int64, used int64, limited bool, err error) {
+	err = m.db.View(func(tx *bbolt.Tx) error {
+		used = getUsage(tx, shareSubject(namespace)).Bytes
+		for _, lim := range limits(m.reloader.Config(), share, namespace, user) {
+			limitBytes, _ := lim.quota.Limit()
+			if limitBytes <= 0 {
+				continue
+			}
+
+			usage := getUsage(tx, lim.subject)
+			remain := limitBytes - usage.Bytes
+			if remain < 0 {
+				remain = 0
+			}
+
+			if !limited || remain < available {
+				available, used, limited = remain, usage.Bytes, true
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (m *boltManager) Written(namespace string, name string, user *auth.AuthedUser, oldSize int64, newSize int64, created bool) error {
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		files, err := tx.Bucket(filesBucket).CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+
+		shareDelta := Usage{Bytes: newSize - oldSize}
+		if created {
+			shareDelta.Files = 1
+		}
+
+		if err := addUsage(tx, shareSubject(namespace), shareDelta); err != nil {
+			return err
+		}
+
+		if data := files.Get([]byte(name)); data != nil {
+			var rec fileRecord
+			if err := json.Unmarshal(data, &rec); err == nil {
+				if err := addOwnerUsage(tx, rec, Usage{Bytes: -rec.Size, Files: -1}); err != nil {
+					return err
+				}
+			}
+		}
+
+		rec := fileRecord{Owner: user.Account, Groups: user.Groups, Size: newSize}
+		if err := addOwnerUsage(tx, rec, Usage{Bytes: rec.Size, Files: 1}); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+
+		return files.Put([]byte(name), data)
+	})
+}
+
+func (m *boltManager) Removed(namespace string, name string, removed Usage) error {
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		if err := addUsage(tx, shareSubject(namespace), Usage{Bytes: -removed.Bytes, Files: -removed.Files}); err != nil {
+			return err
+		}
+
+		files := tx.Bucket(filesBucket).Bucket([]byte(namespace))
+		if files == nil {
+			return nil
+		}
+
+		return eachDescendant(files, name, func(key string, value []byte) error {
+			var rec fileRecord
+			if err := json.Unmarshal(value, &rec); err == nil {
+				if err := addOwnerUsage(tx, rec, Usage{Bytes: -rec.Size, Files: -1}); err != nil {
+					return err
+				}
+			}
+
+			return files.Delete([]byte(key))
+		})
+	})
+}
+
+func (m *boltManager) Moved(namespace string, oldName string, newName string) error {
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		files := tx.Bucket(filesBucket).Bucket([]byte(namespace))
+		if files == nil {
+			return nil
+		}
+
+		return eachDescendant(files, oldName, func(key string, value []byte) error {
+			if err := files.Put([]byte(newName+strings.TrimPrefix(key, oldName)), value); err != nil {
+				return err
+			}
+
+			return files.Delete([]byte(key))
+		})
+	})
+}
+
+// addOwnerUsage 修改文件所有者以及所有者所属用户组的用量
+func addOwnerUsage(tx *bbolt.Tx, rec fileRecord, delta Usage) error {
+	if rec.Owner == "" {
+		return nil
+	}
+
+	if err := addUsage(tx, userSubject(rec.Owner), delta); err != nil {
+		return err
+	}
+
+	for _, group := range rec.Groups {
+		if err := addUsage(tx, groupSubject(group), delta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addUsage(tx *bbolt.Tx, subject string, delta Usage) error {
+	usage := getUsage(tx, subject)
+	usage.Bytes += delta.Bytes
+	usage.Files += delta.Files
+
+	if usage.Bytes < 0 {
+		usage.Bytes = 0
+	}
+
+	if usage.Files < 0 {
+		usage.Files = 0
+	}
+
+	return putUsage(tx, subject, usage)
+}
+
+func getUsage(tx *bbolt.Tx, subject string) Usage {
+	var usage Usage
+	if data := tx.Bucket(usageBucket).Get([]byte(subject)); data != nil {
+		_ = json.Unmarshal(data, &usage)
+	}
+
+	return usage
+}
+
+func putUsage(tx *bbolt.Tx, subject string, usage Usage) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(usageBucket).Put([]byte(subject), data)
+}
+
+// eachDescendant 遍历 name 以及其子孙资源的记录，遍历前先收集所有记录，因此 fn 中可以修改 bucket
+func eachDescendant(bucket *bbolt.Bucket, name string, fn func(key string, value []byte) error) error {
+	keys := make([]string, 0)
+	values := make([][]byte, 0)
+	if value := bucket.Get([]byte(name)); value != nil {
+		keys, values = append(keys, name), append(values, append([]byte{}, value...))
+	}
+
+	prefix := []byte(strings.TrimSuffix(name, "/") + "/")
+	cursor := bucket.Cursor()
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		keys, values = append(keys, string(k)), append(values, append([]byte{}, v...))
+	}
+
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package quota
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/webdav-server/internal/config"
+)
+
+type Provider struct{}
+
+func (p Provider) Register(binder infra.Binder) {
+	binder.MustSingletonOverride(func(conf *config.Config, reloader *config.Reloader) (Manager, error) {
+		if !conf.QuotaEnabled() {
+			return NewNopManager(), nil
+		}
+
+		if err := os.MkdirAll(conf.DataDir, 0700); err != nil {
+			return nil, fmt.Errorf("create data dir failed: %w", err)
+		}
+
+		return NewBoltManager(reloader, filepath.Join(conf.DataDir, "quota.db"))
+	})
+}
@@ -0,0 +1,88 @@
+package quota
+
+import (
+	"errors"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Usage 存储用量
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// Manager 存储配额管理
+//
+// 用量按照 share（共享目录）、user（上传文件的用户）以及 group（上传文件的用户所属的用户组）分别统计，
+// 文件系统发生变化时增量更新，只有在共享目录首次启用配额时扫描一次目录计算已有的用量
+type Manager interface {
+	// Enabled 是否启用了配额
+	Enabled() bool
+	// Init 初始化共享目录的用量，只在首次启用配额时扫描目录
+	Init(namespace string, scope string) error
+	// Check 检查用户在共享中增加 delta 的用量后是否会超出配额，超出时返回 ErrQuotaExceeded
+	Check(share *config.Share, namespace string, user *auth.AuthedUser, delta Usage) error
+	// Available 返回用户在共享中可用的字节数以及对应的已用字节数，limited 为 false 表示没有字节数限制
+	Available(share *config.Share, namespace string, user *auth.AuthedUser) (available int64, used int64, limited bool, err error)
+	// Written 记录文件写入，文件的所有者变更为 user
+	Written(namespace string, name string, user *auth.AuthedUser, oldSize int64, newSize int64, created bool) error
+	// Removed 记录文件或者目录删除，removed 为删除的文件总大小以及文件数
+	Removed(namespace string, name string, removed Usage) error
+	// Moved 记录文件或者目录移动
+	Moved(namespace string, oldName string, newName string) error
+}
+
+type nopManager struct{}
+
+// NewNopManager 创建未启用配额时使用的配额管理器
+func NewNopManager() Manager {
+	return nopManager{}
+}
+
+func (nopManager) Enabled() bool                             { return false }
+func (nopManager) Init(namespace string, scope string) error { return nil }
+func (nopManager) Check(share *config.Share, namespace string, user *auth.AuthedUser, delta Usage) error {
+	return nil
+}
+func (nopManager) Available(share *config.Share, namespace string, user *auth.AuthedUser) (int64, int64, bool, error) {
+	return 0, 0, false, nil
+}
+func (nopManager) Written(namespace string, name string, user *auth.AuthedUser, oldSize int64, newSize int64, created bool) error {
+	return nil
+}
+func (nopManager) Removed(namespace string, name string, removed Usage) error   { return nil }
+func (nopManager) Moved(namespace string, oldName string, newName string) error { return nil }
+
+func shareSubject(namespace string) string { return "share:" + namespace }
+func userSubject(account string) string    { return "user:" + account }
+func groupSubject(group string) string     { return "group:" + group }
+
+// limit 一个配额限制以及其对应的统计对象
+type limit struct {
+	subject string
+	quota   config.Quota
+}
+
+// limits 返回用户在共享中所有生效的配额限制
+func limits(conf *config.Config, share *config.Share, namespace string, user *auth.AuthedUser) []limit {
+	result := make([]limit, 0)
+	if share.Quota.IsLimited() {
+		result = append(result, limit{subject: shareSubject(namespace), quota: share.Quota})
+	}
+
+	if quota, ok := conf.Quotas.Users[user.Account]; ok && quota.IsLimited() {
+		result = append(result, limit{subject: userSubject(user.Account), quota: quota})
+	}
+
+	for _, group := range user.Groups {
+		if quota, ok := conf.Quotas.Groups[group]; ok && quota.IsLimited() {
+			result = append(result, limit{subject: groupSubject(group), quota: quota})
+		}
+	}
+
+	return result
+}
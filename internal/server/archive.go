@@ -0,0 +1,177 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"golang.org/x/net/webdav"
+)
+
+// isArchiveRequest 判断是否为下载目录压缩包的请求
+func isArchiveRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Query().Has("archive")
+}
+
+// archiveWriter 压缩包写入，zip 与 tar.gz 格式的公共接口
+type archiveWriter interface {
+	// Add 添加一个文件或者目录，目录的 src 为 nil
+	Add(name string, info os.FileInfo, src io.Reader) error
+	Close() error
+}
+
+// serveArchive 以 zip 或者 tar.gz 格式流式下载目录，压缩包直接写入响应，不在磁盘上暂存，
+// 用户没有读权限的文件以及目录被跳过
+//
+//	GET /path/dir/?archive=zip
+//	GET /path/dir/?archive=tar.gz
+func serveArchive(w http.ResponseWriter, r *http.Request, share *Share, handler *webdav.Handler, user *auth.AuthedUser) {
+	name := strings.TrimPrefix(r.URL.Path, handler.Prefix)
+	info, err := handler.FileSystem.Stat(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if !info.IsDir() {
+		http.Error(w, "not a collection", http.StatusBadRequest)
+		return
+	}
+
+	base := path.Base(path.Clean("/" + name))
+	if base == "/" {
+		base = share.Conf.Name
+	}
+	if base == "" {
+		base = "archive"
+	}
+
+	var archive archiveWriter
+	format := r.URL.Query().Get("archive")
+	switch format {
+	case "zip", "":
+		format = "zip"
+		w.Header().Set("Content-Type", "application/zip")
+		archive = &zipArchive{w: zip.NewWriter(w)}
+	case "tar.gz", "tgz":
+		format = "tar.gz"
+		w.Header().Set("Content-Type", "application/gzip")
+		gw := gzip.NewWriter(w)
+		archive = &tarArchive{gw: gw, w: tar.NewWriter(gw)}
+	default:
+		http.Error(w, "unsupported archive format", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+escapeFilename(base+"."+format))
+	w.WriteHeader(http.StatusOK)
+
+	// 响应头已经发送，之后的错误只能中断响应
+	err = walkTree(r, handler.FileSystem, name, -1, func(entry searchEntry) error {
+		if !user.HasPrivilege(share.Conf, readPrivilege(entry.info), collectionPath(path.Join(handler.Prefix, entry.name), entry.info.IsDir())) {
+			return nil
+		}
+
+		entryName := path.Join(base, strings.TrimPrefix(entry.name, slashClean(name)))
+		if entry.info.IsDir() {
+			return archive.Add(entryName+"/", entry.info, nil)
+		}
+
+		if !entry.info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := handler.FileSystem.OpenFile(r.Context(), entry.name, os.O_RDONLY, 0)
+		if err != nil {
+			log.WithFields(log.Fields{"path": entry.name}).Warningf("skip file in archive: %v", err)
+			return nil
+		}
+		defer f.Close()
+
+		return archive.Add(entryName, entry.info, io.LimitReader(f, entry.info.Size()))
+	})
+
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{"path": r.URL.Path, "format": format}).Errorf("write archive failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (a *zipArchive) Add(name string, info os.FileInfo, src io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	if src != nil {
+		header.Method = zip.Deflate
+	}
+
+	dst, err := a.w.CreateHeader(header)
+	if err != nil || src == nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.w.Close()
+}
+
+type tarArchive struct {
+	gw *gzip.Writer
+	w  *tar.Writer
+}
+
+func (a *tarArchive) Add(name string, info os.FileInfo, src io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	header.Uname, header.Gname = "", ""
+	if err := a.w.WriteHeader(header); err != nil || src == nil {
+		return err
+	}
+
+	// 文件在写入期间被截断时，tar 要求写满头中声明的大小
+	n, err := io.Copy(a.w, src)
+	if err == nil && n < header.Size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+
+	return a.gw.Close()
+}
+
+// escapeFilename 按照 RFC 5987 编码 Content-Disposition 中的文件名
+func escapeFilename(name string) string {
+	return strings.ReplaceAll(url.QueryEscape(name), "+", "%20")
+}
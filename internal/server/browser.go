@@ -0,0 +1,420 @@
+package server
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/quota"
+	"golang.org/x/net/webdav"
+)
+
+//go:embed templates/browser.html
+var browserTemplateContent string
+
+var browserTemplate = template.Must(template.New("browser").Funcs(template.FuncMap{
+	"humanSize": humanSize,
+}).Parse(browserTemplateContent))
+
+// browser 为浏览器提供的 HTML 目录浏览功能，支持上传、创建目录、重命名以及删除
+type browser struct {
+	share   *Share
+	handler *webdav.Handler
+	user    *auth.AuthedUser
+}
+
+type browserEntry struct {
+	Name    string
+	Href    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+type breadcrumb struct {
+	Name string
+	Href string
+}
+
+type browserPage struct {
+	User        string
+	Path        string
+	Parent      string
+	Breadcrumbs []breadcrumb
+	Entries     []browserEntry
+	// CanCreate、CanMove、CanDelete 控制页面上显示的操作，服务端仍然针对每个目标路径单独检查权限
+	CanCreate bool
+	CanMove   bool
+	CanDelete bool
+	Sort      string
+	Order     string
+	Error     string
+}
+
+// NextOrder 返回点击列标题时使用的排序方式
+func (page browserPage) NextOrder(column string) string {
+	if page.Sort == column && page.Order == "asc" {
+		return "desc"
+	}
+
+	return "asc"
+}
+
+// acceptsHTML 判断客户端是否为浏览器，非浏览器客户端保持返回 PROPFIND 的 XML 结果
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// ServeHTTP 处理浏览器对目录的 GET 以及 POST 请求
+func (b browser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := b.handleAction(r); err != nil {
+			log.WithFields(log.Fields{"account": b.user.Account, "action": r.URL.Query().Get("action")}).Debugf("browser action failed: %v", err)
+			b.render(w, r, errorStatus(err), err.Error())
+			return
+		}
+
+		http.Redirect(w, r, (&url.URL{Path: r.URL.Path}).EscapedPath(), http.StatusSeeOther)
+		return
+	}
+
+	b.render(w, r, http.StatusOK, "")
+}
+
+func (b browser) render(w http.ResponseWriter, r *http.Request, status int, errMessage string) {
+	dirPath := b.dirPath(r)
+	f, err := b.handler.FileSystem.OpenFile(r.Context(), dirPath, os.O_RDONLY, 0)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		http.Error(w, "read directory failed", http.StatusInternalServerError)
+		return
+	}
+
+	privileges := b.user.Privileges(b.share.Conf, collectionPath(r.URL.Path, true))
+	page := browserPage{
+		User:      b.user.Name,
+		Path:      r.URL.Path,
+		CanCreate: privileges.Has(config.PrivilegeCreate),
+		CanMove:   privileges.Has(config.PrivilegeMove),
+		CanDelete: privileges.Has(config.PrivilegeDelete),
+		Sort:      r.URL.Query().Get("sort"),
+		Order:     r.URL.Query().Get("order"),
+		Error:     errMessage,
+	}
+
+	if page.User == "" {
+		page.User = b.user.Account
+	}
+
+	for _, info := range infos {
+		entry := browserEntry{
+			Name:    info.Name(),
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+
+		entry.Href = (&url.URL{Path: path.Join(r.URL.Path, info.Name())}).EscapedPath()
+		if entry.IsDir {
+			entry.Href += "/"
+		}
+
+		page.Entries = append(page.Entries, entry)
+	}
+
+	sortBrowserEntries(page.Entries, page.Sort, page.Order)
+	page.Breadcrumbs = buildBreadcrumbs(b.share.Conf.Prefix, r.URL.Path)
+	if len(page.Breadcrumbs) > 1 {
+		page.Parent = page.Breadcrumbs[len(page.Breadcrumbs)-2].Href
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := browserTemplate.Execute(w, page); err != nil {
+		log.Errorf("render browser template failed: %v", err)
+	}
+}
+
+// handleAction 处理浏览器提交的表单操作，每个操作都针对目标路径单独检查权限
+func (b browser) handleAction(r *http.Request) error {
+	if !sameOrigin(r) {
+		return errForbidden
+	}
+
+	dirPath := b.dirPath(r)
+	switch r.URL.Query().Get("action") {
+	case "upload":
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return errInvalidName
+		}
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if part.FileName() == "" {
+				continue
+			}
+
+			if err := b.upload(r, dirPath, part.FileName(), part); err != nil {
+				return err
+			}
+		}
+	case "mkdir":
+		name, err := b.authorizedName(r, r.PostFormValue("name"), config.PrivilegeCreate, true)
+		if err != nil {
+			return err
+		}
+
+		return withLock(b.handler.LockSystem, path.Join(dirPath, name), func() error {
+			return b.handler.FileSystem.Mkdir(r.Context(), path.Join(dirPath, name), 0777)
+		})
+	case "rename":
+		from, err := b.authorizedName(r, r.PostFormValue("name"), config.PrivilegeMove, false)
+		if err != nil {
+			return err
+		}
+
+		info, err := b.handler.FileSystem.Stat(r.Context(), path.Join(dirPath, from))
+		if err != nil {
+			return err
+		}
+
+		to, err := b.authorizedName(r, r.PostFormValue("to"), config.PrivilegeCreate, info.IsDir())
+		if err != nil {
+			return err
+		}
+
+		if _, err := b.handler.FileSystem.Stat(r.Context(), path.Join(dirPath, to)); err == nil {
+			return os.ErrExist
+		}
+
+		return withLock(b.handler.LockSystem, path.Join(dirPath, from), func() error {
+			return withLock(b.handler.LockSystem, path.Join(dirPath, to), func() error {
+				return b.handler.FileSystem.Rename(r.Context(), path.Join(dirPath, from), path.Join(dirPath, to))
+			})
+		})
+	case "delete":
+		name, err := b.authorizedName(r, r.PostFormValue("name"), config.PrivilegeDelete, false)
+		if err != nil {
+			return err
+		}
+
+		if _, err := b.handler.FileSystem.Stat(r.Context(), path.Join(dirPath, name)); err != nil {
+			return err
+		}
+
+		return withLock(b.handler.LockSystem, path.Join(dirPath, name), func() error {
+			return b.handler.FileSystem.RemoveAll(r.Context(), path.Join(dirPath, name))
+		})
+	}
+
+	return errUnsupportedAction
+}
+
+func (b browser) upload(r *http.Request, dirPath string, filename string, src io.Reader) error {
+	name := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+
+	// 覆盖已经存在的文件需要 overwrite 权限
+	privilege := config.PrivilegeCreate
+	if _, err := b.handler.FileSystem.Stat(r.Context(), path.Join(dirPath, name)); err == nil {
+		privilege = config.PrivilegeOverwrite
+	}
+
+	name, err := b.authorizedName(r, name, privilege, false)
+	if err != nil {
+		return err
+	}
+
+	return withLock(b.handler.LockSystem, path.Join(dirPath, name), func() error {
+		f, err := b.handler.FileSystem.OpenFile(r.Context(), path.Join(dirPath, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+
+		_, copyErr := io.Copy(f, src)
+		closeErr := f.Close()
+		if copyErr != nil {
+			return copyErr
+		}
+
+		return closeErr
+	})
+}
+
+// sameOrigin 检查表单是否由当前站点的页面提交，防止跨站请求伪造
+//
+// 优先使用 Origin，没有 Origin 时使用 Referer，两者都没有的请求同样拒绝
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+
+	if source == "" {
+		return false
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+
+	return u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// authorizedName 检查文件名是否合法，并且当前用户对该文件拥有 privilege 权限，
+// 文件不存在时 isDir 表示将要创建的是否为目录
+func (b browser) authorizedName(r *http.Request, name string, privilege config.Privilege, isDir bool) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return "", errInvalidName
+	}
+
+	info, err := b.handler.FileSystem.Stat(r.Context(), path.Join(b.dirPath(r), name))
+	if err == nil {
+		isDir = info.IsDir()
+	}
+
+	requestPath := collectionPath(path.Join(r.URL.Path, name), isDir)
+	if !b.user.HasPrivilege(b.share.Conf, privilege, requestPath) {
+		return "", errForbidden
+	}
+
+	// 删除以及移动目录时同样作用于目录中的所有资源
+	if subtree := subtreePrivilege(info, err == nil, privilege&(config.PrivilegeDelete|config.PrivilegeMove)); subtree != config.PrivilegeNone {
+		if _, ok := authorizeSubtree(r, b.share.Conf, b.handler, b.user, requestPath, subtree); !ok {
+			return "", errForbidden
+		}
+	}
+
+	return name, nil
+}
+
+// withLock 与 webdav.Handler 一致，在操作期间持有一个临时锁，避免与客户端持有的锁冲突
+func withLock(ls webdav.LockSystem, name string, cb func() error) error {
+	now := time.Now()
+	token, err := ls.Create(now, webdav.LockDetails{
+		Root:      name,
+		Duration:  -1,
+		ZeroDepth: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer ls.Unlock(now, token)
+
+	return cb()
+}
+
+func (b browser) dirPath(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, b.handler.Prefix)
+}
+
+var (
+	errForbidden         = errors.New("access denied")
+	errInvalidName       = errors.New("invalid name")
+	errUnsupportedAction = errors.New("unsupported action")
+)
+
+// errorStatus 根据错误类型返回响应状态码
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errForbidden), os.IsPermission(err):
+		return http.StatusForbidden
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, webdav.ErrLocked):
+		return webdav.StatusLocked
+	case errors.Is(err, errInvalidName), errors.Is(err, errUnsupportedAction):
+		return http.StatusBadRequest
+	case os.IsExist(err):
+		return http.StatusConflict
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+// buildBreadcrumbs 根据请求路径构建导航，第一项为共享的根目录
+func buildBreadcrumbs(prefix string, requestPath string) []breadcrumb {
+	crumbs := []breadcrumb{{Name: strings.Trim(prefix, "/"), Href: (&url.URL{Path: strings.TrimSuffix(prefix, "/") + "/"}).EscapedPath()}}
+	if crumbs[0].Name == "" {
+		crumbs[0].Name = "/"
+	}
+
+	current := strings.TrimSuffix(prefix, "/")
+	for _, seg := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(requestPath, prefix), "/"), "/") {
+		if seg == "" {
+			continue
+		}
+
+		current = current + "/" + seg
+		crumbs = append(crumbs, breadcrumb{Name: seg, Href: (&url.URL{Path: current + "/"}).EscapedPath()})
+	}
+
+	return crumbs
+}
+
+// sortBrowserEntries 对目录内容排序，目录始终排在文件之前
+func sortBrowserEntries(entries []browserEntry, sortBy string, order string) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+
+		a, b := entries[i], entries[j]
+		if order == "desc" {
+			a, b = b, a
+		}
+
+		switch sortBy {
+		case "size":
+			return a.Size < b.Size
+		case "modified":
+			return a.ModTime.Before(b.ModTime)
+		default:
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+	})
+}
+
+// humanSize 将文件大小转换为易读的格式
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+)
+
+// requestState 单次请求的状态，通过 context 在 http handler 与文件系统之间共享
+type requestState struct {
+	user *auth.AuthedUser
+	// quotaExceeded 文件系统操作因为超出配额失败，响应状态码需要改写为 507 Insufficient Storage
+	quotaExceeded bool
+	// bodyErr 读取请求体时发生的错误，原子写入的文件据此判断上传是否完整
+	bodyErr error
+}
+
+// requestBody 记录读取请求体时发生的错误，webdav.Handler 在 PUT 失败时仍然会关闭文件，
+// 文件自身无法区分上传是正常结束还是中断
+type requestBody struct {
+	io.ReadCloser
+	state *requestState
+}
+
+func (b requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.state.bodyErr = err
+	}
+
+	return n, err
+}
+
+type requestStateKey struct{}
+
+func withRequestState(ctx context.Context, state *requestState) context.Context {
+	return context.WithValue(ctx, requestStateKey{}, state)
+}
+
+// hasRequestState 判断 ctx 是否来自用户请求，服务内部的操作（如清理回收站）没有请求状态
+func hasRequestState(ctx context.Context) bool {
+	_, ok := ctx.Value(requestStateKey{}).(*requestState)
+	return ok
+}
+
+func requestStateFrom(ctx context.Context) *requestState {
+	if state, ok := ctx.Value(requestStateKey{}).(*requestState); ok {
+		return state
+	}
+
+	return &requestState{user: &auth.AuthedUser{}}
+}
@@ -0,0 +1,567 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/link"
+	"github.com/mylxsw/webdav-server/internal/service"
+	"golang.org/x/net/webdav"
+)
+
+// linkAPIPrefix 分享链接管理接口的路径
+//
+//	GET    /.webdav/api/links          列出当前用户创建的分享链接
+//	POST   /.webdav/api/links          创建分享链接
+//	DELETE /.webdav/api/links/<token>  撤销分享链接
+//
+// 创建链接的请求体为 JSON：
+//
+//	{"path": "/docs/report.pdf", "mode": "read", "password": "", "expires_in": "72h", "max_downloads": 10}
+//
+// 创建只读链接需要对 path 拥有 read 权限（目录还需要 list 权限），创建上传链接需要对目录拥有 create 权限
+const linkAPIPrefix = "/.webdav/api/links"
+
+// linkPrefix 匿名访问分享链接的路径，不需要 Basic 认证
+//
+//	GET /.webdav/s/<token>                      下载分享的文件，分享的是目录时返回目录内容列表
+//	GET /.webdav/s/<token>/sub/file.txt         下载分享目录中的文件
+//	GET /.webdav/s/<token>/sub/?archive=zip     下载分享目录的压缩包
+//	PUT /.webdav/s/<token>/file.txt             向上传链接分享的目录中上传新文件
+//
+// 链接设置了密码时，通过 Basic 认证的密码字段提供，用户名可以为任意值
+const linkPrefix = "/.webdav/s/"
+
+var (
+	errLinkMode       = errors.New("operation not allowed by link mode")
+	errLengthRequired = errors.New("content length required")
+)
+
+// linkRequest 创建分享链接的请求
+type linkRequest struct {
+	Path         string     `json:"path"`
+	Mode         string     `json:"mode"`
+	Password     string     `json:"password"`
+	ExpiresIn    string     `json:"expires_in"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads int        `json:"max_downloads"`
+}
+
+// linkEntry 分享链接接口返回的链接信息，不包含密码
+type linkEntry struct {
+	Token        string     `json:"token"`
+	Share        string     `json:"share"`
+	Path         string     `json:"path"`
+	Mode         string     `json:"mode"`
+	HasPassword  bool       `json:"has_password"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Expired      bool       `json:"expired"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	CreatedAt    time.Time  `json:"created_at"`
+	// URL 被分享资源的请求路径，Link 为匿名访问的路径
+	URL  string `json:"url"`
+	Link string `json:"link"`
+}
+
+func newLinkEntry(share *Share, l link.Link) linkEntry {
+	prefix := ""
+	if share != nil {
+		prefix = share.Conf.Prefix
+	}
+
+	return linkEntry{
+		Token:        l.Token,
+		Share:        l.Share,
+		Path:         l.Path,
+		Mode:         l.Mode,
+		HasPassword:  l.HasPassword(),
+		ExpiresAt:    l.ExpiresAt,
+		Expired:      l.Expired(),
+		MaxDownloads: l.MaxDownloads,
+		Downloads:    l.Downloads,
+		CreatedAt:    l.CreatedAt,
+		URL:          path.Join("/", prefix, l.Path),
+		Link:         linkPrefix + l.Token,
+	}
+}
+
+type linkAPI struct {
+	shares *Shares
+	store  link.Store
+}
+
+func (api linkAPI) ServeHTTP(w http.ResponseWriter, r *http.Request, user *auth.AuthedUser) {
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, linkAPIPrefix), "/")
+	switch {
+	case r.Method == http.MethodGet && token == "":
+		items, err := api.store.List(user.Account)
+		if err != nil {
+			http.Error(w, "list links failed", http.StatusInternalServerError)
+			return
+		}
+
+		entries := make([]linkEntry, 0, len(items))
+		for _, l := range items {
+			entries = append(entries, newLinkEntry(api.shares.Get(l.Share), l))
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(entries)
+	case r.Method == http.MethodPost && token == "":
+		var req linkRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		share, l, err := api.create(r, user, req)
+		if err != nil {
+			log.WithFields(log.Fields{"account": user.Account, "path": req.Path}).Debugf("create link failed: %v", err)
+			http.Error(w, err.Error(), linkErrorStatus(err))
+			return
+		}
+
+		log.WithFields(log.Fields{"account": user.Account, "share": l.Share, "path": l.Path, "mode": l.Mode}).Infof("share link created")
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(newLinkEntry(share, l))
+	case r.Method == http.MethodDelete && token != "":
+		l, err := api.store.Get(token)
+		if err == nil && l.Owner.Account != user.Account {
+			err = link.ErrNotFound
+		}
+
+		if err == nil {
+			err = api.store.Delete(token)
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), linkErrorStatus(err))
+			return
+		}
+
+		log.WithFields(log.Fields{"account": user.Account, "share": l.Share, "path": l.Path}).Infof("share link revoked")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// create 校验请求并且创建分享链接
+func (api linkAPI) create(r *http.Request, user *auth.AuthedUser, req linkRequest) (*Share, link.Link, error) {
+	var l link.Link
+
+	target := path.Clean("/" + req.Path)
+	share := api.shares.Match(target)
+	if share == nil {
+		return nil, l, os.ErrNotExist
+	}
+
+	mode := req.Mode
+	if mode == "" {
+		mode = link.ModeRead
+	}
+
+	if mode != link.ModeRead && mode != link.ModeUpload {
+		return nil, l, fmt.Errorf("%w: invalid mode %s", errUnsupportedAction, mode)
+	}
+
+	handler, err := share.Handler(user)
+	if err != nil {
+		return nil, l, err
+	}
+
+	name := slashClean(strings.TrimPrefix(target, handler.Prefix))
+	info, err := handler.FileSystem.Stat(r.Context(), name)
+	if err != nil {
+		return nil, l, err
+	}
+
+	if mode == link.ModeUpload && !info.IsDir() {
+		return nil, l, fmt.Errorf("%w: upload links require a collection", errUnsupportedAction)
+	}
+
+	// 只读链接需要能够读取分享的文件，分享目录时还需要能够列出目录内容
+	required := config.PrivilegeCreate
+	if mode == link.ModeRead {
+		required = config.PrivilegeRead
+		if info.IsDir() {
+			required |= config.PrivilegeList
+		}
+	}
+
+	if !user.HasPrivilege(share.Conf, required, collectionPath(target, info.IsDir())) {
+		return nil, l, errForbidden
+	}
+
+	if req.MaxDownloads < 0 {
+		return nil, l, fmt.Errorf("%w: invalid max_downloads", errUnsupportedAction)
+	}
+
+	token, err := link.NewToken()
+	if err != nil {
+		return nil, l, err
+	}
+
+	login, _, _ := r.BasicAuth()
+	l = link.Link{
+		Token:        token,
+		Share:        share.Conf.Name,
+		Path:         name,
+		Mode:         mode,
+		Owner:        *user,
+		Login:        login,
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+		CreatedAt:    time.Now(),
+	}
+
+	if req.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			return nil, l, fmt.Errorf("%w: invalid expires_in", errUnsupportedAction)
+		}
+
+		expiresAt := l.CreatedAt.Add(expiresIn)
+		l.ExpiresAt = &expiresAt
+	}
+
+	if err := l.SetPassword(req.Password); err != nil {
+		return nil, l, err
+	}
+
+	return share, l, api.store.Create(l)
+}
+
+// links 处理分享链接的匿名访问，以链接创建者的身份访问共享，每次访问都重新检查创建者的权限
+type links struct {
+	shares  *Shares
+	store   link.Store
+	authSrv service.AuthService
+}
+
+func (s links) ServeHTTP(w http.ResponseWriter, r *http.Request, clientIP string, verbose bool) {
+	token, rel := strings.TrimPrefix(r.URL.Path, linkPrefix), ""
+	if i := strings.Index(token, "/"); i >= 0 {
+		token, rel = token[:i], token[i:]
+	}
+
+	targetResponse := newResponseWriter(w, verbose)
+	var l link.Link
+	defer func() {
+		// 匿名访问的审计日志，Basic 认证中的用户名由访问者自行填写，仅用于辨识，
+		// token 只记录前 8 位，避免日志的读者获得链接的访问权限
+		username, _, _ := r.BasicAuth()
+		requestURI := r.RequestURI
+		if token != "" {
+			requestURI = strings.Replace(requestURI, token, tokenExcerpt(token)+"...", 1)
+		}
+
+		log.F(log.M{
+			"remote":   clientIP,
+			"username": username,
+			"link": log.M{
+				"token": tokenExcerpt(token),
+				"owner": l.Owner.Account,
+				"share": l.Share,
+				"path":  l.Path,
+				"mode":  l.Mode,
+			},
+			"request": log.M{
+				"method": r.Method,
+				"url":    requestURI,
+				"ua":     r.Header.Get("User-Agent"),
+			},
+			"response": targetResponse.Response(),
+		}).Infof("share link access")
+	}()
+
+	l, err := s.store.Get(token)
+	if err == nil && l.Expired() {
+		err = link.ErrExpired
+	}
+
+	if err != nil {
+		http.Error(targetResponse, err.Error(), linkErrorStatus(err))
+		return
+	}
+
+	if _, password, _ := r.BasicAuth(); !l.CheckPassword(password) {
+		targetResponse.Header().Set("WWW-Authenticate", `Basic realm="Share link"`)
+		http.Error(targetResponse, "password required", http.StatusUnauthorized)
+		return
+	}
+
+	share := s.shares.Get(l.Share)
+	if share == nil || share.Conf.Name != l.Share {
+		http.Error(targetResponse, "share not available", http.StatusNotFound)
+		return
+	}
+
+	owner, err := resolveLinkOwner(s.authSrv, l)
+	if err != nil {
+		if errors.Is(err, auth.ErrNoSuchUser) {
+			http.Error(targetResponse, "link owner no longer exists", http.StatusGone)
+			return
+		}
+
+		log.WithFields(log.Fields{"owner": l.Owner.Account}).Errorf("resolve link owner failed: %v", err)
+		http.Error(targetResponse, "share not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	state := &requestState{user: owner}
+	r = r.WithContext(withRequestState(r.Context(), state))
+	targetResponse.state = state
+
+	handler, err := share.Handler(owner)
+	if err != nil {
+		log.WithFields(log.Fields{"owner": owner.Account, "share": share.Conf.Name}).Errorf("resolve share failed: %v", err)
+		http.Error(targetResponse, "share not available", http.StatusInternalServerError)
+		return
+	}
+
+	// rel 先按照绝对路径清理，保证拼接后的路径不会超出分享的资源
+	name := path.Join(l.Path, path.Clean("/"+rel))
+	if isReserved(name) {
+		http.Error(targetResponse, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch l.Mode {
+	case link.ModeRead:
+		err = s.read(targetResponse, r, share, handler, l, name)
+	case link.ModeUpload:
+		err = s.upload(r, share, handler, l, name)
+		if err == nil {
+			targetResponse.WriteHeader(http.StatusCreated)
+		}
+	default:
+		err = errLinkMode
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{"token": tokenExcerpt(token), "path": name}).Debugf("share link request failed: %v", err)
+		http.Error(targetResponse, err.Error(), linkErrorStatus(err))
+	}
+}
+
+// resolveLinkOwner 每次访问都使用创建者当前的用户信息，创建者被删除或者禁用后链接失效，用户组的变化立即生效
+//
+// 通过创建者登录时的用户名查询，misc 认证中本地用户与 LDAP 用户同名时，再按照 local:、ldap: 前缀查询创建者所属的认证方式；
+// 查询到的账号与创建链接时不同（用户名已经属于其他用户）时同样视为创建者不存在
+func resolveLinkOwner(authSrv service.AuthService, l link.Link) (*auth.AuthedUser, error) {
+	logins := []string{l.OwnerLogin()}
+	if l.Owner.Type != "" && !strings.Contains(logins[0], ":") {
+		logins = append(logins, l.Owner.Type+":"+logins[0])
+	}
+
+	for _, login := range logins {
+		owner, err := authSrv.GetUser(login)
+		if err != nil {
+			if errors.Is(err, auth.ErrNoSuchUser) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if owner.Account == l.Owner.Account && (l.Owner.UUID == "" || owner.UUID == l.Owner.UUID) {
+			return owner, nil
+		}
+	}
+
+	return nil, auth.ErrNoSuchUser
+}
+
+// read 处理只读链接的下载请求，文件下载以及目录压缩包下载计入下载次数，目录列表不计入
+//
+// 只有内容完整发送（200）或者从第一个字节开始发送（206）时才计入一次下载，断点续传、分段下载的后续请求以及 304 不计入；
+// 下载次数用完后只允许继续之前下载的后续分段
+func (s links) read(w *responseWriter, r *http.Request, share *Share, h *webdav.Handler, l link.Link, name string) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return errLinkMode
+	}
+
+	info, err := h.FileSystem.Stat(r.Context(), name)
+	if err != nil {
+		return err
+	}
+
+	owner := requestStateFrom(r.Context()).user
+	if !owner.HasPrivilege(share.Conf, readPrivilege(info), collectionPath(path.Join(h.Prefix, name), info.IsDir())) {
+		return errForbidden
+	}
+
+	if info.IsDir() && !isArchiveRequest(r) {
+		return s.list(w, r, share, h, l, name)
+	}
+
+	if r.Method == http.MethodGet && l.Exhausted() && !isResumeRequest(r) {
+		return link.ErrExhausted
+	}
+
+	defer func() {
+		if r.Method == http.MethodGet && countsAsDownload(r, w.statusCode) {
+			if _, err := s.store.Consume(l.Token); err != nil {
+				log.WithFields(log.Fields{"token": tokenExcerpt(l.Token), "path": name}).Debugf("count share link download failed: %v", err)
+			}
+		}
+	}()
+
+	if info.IsDir() {
+		ar := r.Clone(r.Context())
+		ar.URL.Path = path.Join(h.Prefix, name)
+		serveArchive(w, ar, share, h, owner)
+		return nil
+	}
+
+	f, err := h.FileSystem.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+escapeFilename(info.Name()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// isResumeRequest 判断是否为断点续传或者分段下载的后续请求：Range 不从第一个字节开始，并且不带 If-Range，
+// 保证响应只包含部分内容，不会返回完整的文件
+func isResumeRequest(r *http.Request) bool {
+	rangeHeader := strings.TrimSpace(r.Header.Get("Range"))
+	return rangeHeader != "" && !strings.HasPrefix(rangeHeader, "bytes=0-") && r.Header.Get("If-Range") == ""
+}
+
+// countsAsDownload 判断已经发送的响应是否计入下载次数
+func countsAsDownload(r *http.Request, statusCode int) bool {
+	switch statusCode {
+	case http.StatusOK:
+		return true
+	case http.StatusPartialContent:
+		return strings.HasPrefix(strings.TrimSpace(r.Header.Get("Range")), "bytes=0-")
+	}
+
+	return false
+}
+
+// linkListEntry 分享目录列表中的文件信息
+type linkListEntry struct {
+	Name     string    `json:"name"`
+	IsDir    bool      `json:"is_dir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	URL      string    `json:"url"`
+}
+
+// list 返回分享目录的内容列表，只包含创建者有读权限的文件
+func (s links) list(w http.ResponseWriter, r *http.Request, share *Share, h *webdav.Handler, l link.Link, name string) error {
+	owner := requestStateFrom(r.Context()).user
+	entries := make([]linkListEntry, 0)
+	err := walkTree(r, h.FileSystem, name, 1, func(entry searchEntry) error {
+		if !owner.HasPrivilege(share.Conf, config.PrivilegeList, collectionPath(path.Join(h.Prefix, entry.name), entry.info.IsDir())) {
+			return nil
+		}
+
+		href := linkPrefix + l.Token + "/" + strings.TrimPrefix(strings.TrimPrefix(entry.name, l.Path), "/")
+		if entry.info.IsDir() {
+			href += "/"
+		}
+
+		entries = append(entries, linkListEntry{
+			Name:     entry.info.Name(),
+			IsDir:    entry.info.IsDir(),
+			Size:     entry.info.Size(),
+			Modified: entry.info.ModTime(),
+			URL:      href,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// upload 处理上传链接的上传请求，只能在分享的目录中创建新文件，不能覆盖已有文件，用量计入链接创建者
+func (s links) upload(r *http.Request, share *Share, h *webdav.Handler, l link.Link, name string) error {
+	if r.Method != http.MethodPut {
+		return errLinkMode
+	}
+
+	if path.Dir(name) != slashClean(l.Path) || name == slashClean(l.Path) {
+		return fmt.Errorf("%w: invalid file name", errInvalidName)
+	}
+
+	if r.ContentLength < 0 {
+		return errLengthRequired
+	}
+
+	owner := requestStateFrom(r.Context()).user
+	if !owner.HasPrivilege(share.Conf, config.PrivilegeCreate, path.Join(h.Prefix, name)) {
+		return errForbidden
+	}
+
+	dir, ok := h.FileSystem.(WebDavDir)
+	if !ok {
+		return errUnsupportedAction
+	}
+
+	return withLock(h.LockSystem, name, func() error {
+		if _, err := dir.Stat(r.Context(), name); err == nil {
+			return os.ErrExist
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := dir.CheckWrite(r.Context(), name, r.ContentLength); err != nil {
+			return err
+		}
+
+		if _, err := s.store.Consume(l.Token); err != nil {
+			return err
+		}
+
+		return dir.Replace(r.Context(), name, io.LimitReader(r.Body, r.ContentLength))
+	})
+}
+
+// linkErrorStatus 根据错误类型返回分享链接请求的响应状态码
+func linkErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, link.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, link.ErrExpired), errors.Is(err, link.ErrExhausted):
+		return http.StatusGone
+	case errors.Is(err, errLinkMode):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, errLengthRequired):
+		return http.StatusLengthRequired
+	}
+
+	return errorStatus(err)
+}
+
+// tokenExcerpt 返回 token 的前 8 位，用于日志输出
+func tokenExcerpt(token string) string {
+	if len(token) > 8 {
+		return token[:8]
+	}
+
+	return token
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/link"
+)
+
+// testAuthService 按照用户名返回固定的用户，模拟 misc 认证中的 local:、ldap: 前缀
+type testAuthService map[string]auth.AuthedUser
+
+func (srv testAuthService) Login(username, password string) (*auth.AuthedUser, error) {
+	return srv.GetUser(username)
+}
+
+func (srv testAuthService) GetUser(username string) (*auth.AuthedUser, error) {
+	if username == "down" {
+		return nil, errors.New("ldap server unavailable")
+	}
+
+	user, ok := srv[username]
+	if !ok {
+		return nil, auth.ErrNoSuchUser
+	}
+
+	return &user, nil
+}
+
+func (srv testAuthService) Reload(conf *config.Config) {}
+
+func TestResolveLinkOwner(t *testing.T) {
+	ldapAlice := auth.AuthedUser{Type: "ldap", UUID: "6f1c", Account: "CN=Alice,OU=Staff,DC=example,DC=com", Groups: []string{"editor"}}
+	localAlice := auth.AuthedUser{Type: "local", Account: "alice", Groups: []string{"vistor"}}
+	localBob := auth.AuthedUser{Type: "local", Account: "bob"}
+
+	authSrv := testAuthService{
+		"alice":      localAlice,
+		"local:bob":  localBob,
+		"bob":        localBob,
+		"ldap:alice": ldapAlice,
+		"carol":      {Type: "ldap", UUID: "other", Account: "CN=Carol,DC=example,DC=com"},
+	}
+
+	tests := []struct {
+		name  string
+		link  link.Link
+		want  string
+		isErr error
+	}{
+		// LDAP 用户的 Account 为 DN，通过登录时的用户名查询
+		{name: "ldap owner", link: link.Link{Owner: ldapAlice, Login: "alice"}, want: ldapAlice.Account},
+		{name: "local owner", link: link.Link{Owner: localAlice, Login: "alice"}, want: localAlice.Account},
+		{name: "prefixed login", link: link.Link{Owner: localBob, Login: "local:bob"}, want: localBob.Account},
+		{name: "link without login", link: link.Link{Owner: localBob}, want: localBob.Account},
+		{name: "owner removed", link: link.Link{Owner: auth.AuthedUser{Type: "local", Account: "dave"}, Login: "dave"}, isErr: auth.ErrNoSuchUser},
+		{name: "login reused by another user", link: link.Link{Owner: auth.AuthedUser{Type: "ldap", UUID: "1234", Account: "CN=Carol,DC=example,DC=com"}, Login: "carol"}, isErr: auth.ErrNoSuchUser},
+	}
+
+	for _, tt := range tests {
+		owner, err := resolveLinkOwner(authSrv, tt.link)
+		if tt.isErr != nil {
+			if !errors.Is(err, tt.isErr) {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, tt.isErr)
+			}
+			continue
+		}
+
+		if err != nil || owner.Account != tt.want {
+			t.Errorf("%s: got %v, %v, want %s", tt.name, owner, err, tt.want)
+		}
+	}
+
+	if _, err := resolveLinkOwner(authSrv, link.Link{Owner: localAlice, Login: "down"}); err == nil || errors.Is(err, auth.ErrNoSuchUser) {
+		t.Errorf("lookup failure: got %v, want the lookup error", err)
+	}
+}
+
+func TestLinkDownloadCounting(t *testing.T) {
+	tests := []struct {
+		rangeHeader string
+		ifRange     string
+		status      int
+		counted     bool
+		resume      bool
+	}{
+		{status: http.StatusOK, counted: true},
+		{status: http.StatusNotModified},
+		{rangeHeader: "bytes=0-1023", status: http.StatusPartialContent, counted: true},
+		{rangeHeader: "bytes=1024-", status: http.StatusPartialContent, resume: true},
+		{rangeHeader: "bytes=-512", status: http.StatusPartialContent, resume: true},
+		// If-Range 不匹配时返回完整的文件
+		{rangeHeader: "bytes=1024-", ifRange: `"etag"`, status: http.StatusOK, counted: true},
+		{rangeHeader: "bytes=1024-", status: http.StatusRequestedRangeNotSatisfiable, resume: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/.webdav/s/token", nil)
+		if tt.rangeHeader != "" {
+			r.Header.Set("Range", tt.rangeHeader)
+		}
+		if tt.ifRange != "" {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+
+		if got := countsAsDownload(r, tt.status); got != tt.counted {
+			t.Errorf("countsAsDownload(%q, %d) = %v, want %v", tt.rangeHeader, tt.status, got, tt.counted)
+		}
+
+		if got := isResumeRequest(r); got != tt.resume {
+			t.Errorf("isResumeRequest(%q, if-range %q) = %v, want %v", tt.rangeHeader, tt.ifRange, got, tt.resume)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mylxsw/asteria/log"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"golang.org/x/net/webdav"
+)
+
+// privilegeCheck 请求需要对 Path 拥有的权限
+type privilegeCheck struct {
+	Path      string
+	Privilege config.Privilege
+	// Subtree Path 为目录时，请求同样作用于目录中的所有资源（如删除、移动目录），需要对其中每一个资源拥有的权限
+	Subtree config.Privilege
+}
+
+// normalizeRequest 将请求路径以及 Destination 请求头中的路径规范化，
+// 保证权限检查与 webdav.Handler 实际操作的是同一个路径
+func normalizeRequest(r *http.Request) {
+	r.URL.Path, r.URL.RawPath = config.CanonicalPath(r.URL.Path), ""
+
+	if destination := r.Header.Get("Destination"); destination != "" {
+		if dst, err := url.Parse(destination); err == nil && dst.Path != "" {
+			dst.Path, dst.RawPath = config.CanonicalPath(dst.Path), ""
+			r.Header.Set("Destination", dst.String())
+		}
+	}
+}
+
+// requiredPrivileges 根据 WebDAV 方法以及请求目标返回请求需要的权限，COPY、MOVE 同时检查 Destination
+//
+//	GET、HEAD          文件需要 read，目录（目录浏览、PROPFIND、压缩包下载）需要 list
+//	PROPFIND、SEARCH   list
+//	PUT                目标不存在时需要 create，已经存在时需要 overwrite
+//	MKCOL              create
+//	DELETE             delete
+//	PROPPATCH          overwrite
+//	LOCK、UNLOCK       lock，锁定不存在的资源时还需要 create
+//	COPY               源需要 read，目标需要 create 或者 overwrite，覆盖目录时还需要 delete
+//	MOVE               源需要 move，目标与 COPY 相同
+//	OPTIONS            不需要任何权限
+//
+// DELETE、MOVE 以及 COPY 的源为目录时，还需要对目录中每一个资源拥有 delete、move、read（目录为 list）权限，
+// 覆盖已经存在的目录时需要对其中每一个资源拥有 delete 权限，避免通过操作上级目录绕过子目录上的 deny 规则
+func requiredPrivileges(r *http.Request, handler *webdav.Handler) []privilegeCheck {
+	target := r.URL.Path
+	info, exists := statRequestPath(r, handler, target)
+	target = collectionPath(target, r.Method == "MKCOL" || exists && info.IsDir())
+
+	var privilege config.Privilege
+	switch r.Method {
+	case http.MethodOptions:
+		return nil
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+		switch {
+		case isVersionsRequest(r) && r.Method == http.MethodPost:
+			privilege = config.PrivilegeOverwrite
+		case isVersionsRequest(r):
+			privilege = config.PrivilegeRead
+		case exists && info.IsDir():
+			privilege = config.PrivilegeList
+		default:
+			privilege = config.PrivilegeRead
+		}
+	case "PROPFIND", "SEARCH":
+		privilege = config.PrivilegeList
+	case http.MethodPut:
+		privilege = writePrivilege(info, exists)
+	case "MKCOL":
+		privilege = config.PrivilegeCreate
+	case http.MethodDelete:
+		return []privilegeCheck{{Path: target, Privilege: config.PrivilegeDelete, Subtree: subtreePrivilege(info, exists, config.PrivilegeDelete)}}
+	case "PROPPATCH":
+		privilege = config.PrivilegeOverwrite
+	case "LOCK":
+		privilege = config.PrivilegeLock
+		if !exists {
+			privilege |= config.PrivilegeCreate
+		}
+	case "UNLOCK":
+		privilege = config.PrivilegeLock
+	case "COPY", "MOVE":
+		privilege = config.PrivilegeMove
+		if r.Method == "COPY" {
+			privilege = config.PrivilegeRead
+		}
+
+		checks := []privilegeCheck{{Path: target, Privilege: privilege, Subtree: subtreePrivilege(info, exists, privilege)}}
+
+		// Destination 不属于当前共享时由 webdav.Handler 拒绝
+		if dst, err := url.Parse(r.Header.Get("Destination")); err == nil && dst.Path != "" {
+			dstPath := config.CanonicalPath(dst.Path)
+			if dstPath == handler.Prefix || strings.HasPrefix(dstPath, strings.TrimSuffix(handler.Prefix, "/")+"/") {
+				dstInfo, dstExists := statRequestPath(r, handler, dstPath)
+				dstPath = collectionPath(dstPath, exists && info.IsDir() || dstExists && dstInfo.IsDir())
+				checks = append(checks, privilegeCheck{
+					Path:      dstPath,
+					Privilege: writePrivilege(dstInfo, dstExists),
+					Subtree:   subtreePrivilege(dstInfo, dstExists, config.PrivilegeDelete),
+				})
+			}
+		}
+
+		return checks
+	default:
+		privilege = config.PrivilegeAll
+	}
+
+	return []privilegeCheck{{Path: target, Privilege: privilege}}
+}
+
+// authorizeRequest 依次检查请求需要的所有权限，遇到第一个被拒绝的权限时停止，返回已经检查的所有结果
+func authorizeRequest(r *http.Request, share *config.Share, handler *webdav.Handler, user *auth.AuthedUser) ([]auth.Decision, bool) {
+	checks := requiredPrivileges(r, handler)
+	decisions := make([]auth.Decision, 0, len(checks))
+	for _, check := range checks {
+		decision := user.Authorize(share, check.Privilege, check.Path)
+		decisions = append(decisions, decision)
+
+		if !decision.Allowed {
+			return decisions, false
+		}
+
+		if check.Subtree != config.PrivilegeNone {
+			if denied, ok := authorizeSubtree(r, share, handler, user, check.Path, check.Subtree); !ok {
+				return append(decisions, denied), false
+			}
+		}
+	}
+
+	return decisions, true
+}
+
+// authorizeSubtree 检查用户对目录 requestPath 中的每一个资源是否拥有 required 权限（目录需要的 read 替换为 list），
+// 返回第一个被拒绝的检查结果，遍历目录失败时同样拒绝
+func authorizeSubtree(r *http.Request, share *config.Share, handler *webdav.Handler, user *auth.AuthedUser, requestPath string, required config.Privilege) (auth.Decision, bool) {
+	// 没有任何规则时目录中所有资源的权限都与目录相同
+	if len(share.AppliedRules()) == 0 {
+		return auth.Decision{}, true
+	}
+
+	var denied auth.Decision
+	// 使用不带请求状态的 context，Readdir 不会过滤对用户隐藏的资源
+	walkReq := r.WithContext(context.Background())
+	err := walkTree(walkReq, handler.FileSystem, strings.TrimPrefix(requestPath, handler.Prefix), -1, func(entry searchEntry) error {
+		privilege := required
+		if entry.info.IsDir() && privilege.Has(config.PrivilegeRead) {
+			privilege = privilege&^config.PrivilegeRead | config.PrivilegeList
+		}
+
+		decision := user.Authorize(share, privilege, collectionPath(path.Join(handler.Prefix, entry.name), entry.info.IsDir()))
+		if !decision.Allowed {
+			denied = decision
+			return errForbidden
+		}
+
+		return nil
+	})
+
+	switch {
+	case err == nil, os.IsNotExist(err):
+		return auth.Decision{}, true
+	case errors.Is(err, errForbidden):
+		return denied, false
+	}
+
+	log.WithFields(log.Fields{"path": requestPath}).Errorf("check privileges of collection members failed: %v", err)
+	return auth.Decision{Path: share.RelativePath(requestPath), Required: required, Rule: "error"}, false
+}
+
+// subtreePrivilege 返回操作目录时需要对目录中每一个资源拥有的权限，目标不是目录时不需要检查
+func subtreePrivilege(info os.FileInfo, exists bool, privilege config.Privilege) config.Privilege {
+	if !exists || !info.IsDir() {
+		return config.PrivilegeNone
+	}
+
+	return privilege
+}
+
+// ExplainAccess 不经过 HTTP 服务，使用与服务端相同的逻辑检查用户对 requestPath 执行 method 是否有权限，用于排查权限问题，
+// destination 为 COPY、MOVE 的目标路径，返回请求所属的共享以及每一项权限检查的结果
+func ExplainAccess(conf *config.Config, user *auth.AuthedUser, method, requestPath, destination string) (*config.Share, []auth.Decision, bool, error) {
+	r, err := http.NewRequest(method, requestPath, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if destination != "" {
+		r.Header.Set("Destination", destination)
+	}
+
+	normalizeRequest(r)
+
+	// 与 Shares.Match 相同，最长前缀优先匹配
+	var share *config.Share
+	for i := range conf.Shares {
+		if conf.Shares[i].Contains(r.URL.Path) && (share == nil || len(conf.Shares[i].Prefix) > len(share.Prefix)) {
+			share = &conf.Shares[i]
+		}
+	}
+
+	if share == nil {
+		return nil, nil, false, fmt.Errorf("no share matches %s", r.URL.Path)
+	}
+
+	scope := share.Scope
+	if share.IsTemplate() {
+		if scope, err = share.ResolveScope(user.ScopeVars()); err != nil {
+			return share, nil, false, err
+		}
+	}
+
+	// 只用于判断文件是否存在以及是否为目录，不会修改任何文件
+	handler := &webdav.Handler{Prefix: share.Prefix, FileSystem: webdav.Dir(scope)}
+	decisions, allowed := authorizeRequest(r, share, handler, user)
+
+	return share, decisions, allowed, nil
+}
+
+// collectionPath 目录的路径以 / 结尾，保证 ^/releases/ 这样的规则同样匹配对目录自身的操作（如删除、移动目录）
+func collectionPath(requestPath string, isDir bool) string {
+	if isDir && !strings.HasSuffix(requestPath, "/") {
+		return requestPath + "/"
+	}
+
+	return requestPath
+}
+
+// readPrivilege 返回读取资源需要的权限，目录需要 list，文件需要 read
+func readPrivilege(info os.FileInfo) config.Privilege {
+	if info.IsDir() {
+		return config.PrivilegeList
+	}
+
+	return config.PrivilegeRead
+}
+
+// writePrivilege 返回写入目标需要的权限，覆盖目录时目录原有的内容被删除，需要同时拥有 delete 权限
+func writePrivilege(info os.FileInfo, exists bool) config.Privilege {
+	switch {
+	case !exists:
+		return config.PrivilegeCreate
+	case info.IsDir():
+		return config.PrivilegeOverwrite | config.PrivilegeDelete
+	}
+
+	return config.PrivilegeOverwrite
+}
+
+func statRequestPath(r *http.Request, handler *webdav.Handler, requestPath string) (os.FileInfo, bool) {
+	info, err := handler.FileSystem.Stat(r.Context(), strings.TrimPrefix(requestPath, handler.Prefix))
+	return info, err == nil
+}
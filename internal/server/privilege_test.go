@@ -0,0 +1,368 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"golang.org/x/net/webdav"
+)
+
+func TestNormalizeRequest(t *testing.T) {
+	tests := []struct {
+		target      string
+		destination string
+		path        string
+		wantDest    string
+	}{
+		{target: "/docs/a.txt", path: "/docs/a.txt"},
+		{target: "/docs%2Fa.txt", path: "/docs/a.txt"},
+		{target: "/docs%2f..%2f..%2fetc/passwd", path: "/etc/passwd"},
+		{target: "//docs///a.txt", path: "/docs/a.txt"},
+		{target: "/docs/./sub//", path: "/docs/sub/"},
+		{target: "/docs/../../../etc/passwd", path: "/etc/passwd"},
+		{target: "/%2e%2e/releases/", path: "/releases/"},
+		{target: "/docs/a.txt", destination: "http://example.com/docs//b.txt", path: "/docs/a.txt", wantDest: "http://example.com/docs/b.txt"},
+		{target: "/docs/a.txt", destination: "http://example.com/docs/%2e%2e/releases/b.txt", path: "/docs/a.txt", wantDest: "http://example.com/releases/b.txt"},
+		{target: "/docs/a.txt", destination: "/docs/sub%2F..%2F..%2Fb.txt", path: "/docs/a.txt", wantDest: "/b.txt"},
+		{target: "/docs/", destination: "http://example.com/moved/", path: "/docs/", wantDest: "http://example.com/moved/"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("MOVE", tt.target, nil)
+		if tt.destination != "" {
+			r.Header.Set("Destination", tt.destination)
+		}
+
+		normalizeRequest(r)
+
+		if r.URL.Path != tt.path || r.URL.RawPath != "" {
+			t.Errorf("normalizeRequest(%q): path = %q (raw %q), want %q", tt.target, r.URL.Path, r.URL.RawPath, tt.path)
+		}
+
+		if got := r.Header.Get("Destination"); got != tt.wantDest {
+			t.Errorf("normalizeRequest(%q): destination = %q, want %q", tt.destination, got, tt.wantDest)
+		}
+	}
+}
+
+func TestRequiredPrivileges(t *testing.T) {
+	handler := testHandler(t, "/")
+
+	tests := []struct {
+		method      string
+		target      string
+		destination string
+		want        []privilegeCheck
+	}{
+		{method: http.MethodOptions, target: "/docs/"},
+		{method: http.MethodGet, target: "/docs/a.txt", want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeRead}}},
+		{method: http.MethodGet, target: "/docs", want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeList}}},
+		{method: http.MethodGet, target: "/docs/", want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeList}}},
+		{method: http.MethodGet, target: "/docs%2Fa.txt", want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeRead}}},
+		{method: http.MethodGet, target: "/docs/a.txt?versions", want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeRead}}},
+		{method: http.MethodPost, target: "/docs/a.txt?version=1", want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeOverwrite}}},
+		// 浏览器在目录上的 POST 只需要 list，上传、删除等操作由 browser 针对每个目标单独检查权限
+		{method: http.MethodPost, target: "/docs", want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeList}}},
+		{method: "PROPFIND", target: "//docs", want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeList}}},
+		{method: "SEARCH", target: "/", want: []privilegeCheck{{Path: "/", Privilege: config.PrivilegeList}}},
+		{method: http.MethodPut, target: "/docs/a.txt", want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeOverwrite}}},
+		{method: http.MethodPut, target: "/docs/new.txt", want: []privilegeCheck{{Path: "/docs/new.txt", Privilege: config.PrivilegeCreate}}},
+		{method: http.MethodPut, target: "/docs/sub/../../new.txt", want: []privilegeCheck{{Path: "/new.txt", Privilege: config.PrivilegeCreate}}},
+		{method: "MKCOL", target: "/newdir", want: []privilegeCheck{{Path: "/newdir/", Privilege: config.PrivilegeCreate}}},
+		{method: http.MethodDelete, target: "/docs", want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeDelete, Subtree: config.PrivilegeDelete}}},
+		{method: http.MethodDelete, target: "/docs/", want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeDelete, Subtree: config.PrivilegeDelete}}},
+		{method: http.MethodDelete, target: "/docs/x/..", want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeDelete, Subtree: config.PrivilegeDelete}}},
+		{method: http.MethodDelete, target: "/docs/a.txt", want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeDelete}}},
+		{method: "PROPPATCH", target: "/docs/a.txt", want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeOverwrite}}},
+		{method: "LOCK", target: "/docs/a.txt", want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeLock}}},
+		{method: "LOCK", target: "/docs/new.txt", want: []privilegeCheck{{Path: "/docs/new.txt", Privilege: config.PrivilegeLock | config.PrivilegeCreate}}},
+		{method: "UNLOCK", target: "/docs", want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeLock}}},
+		{
+			method: "COPY", target: "/docs/a.txt", destination: "http://example.com/docs/b.txt",
+			want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeRead}, {Path: "/docs/b.txt", Privilege: config.PrivilegeCreate}},
+		},
+		{
+			method: "COPY", target: "/docs/a.txt", destination: "http://example.com/docs/%2e%2e/releases/a.txt",
+			want: []privilegeCheck{{Path: "/docs/a.txt", Privilege: config.PrivilegeRead}, {Path: "/releases/a.txt", Privilege: config.PrivilegeCreate}},
+		},
+		{
+			method: "MOVE", target: "/docs/a.txt", destination: "http://example.com//releases",
+			want: []privilegeCheck{
+				{Path: "/docs/a.txt", Privilege: config.PrivilegeMove},
+				{Path: "/releases/", Privilege: config.PrivilegeOverwrite | config.PrivilegeDelete, Subtree: config.PrivilegeDelete},
+			},
+		},
+		{
+			method: "MOVE", target: "/docs", destination: "http://example.com/moved",
+			want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeMove, Subtree: config.PrivilegeMove}, {Path: "/moved/", Privilege: config.PrivilegeCreate}},
+		},
+		{
+			method: "MOVE", target: "/docs/", destination: "/releases/",
+			want: []privilegeCheck{
+				{Path: "/docs/", Privilege: config.PrivilegeMove, Subtree: config.PrivilegeMove},
+				{Path: "/releases/", Privilege: config.PrivilegeOverwrite | config.PrivilegeDelete, Subtree: config.PrivilegeDelete},
+			},
+		},
+		{
+			method: "COPY", target: "/docs", destination: "/copied",
+			want: []privilegeCheck{{Path: "/docs/", Privilege: config.PrivilegeRead, Subtree: config.PrivilegeRead}, {Path: "/copied/", Privilege: config.PrivilegeCreate}},
+		},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.destination != "" {
+			r.Header.Set("Destination", tt.destination)
+		}
+
+		normalizeRequest(r)
+
+		if got := requiredPrivileges(r, handler); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s (destination %q): got %v, want %v", tt.method, tt.target, tt.destination, got, tt.want)
+		}
+	}
+}
+
+// TestRequiredPrivilegesOutsideShare Destination 不属于当前共享时只检查源路径，由 webdav.Handler 拒绝请求
+func TestRequiredPrivilegesOutsideShare(t *testing.T) {
+	handler := testHandler(t, "/share")
+
+	r := httptest.NewRequest("MOVE", "/share/docs", nil)
+	r.Header.Set("Destination", "http://example.com/share/../other/docs")
+	normalizeRequest(r)
+
+	want := []privilegeCheck{{Path: "/share/docs/", Privilege: config.PrivilegeMove, Subtree: config.PrivilegeMove}}
+	if got := requiredPrivileges(r, handler); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestBrowserAuthorizedName 浏览器操作目录时同样按照目录路径（以 / 结尾）匹配规则
+func TestBrowserAuthorizedName(t *testing.T) {
+	conf := testConfig(t, `
+shares:
+- name: main
+  scope: /tmp
+  prefix: /
+  access_mode: write
+  rules:
+  - path: ^/releases/
+    effect: deny
+    access_mode: delete,move
+    users: ["*"]
+`)
+
+	b := browser{
+		share:   &Share{Conf: &conf.Shares[0]},
+		handler: testHandler(t, "/"),
+		user:    &auth.AuthedUser{Account: "tester"},
+	}
+
+	tests := []struct {
+		name      string
+		privilege config.Privilege
+		isDir     bool
+		err       error
+	}{
+		{name: "releases", privilege: config.PrivilegeDelete, err: errForbidden},
+		{name: "releases", privilege: config.PrivilegeMove, err: errForbidden},
+		{name: "releases", privilege: config.PrivilegeCreate},
+		{name: "docs", privilege: config.PrivilegeDelete},
+		{name: "newdir", privilege: config.PrivilegeCreate, isDir: true},
+		{name: "..", privilege: config.PrivilegeDelete, err: errInvalidName},
+		{name: "a/b", privilege: config.PrivilegeDelete, err: errInvalidName},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if _, err := b.authorizedName(r, tt.name, tt.privilege, tt.isDir); err != tt.err {
+			t.Errorf("authorizedName(%q, %v): got %v, want %v", tt.name, tt.privilege, err, tt.err)
+		}
+	}
+}
+
+// TestAuthorizeCollectionMembers 删除、移动目录时目录中的资源同样需要对应的权限
+func TestAuthorizeCollectionMembers(t *testing.T) {
+	conf := testConfig(t, `
+shares:
+- name: main
+  scope: /tmp
+  prefix: /
+  access_mode: write
+  rules:
+  - path: ^/team/releases/
+    effect: deny
+    access_mode: delete,move
+    users: ["*"]
+`)
+
+	handler := testHandler(t, "/")
+	testTeamReleases(t, handler)
+
+	user := &auth.AuthedUser{Account: "tester"}
+	tests := []struct {
+		method      string
+		target      string
+		destination string
+		allowed     bool
+	}{
+		{method: http.MethodDelete, target: "/team/"},
+		{method: http.MethodDelete, target: "/team"},
+		{method: "MOVE", target: "/team/", destination: "/x/"},
+		{method: http.MethodDelete, target: "/team/releases/x"},
+		// 目标目录已存在时会被覆盖删除
+		{method: "MOVE", target: "/docs/", destination: "/team/"},
+		{method: "COPY", target: "/team/", destination: "/x/", allowed: true},
+		{method: http.MethodDelete, target: "/docs/", allowed: true},
+		{method: "MOVE", target: "/docs/", destination: "/x/", allowed: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.destination != "" {
+			r.Header.Set("Destination", tt.destination)
+		}
+		normalizeRequest(r)
+
+		if decisions, ok := authorizeRequest(r, &conf.Shares[0], handler, user); ok != tt.allowed {
+			t.Errorf("%s %s (destination %q): allowed = %v, want %v (%v)", tt.method, tt.target, tt.destination, ok, tt.allowed, decisions)
+		}
+	}
+
+	b := browser{share: &Share{Conf: &conf.Shares[0]}, handler: handler, user: user}
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	if _, err := b.authorizedName(r, "team", config.PrivilegeDelete, false); err != errForbidden {
+		t.Errorf("browser delete team: got %v, want %v", err, errForbidden)
+	}
+}
+
+// TestAuthorizeRequestWithPrefix 从配置文件开始，经过请求规范化以及权限检查，验证前缀不为 / 的共享
+func TestAuthorizeRequestWithPrefix(t *testing.T) {
+	conf := testConfig(t, `
+shares:
+- name: main
+  scope: /tmp
+  prefix: /share
+  access_mode: write
+  rules:
+  - path: ^/team/releases/
+    effect: deny
+    access_mode: list,read,create,delete,move
+    users: ["*"]
+`)
+
+	handler := testHandler(t, "/share")
+	testTeamReleases(t, handler)
+	user := &auth.AuthedUser{Account: "tester"}
+
+	tests := []struct {
+		method      string
+		target      string
+		destination string
+		allowed     bool
+	}{
+		{method: http.MethodGet, target: "/share/docs/a.txt", allowed: true},
+		{method: http.MethodGet, target: "/share/team/releases/x"},
+		{method: http.MethodPut, target: "/share/docs/new.txt", allowed: true},
+		{method: http.MethodPut, target: "/share/team/releases/new.txt"},
+		// 编码的 ..
+		{method: http.MethodGet, target: "/share/docs/%2e%2e/team/releases/x"},
+		{method: http.MethodGet, target: "/share/team/releases/%2e%2e/%2e%2e/docs/a.txt", allowed: true},
+		{method: http.MethodGet, target: "/share/docs%2F..%2Fteam%2Freleases%2Fx"},
+		// 重复的 /
+		{method: http.MethodGet, target: "//share//team///releases/x"},
+		{method: "PROPFIND", target: "/share//team//releases"},
+		// 目录是否以 / 结尾
+		{method: "PROPFIND", target: "/share/team/releases"},
+		{method: "PROPFIND", target: "/share/team/releases/"},
+		{method: "PROPFIND", target: "/share/team", allowed: true},
+		{method: "MKCOL", target: "/share/team/releases/sub/"},
+		// Destination 经过规范化后仍在共享内
+		{method: "COPY", target: "/share/docs/a.txt", destination: "http://example.com/share/docs/%2e%2e/team/releases/a.txt"},
+		{method: "MOVE", target: "/share/docs/a.txt", destination: "http://example.com/share//team/releases/a.txt"},
+		{method: "MOVE", target: "/share/docs/a.txt", destination: "http://example.com/share/team/a.txt", allowed: true},
+		// Destination 离开共享时只检查源路径，由 webdav.Handler 拒绝请求
+		{method: "MOVE", target: "/share/docs/a.txt", destination: "http://example.com/share/../team/releases/a.txt", allowed: true},
+		{method: "MOVE", target: "/share/team/releases/x", destination: "http://example.com/share/%2e%2e/other/x"},
+		// 删除、移动上级目录
+		{method: http.MethodDelete, target: "/share/team"},
+		{method: http.MethodDelete, target: "/share/team/"},
+		{method: http.MethodDelete, target: "/share/docs/%2e%2e/team/"},
+		{method: "MOVE", target: "/share/team/", destination: "http://example.com/share/moved/"},
+		{method: "MOVE", target: "/share/docs/", destination: "http://example.com/share/team/"},
+		{method: http.MethodDelete, target: "/share/docs", allowed: true},
+		{method: "MOVE", target: "/share/docs", destination: "http://example.com/share/moved", allowed: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.destination != "" {
+			r.Header.Set("Destination", tt.destination)
+		}
+
+		normalizeRequest(r)
+
+		if decisions, ok := authorizeRequest(r, &conf.Shares[0], handler, user); ok != tt.allowed {
+			t.Errorf("%s %s (destination %q): allowed = %v, want %v (%v)", tt.method, tt.target, tt.destination, ok, tt.allowed, decisions)
+		}
+	}
+}
+
+// testTeamReleases 在 handler 中创建 team/releases/x
+func testTeamReleases(t *testing.T, handler *webdav.Handler) {
+	t.Helper()
+
+	ctx := context.Background()
+	for _, name := range []string{"/team", "/team/releases"} {
+		if err := handler.FileSystem.Mkdir(ctx, name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := handler.FileSystem.OpenFile(ctx, "/team/releases/x", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+// testHandler 创建测试使用的 webdav.Handler，目录中包含 docs/a.txt 以及 releases/
+func testHandler(t *testing.T, prefix string) *webdav.Handler {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, name := range []string{"docs", "releases"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "docs", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &webdav.Handler{Prefix: prefix, FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()}
+}
+
+func testConfig(t *testing.T, content string) *config.Config {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := config.LoadConfFromFile(configPath)
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+
+	return conf
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/quota"
+	"golang.org/x/net/webdav"
+)
+
+// checkQuota 在执行 PUT、MKCOL 以及 COPY 之前检查配额，请求声明的大小会超出配额时返回 quota.ErrQuotaExceeded
+//
+// PUT 未声明大小（例如 chunked 编码）时无法预先检查，由 quotaFile 在写入时限制
+func checkQuota(handler *webdav.Handler, user *auth.AuthedUser, r *http.Request) error {
+	dir, ok := handler.FileSystem.(WebDavDir)
+	if !ok || !dir.Quota.Enabled() {
+		return nil
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, handler.Prefix)
+
+	var delta quota.Usage
+	switch r.Method {
+	case http.MethodPut:
+		size := r.ContentLength
+		if size < 0 {
+			if expected, err := strconv.ParseInt(r.Header.Get("X-Expected-Entity-Length"), 10, 64); err == nil {
+				size = expected
+			}
+		}
+
+		return dir.CheckWrite(r.Context(), name, size)
+	case "MKCOL":
+		delta.Files = 1
+	case "COPY":
+		usage, err := dir.DiskUsage(r.Context(), name, r.Header.Get("Depth") != "0")
+		if err != nil {
+			// 源不存在等错误交给 webdav.Handler 处理
+			return nil
+		}
+
+		delta = usage
+		if dst, err := url.Parse(r.Header.Get("Destination")); err == nil {
+			if existing, err := dir.DiskUsage(r.Context(), strings.TrimPrefix(dst.Path, handler.Prefix), true); err == nil {
+				delta.Bytes -= existing.Bytes
+				delta.Files -= existing.Files
+			}
+		}
+	default:
+		return nil
+	}
+
+	return dir.Quota.Check(dir.Share, dir.Namespace, user, delta)
+}
@@ -0,0 +1,636 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"golang.org/x/net/webdav"
+)
+
+// maxSearchResults SEARCH 请求最多返回的结果数量，超出时结果被截断，并且返回 507 状态提示客户端
+const maxSearchResults = 1000
+
+var (
+	propDisplayName      = xml.Name{Space: "DAV:", Local: "displayname"}
+	propGetContentLength = xml.Name{Space: "DAV:", Local: "getcontentlength"}
+	propGetLastModified  = xml.Name{Space: "DAV:", Local: "getlastmodified"}
+	propResourceType     = xml.Name{Space: "DAV:", Local: "resourcetype"}
+	propGetContentType   = xml.Name{Space: "DAV:", Local: "getcontenttype"}
+
+	// allProps allprop 时返回的属性
+	allProps = []xml.Name{propDisplayName, propGetContentLength, propGetLastModified, propResourceType, propGetContentType}
+
+	errBadSearch = errors.New("bad search request")
+)
+
+// searchNode 通用的 XML 节点，where 子句可以任意嵌套，因此不使用固定结构解析
+type searchNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr   `xml:",any,attr"`
+	Content string       `xml:",chardata"`
+	Nodes   []searchNode `xml:",any"`
+}
+
+func (n searchNode) child(local string) (searchNode, bool) {
+	for _, c := range n.Nodes {
+		if c.XMLName.Space == "DAV:" && c.XMLName.Local == local {
+			return c, true
+		}
+	}
+
+	return searchNode{}, false
+}
+
+func (n searchNode) attr(local string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// searchEntry 搜索时遍历到的资源
+type searchEntry struct {
+	name string
+	info os.FileInfo
+}
+
+type searchCondition func(entry searchEntry) bool
+
+type searchOrder struct {
+	prop       xml.Name
+	descending bool
+}
+
+// searchQuery 解析后的 RFC 5323 basicsearch 查询
+type searchQuery struct {
+	props   []xml.Name
+	scope   string
+	depth   int
+	where   searchCondition
+	orderBy []searchOrder
+	limit   int
+}
+
+// serveSearch 处理 RFC 5323 DASL SEARCH 请求，支持 basicsearch 语法的子集：
+// displayname、getcontentlength、getlastmodified 上的 like、eq、lt、lte、gt、gte 比较，
+// and、or、not、is-collection 组合以及 orderby、limit，结果按照用户的读权限过滤
+func serveSearch(w http.ResponseWriter, r *http.Request, share *Share, handler *webdav.Handler, user *auth.AuthedUser) {
+	query, err := parseSearchRequest(r, handler)
+	if err != nil {
+		log.WithFields(log.Fields{"path": r.URL.Path}).Debugf("invalid search request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]searchEntry, 0)
+	truncated := false
+	err = walkTree(r, handler.FileSystem, query.scope, query.depth, func(entry searchEntry) error {
+		if !user.HasPrivilege(share.Conf, readPrivilege(entry.info), collectionPath(path.Join(handler.Prefix, entry.name), entry.info.IsDir())) {
+			return nil
+		}
+
+		if query.where != nil && !query.where(entry) {
+			return nil
+		}
+
+		if len(results) >= maxSearchResults {
+			truncated = true
+			return io.EOF
+		}
+
+		results = append(results, entry)
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	sortSearchResults(results, query.orderBy)
+	if query.limit > 0 && len(results) > query.limit {
+		results = results[:query.limit]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?><D:multistatus xmlns:D="DAV:">`)
+	for _, entry := range results {
+		writeSearchResponse(&buf, r, handler, entry, query.props)
+	}
+
+	if truncated {
+		buf.WriteString("<D:response><D:href>")
+		_ = xml.EscapeText(&buf, []byte(searchHref(handler.Prefix, query.scope, true)))
+		buf.WriteString("</D:href><D:status>HTTP/1.1 507 Insufficient Storage</D:status></D:response>")
+	}
+
+	buf.WriteString("</D:multistatus>")
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(webdav.StatusMulti)
+	_, _ = w.Write(buf.Bytes())
+}
+
+func parseSearchRequest(r *http.Request, handler *webdav.Handler) (*searchQuery, error) {
+	var root searchNode
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadSearch, err)
+	}
+
+	if root.XMLName.Space != "DAV:" || root.XMLName.Local != "searchrequest" {
+		return nil, fmt.Errorf("%w: searchrequest expected", errBadSearch)
+	}
+
+	basic, ok := root.child("basicsearch")
+	if !ok {
+		return nil, fmt.Errorf("%w: only basicsearch grammar is supported", errBadSearch)
+	}
+
+	query := &searchQuery{scope: strings.TrimPrefix(r.URL.Path, handler.Prefix), depth: -1}
+
+	if sel, ok := basic.child("select"); ok {
+		if prop, ok := sel.child("prop"); ok {
+			for _, p := range prop.Nodes {
+				query.props = append(query.props, p.XMLName)
+			}
+		}
+	}
+
+	if len(query.props) == 0 {
+		query.props = allProps
+	}
+
+	if from, ok := basic.child("from"); ok {
+		if scope, ok := from.child("scope"); ok {
+			if href, ok := scope.child("href"); ok {
+				u, err := url.Parse(strings.TrimSpace(href.Content))
+				if err != nil {
+					return nil, fmt.Errorf("%w: invalid scope href", errBadSearch)
+				}
+
+				scopePath := u.Path
+				if !path.IsAbs(scopePath) {
+					scopePath = path.Join(r.URL.Path, scopePath)
+				}
+
+				if !strings.HasPrefix(path.Clean(scopePath)+"/", strings.TrimSuffix(handler.Prefix, "/")+"/") {
+					return nil, fmt.Errorf("%w: scope must be inside the share", errBadSearch)
+				}
+
+				query.scope = strings.TrimPrefix(path.Clean(scopePath), handler.Prefix)
+			}
+
+			if depth, ok := scope.child("depth"); ok {
+				switch strings.TrimSpace(depth.Content) {
+				case "0":
+					query.depth = 0
+				case "1":
+					query.depth = 1
+				case "infinity", "":
+					query.depth = -1
+				default:
+					return nil, fmt.Errorf("%w: invalid depth", errBadSearch)
+				}
+			}
+		}
+	}
+
+	if where, ok := basic.child("where"); ok {
+		if len(where.Nodes) != 1 {
+			return nil, fmt.Errorf("%w: where must contain exactly one expression", errBadSearch)
+		}
+
+		cond, err := parseSearchCondition(where.Nodes[0])
+		if err != nil {
+			return nil, err
+		}
+
+		query.where = cond
+	}
+
+	if orderBy, ok := basic.child("orderby"); ok {
+		for _, order := range orderBy.Nodes {
+			prop, ok := order.child("prop")
+			if !ok || len(prop.Nodes) != 1 {
+				return nil, fmt.Errorf("%w: invalid orderby", errBadSearch)
+			}
+
+			_, descending := order.child("descending")
+			query.orderBy = append(query.orderBy, searchOrder{prop: prop.Nodes[0].XMLName, descending: descending})
+		}
+	}
+
+	if limit, ok := basic.child("limit"); ok {
+		if nresults, ok := limit.child("nresults"); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(nresults.Content))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%w: invalid nresults", errBadSearch)
+			}
+
+			query.limit = n
+		}
+	}
+
+	return query, nil
+}
+
+func parseSearchCondition(node searchNode) (searchCondition, error) {
+	if node.XMLName.Space != "DAV:" {
+		return nil, fmt.Errorf("%w: unsupported operator %s", errBadSearch, node.XMLName.Local)
+	}
+
+	switch node.XMLName.Local {
+	case "and", "or":
+		conds := make([]searchCondition, 0, len(node.Nodes))
+		for _, child := range node.Nodes {
+			cond, err := parseSearchCondition(child)
+			if err != nil {
+				return nil, err
+			}
+
+			conds = append(conds, cond)
+		}
+
+		if node.XMLName.Local == "and" {
+			return func(entry searchEntry) bool {
+				for _, cond := range conds {
+					if !cond(entry) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		}
+
+		return func(entry searchEntry) bool {
+			for _, cond := range conds {
+				if cond(entry) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "not":
+		if len(node.Nodes) != 1 {
+			return nil, fmt.Errorf("%w: not must contain exactly one expression", errBadSearch)
+		}
+
+		cond, err := parseSearchCondition(node.Nodes[0])
+		if err != nil {
+			return nil, err
+		}
+
+		return func(entry searchEntry) bool { return !cond(entry) }, nil
+	case "is-collection":
+		return func(entry searchEntry) bool { return entry.info.IsDir() }, nil
+	case "like":
+		prop, literal, err := searchOperands(node)
+		if err != nil {
+			return nil, err
+		}
+
+		if prop != propDisplayName {
+			return nil, fmt.Errorf("%w: like only supports displayname", errBadSearch)
+		}
+
+		pattern, err := likePattern(literal, node.attr("caseless") != "no")
+		if err != nil {
+			return nil, err
+		}
+
+		return func(entry searchEntry) bool { return pattern.MatchString(entry.info.Name()) }, nil
+	case "eq", "lt", "lte", "gt", "gte":
+		prop, literal, err := searchOperands(node)
+		if err != nil {
+			return nil, err
+		}
+
+		compare, err := searchComparator(prop, literal, node.attr("caseless") != "no")
+		if err != nil {
+			return nil, err
+		}
+
+		op := node.XMLName.Local
+		return func(entry searchEntry) bool {
+			c, ok := compare(entry)
+			if !ok {
+				return false
+			}
+
+			switch op {
+			case "eq":
+				return c == 0
+			case "lt":
+				return c < 0
+			case "lte":
+				return c <= 0
+			case "gt":
+				return c > 0
+			default:
+				return c >= 0
+			}
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported operator %s", errBadSearch, node.XMLName.Local)
+}
+
+// searchOperands 返回比较运算的属性以及字面量
+func searchOperands(node searchNode) (xml.Name, string, error) {
+	prop, ok := node.child("prop")
+	if !ok || len(prop.Nodes) != 1 {
+		return xml.Name{}, "", fmt.Errorf("%w: %s requires a prop", errBadSearch, node.XMLName.Local)
+	}
+
+	literal, ok := node.child("literal")
+	if !ok {
+		return xml.Name{}, "", fmt.Errorf("%w: %s requires a literal", errBadSearch, node.XMLName.Local)
+	}
+
+	return prop.Nodes[0].XMLName, literal.Content, nil
+}
+
+// searchComparator 返回资源属性与字面量的比较函数，资源没有该属性时 ok 为 false
+func searchComparator(prop xml.Name, literal string, caseless bool) (func(entry searchEntry) (int, bool), error) {
+	switch prop {
+	case propDisplayName:
+		if caseless {
+			literal = strings.ToLower(literal)
+		}
+
+		return func(entry searchEntry) (int, bool) {
+			name := entry.info.Name()
+			if caseless {
+				name = strings.ToLower(name)
+			}
+			return strings.Compare(name, literal), true
+		}, nil
+	case propGetContentLength:
+		size, err := strconv.ParseInt(strings.TrimSpace(literal), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid getcontentlength literal", errBadSearch)
+		}
+
+		return func(entry searchEntry) (int, bool) {
+			if entry.info.IsDir() {
+				return 0, false
+			}
+			return compareInt64(entry.info.Size(), size), true
+		}, nil
+	case propGetLastModified:
+		modified, err := parseSearchTime(literal)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid getlastmodified literal", errBadSearch)
+		}
+
+		return func(entry searchEntry) (int, bool) {
+			return compareInt64(entry.info.ModTime().Unix(), modified.Unix()), true
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported property %s", errBadSearch, prop.Local)
+}
+
+// parseSearchTime 解析 getlastmodified 字面量，支持 HTTP 日期以及 RFC 3339 格式
+func parseSearchTime(literal string) (time.Time, error) {
+	literal = strings.TrimSpace(literal)
+	if t, err := http.ParseTime(literal); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, literal)
+}
+
+// likePattern 将 like 的模式转换为正则表达式，% 匹配任意多个字符，_ 匹配单个字符，\ 用于转义
+func likePattern(literal string, caseless bool) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	if caseless {
+		expr.WriteString("(?i)")
+	}
+
+	expr.WriteString("^")
+	runes := []rune(literal)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		case '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("%w: invalid like pattern", errBadSearch)
+			}
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
+
+// walkTree 遍历目录中的资源，depth 为 -1 表示不限制深度，范围本身不包含在结果中
+func walkTree(r *http.Request, fs webdav.FileSystem, scope string, depth int, fn func(entry searchEntry) error) error {
+	info, err := fs.Stat(r.Context(), scope)
+	if err != nil {
+		return err
+	}
+
+	if depth == 0 {
+		return fn(searchEntry{name: slashClean(scope), info: info})
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	f, err := fs.OpenFile(r.Context(), scope, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	children, err := f.Readdir(-1)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		name := path.Join(slashClean(scope), child.Name())
+		if err := fn(searchEntry{name: name, info: child}); err != nil {
+			return err
+		}
+
+		if child.IsDir() && depth != 1 {
+			if err := walkTree(r, fs, name, depth, fn); err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func sortSearchResults(results []searchEntry, orderBy []searchOrder) {
+	if len(orderBy) == 0 {
+		return
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, order := range orderBy {
+			a, b := results[i].info, results[j].info
+			if order.descending {
+				a, b = b, a
+			}
+
+			var c int
+			switch order.prop {
+			case propGetContentLength:
+				c = compareInt64(a.Size(), b.Size())
+			case propGetLastModified:
+				c = compareInt64(a.ModTime().UnixNano(), b.ModTime().UnixNano())
+			default:
+				c = strings.Compare(strings.ToLower(a.Name()), strings.ToLower(b.Name()))
+			}
+
+			if c != 0 {
+				return c < 0
+			}
+		}
+
+		return false
+	})
+}
+
+// writeSearchResponse 输出一个资源的 multistatus response，不支持的属性在 404 propstat 中返回
+func writeSearchResponse(buf *bytes.Buffer, r *http.Request, handler *webdav.Handler, entry searchEntry, props []xml.Name) {
+	var found, missing bytes.Buffer
+
+	var deadProps map[xml.Name]webdav.Property
+	for _, prop := range props {
+		var value string
+		ok := true
+		switch prop {
+		case propDisplayName:
+			value = escapeXML(entry.info.Name())
+		case propGetContentLength:
+			ok = !entry.info.IsDir()
+			value = strconv.FormatInt(entry.info.Size(), 10)
+		case propGetLastModified:
+			value = entry.info.ModTime().UTC().Format(http.TimeFormat)
+		case propResourceType:
+			if entry.info.IsDir() {
+				value = "<D:collection/>"
+			}
+		case propGetContentType:
+			ok = !entry.info.IsDir()
+			value = mime.TypeByExtension(path.Ext(entry.name))
+			if value == "" {
+				value = "application/octet-stream"
+			}
+			value = escapeXML(value)
+		default:
+			if deadProps == nil {
+				deadProps = searchDeadProps(r, handler.FileSystem, entry.name)
+			}
+
+			if p, exists := deadProps[prop]; exists {
+				fmt.Fprintf(&found, `<%s xmlns="%s">%s</%s>`, prop.Local, escapeXML(prop.Space), p.InnerXML, prop.Local)
+			} else {
+				fmt.Fprintf(&missing, `<%s xmlns="%s"/>`, prop.Local, escapeXML(prop.Space))
+			}
+			continue
+		}
+
+		if !ok {
+			fmt.Fprintf(&missing, "<D:%s/>", prop.Local)
+			continue
+		}
+
+		fmt.Fprintf(&found, "<D:%s>%s</D:%s>", prop.Local, value, prop.Local)
+	}
+
+	buf.WriteString("<D:response><D:href>")
+	_ = xml.EscapeText(buf, []byte(searchHref(handler.Prefix, entry.name, entry.info.IsDir())))
+	buf.WriteString("</D:href>")
+
+	if found.Len() > 0 {
+		buf.WriteString("<D:propstat><D:prop>")
+		buf.Write(found.Bytes())
+		buf.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+	}
+
+	if missing.Len() > 0 {
+		buf.WriteString("<D:propstat><D:prop>")
+		buf.Write(missing.Bytes())
+		buf.WriteString("</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+	}
+
+	buf.WriteString("</D:response>")
+}
+
+// searchDeadProps 读取资源的 dead property
+func searchDeadProps(r *http.Request, fs webdav.FileSystem, name string) map[xml.Name]webdav.Property {
+	f, err := fs.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return map[xml.Name]webdav.Property{}
+	}
+	defer f.Close()
+
+	holder, ok := f.(webdav.DeadPropsHolder)
+	if !ok {
+		return map[xml.Name]webdav.Property{}
+	}
+
+	props, err := holder.DeadProps()
+	if err != nil || props == nil {
+		return map[xml.Name]webdav.Property{}
+	}
+
+	return props
+}
+
+func searchHref(prefix string, name string, isDir bool) string {
+	href := path.Join(prefix, name)
+	if isDir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+
+	return (&url.URL{Path: href}).EscapedPath()
+}
+
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
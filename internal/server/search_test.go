@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mylxsw/webdav-server/internal/auth"
+)
+
+// TestSearchPrivileges 搜索结果中的文件需要 read 权限，目录需要 list 权限
+func TestSearchPrivileges(t *testing.T) {
+	conf := testConfig(t, `
+shares:
+- name: main
+  scope: /tmp
+  prefix: /
+  access_mode: list
+  rules:
+  - path: ^/releases/
+    effect: deny
+    access_mode: list
+    users: ["*"]
+`)
+
+	share := &Share{Conf: &conf.Shares[0]}
+	handler := testHandler(t, "/")
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<d:searchrequest xmlns:d="DAV:">
+  <d:basicsearch>
+    <d:select><d:prop><d:displayname/></d:prop></d:select>
+    <d:from><d:scope><d:href>/</d:href><d:depth>infinity</d:depth></d:scope></d:from>
+  </d:basicsearch>
+</d:searchrequest>`
+
+	r := httptest.NewRequest("SEARCH", "/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	serveSearch(w, r, share, handler, &auth.AuthedUser{Account: "tester"})
+
+	result := w.Body.String()
+	if !strings.Contains(result, "<D:href>/docs/</D:href>") {
+		t.Errorf("/docs/ should be listed: %s", result)
+	}
+
+	for _, hidden := range []string{"/docs/a.txt", "/releases/"} {
+		if strings.Contains(result, hidden) {
+			t.Errorf("%s should not be listed: %s", hidden, result)
+		}
+	}
+}
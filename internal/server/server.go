@@ -3,17 +3,21 @@ package server
 import (
 	"bytes"
 	"context"
+	"errors"
+	"github.com/mylxsw/webdav-server/internal/auth"
 	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/link"
+	"github.com/mylxsw/webdav-server/internal/quota"
 	"golang.org/x/net/webdav"
+	"io"
 	"net"
 	"net/http"
-	"strconv"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/glacier/infra"
-	"github.com/mylxsw/go-utils/str"
 	"github.com/mylxsw/webdav-server/internal/service"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -26,14 +30,19 @@ type webdavServer struct {
 	authSrv  service.AuthService
 	resolver infra.Resolver
 	log      log.Logger
-	handler  *webdav.Handler
+	shares   *Shares
+	uploads  *uploads
+	links    link.Store
 }
 
-func New(resolver infra.Resolver, logger log.Logger, handler *webdav.Handler, authSrv service.AuthService) Server {
-	server := &webdavServer{log: logger, authSrv: authSrv, resolver: resolver, handler: handler}
+func New(resolver infra.Resolver, logger log.Logger, shares *Shares, authSrv service.AuthService) Server {
+	server := &webdavServer{log: logger, authSrv: authSrv, resolver: resolver, shares: shares}
 
-	resolver.MustResolve(func(conf *config.Config, userGroupRules *config.UserGroupRules) {
-		http.HandleFunc("/", server.buildHandler(conf, userGroupRules))
+	resolver.MustResolve(func(conf *config.Config, linkStore link.Store, reloader *config.Reloader) {
+		server.uploads = newUploads(shares, conf.DataDir)
+		server.links = linkStore
+		reloader.OnReload(shares.Reload)
+		http.HandleFunc("/", server.buildHandler(reloader))
 		http.Handle("/metrics", promhttp.Handler())
 	})
 
@@ -78,8 +87,18 @@ func (server *webdavServer) Start(ctx context.Context, listener net.Listener) {
 	}
 }
 
-func (server *webdavServer) buildHandler(conf *config.Config, userGroupRules *config.UserGroupRules) func(w http.ResponseWriter, r *http.Request) {
+func (server *webdavServer) buildHandler(reloader *config.Reloader) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// 每个请求使用请求开始时生效的配置，配置重新加载不影响正在处理的请求
+		conf := reloader.Config()
+		normalizeRequest(r)
+
+		// 分享链接允许匿名访问
+		if strings.HasPrefix(r.URL.Path, linkPrefix) {
+			links{shares: server.shares, store: server.links, authSrv: server.authSrv}.ServeHTTP(w, r, requestClientIP(conf, r), conf.Verbose)
+			return
+		}
+
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 
 		// Gets the correct user for this request.
@@ -97,28 +116,29 @@ func (server *webdavServer) buildHandler(conf *config.Config, userGroupRules *co
 			return
 		}
 
-		targetResponse := &responseWriterWrap{
-			Headers:    make(http.Header),
-			body:       bytes.NewBuffer([]byte{}),
-			StatusCode: 0,
-		}
+		state := &requestState{user: user}
+		r = r.WithContext(withRequestState(r.Context(), state))
+		r.Body = requestBody{ReadCloser: r.Body, state: state}
 
-		var clientIP string
-		if conf.ClientRealIPHeader != "" {
-			// 如从请求头 X-Forwarded-For 中获取真实 IP，列表中第一个 IP 为真实的客户端 IP 地址
-			clientIP = strings.Split(r.Header.Get(conf.ClientRealIPHeader), ",")[0]
-		}
+		targetResponse := newResponseWriter(w, conf.Verbose)
+		targetResponse.state = state
 
-		if clientIP == "" {
-			clientIP = strings.Split(r.RemoteAddr, ":")[0]
+		clientIP := requestClientIP(conf, r)
+
+		// reservedDir 下的路径为服务端保留的接口，不路由到共享
+		reserved := strings.HasPrefix(r.URL.Path, reservedDir+"/")
+
+		var share *Share
+		if !reserved {
+			share = server.shares.Match(r.URL.Path)
 		}
 
-		readonlyRequest := str.InIgnoreCase(r.Method, []string{"GET", "HEAD", "OPTIONS", "PROPFIND"})
+		var decisions []auth.Decision
 		defer func() {
-			resp := targetResponse.RealWrite(w, conf.Verbose)
 			log.F(log.M{
-				"readonly": readonlyRequest,
-				"remote":   clientIP,
+				"authorization": decisions,
+				"remote":        clientIP,
+				"share":         shareName(share),
 				"user": log.M{
 					"name":    user.Name,
 					"account": user.Account,
@@ -128,18 +148,68 @@ func (server *webdavServer) buildHandler(conf *config.Config, userGroupRules *co
 					"url":    r.RequestURI,
 					"ua":     r.Header.Get("User-Agent"),
 				},
-				"response": resp,
+				"response": targetResponse.Response(),
 			}).Debugf("request")
 		}()
 
-		if !user.HasPrivilege(conf, userGroupRules, readonlyRequest, r.URL.Path) {
-			log.WithFields(log.Fields{"username": username}).Debugf("access denied: %v", err)
+		if reserved {
+			server.serveReserved(targetResponse, r, user)
+			return
+		}
+
+		if share == nil {
+			http.Error(targetResponse, "not found", http.StatusNotFound)
+			return
+		}
+
+		handler, err := share.Handler(user)
+		if err != nil {
+			log.WithFields(log.Fields{"username": username, "share": share.Conf.Name}).Errorf("resolve share failed: %v", err)
+			http.Error(targetResponse, "share not available", http.StatusInternalServerError)
+			return
+		}
+
+		var allowed bool
+		if decisions, allowed = authorizeRequest(r, share.Conf, handler, user); !allowed {
+			denied := decisions[len(decisions)-1]
+			log.WithFields(log.Fields{"username": username, "path": denied.Path, "required": denied.Required, "rule": denied.Rule}).Debugf("access denied")
 			http.Error(targetResponse, "access denied", http.StatusForbidden)
 			return
 		}
 
+		if err := checkQuota(handler, user, r); err != nil {
+			log.WithFields(log.Fields{"username": username, "share": share.Conf.Name}).Debugf("quota check failed: %v", err)
+			if errors.Is(err, quota.ErrQuotaExceeded) {
+				http.Error(targetResponse, "insufficient storage", http.StatusInsufficientStorage)
+			} else {
+				http.Error(targetResponse, "quota check failed", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var handlerResponse http.ResponseWriter = targetResponse
 		if r.Method == "HEAD" {
-			w = newResponseWriterNoBody(targetResponse)
+			handlerResponse = newResponseWriterNoBody(targetResponse)
+		}
+
+		if isArchiveRequest(r) {
+			serveArchive(targetResponse, r, share, handler, user)
+			return
+		}
+
+		if isVersionsRequest(r) {
+			serveVersions(targetResponse, r, handler)
+			return
+		}
+
+		// RFC 5323 DASL
+		if r.Method == "SEARCH" {
+			serveSearch(targetResponse, r, share, handler, user)
+			return
+		}
+
+		if r.Method == "OPTIONS" {
+			targetResponse.Header().Set("DASL", "<DAV:basicsearch>")
 		}
 
 		// Excerpt from RFC4918, section 9.4:
@@ -148,10 +218,16 @@ func (server *webdavServer) buildHandler(conf *config.Config, userGroupRules *co
 		//		"index.html" resource, a human-readable view of the contents of
 		//		the collection, or something else altogether.
 		//
-		// Get, when applied to collection, will return the same as PROPFIND method.
-		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, server.handler.Prefix) {
-			info, err := server.handler.FileSystem.Stat(context.TODO(), strings.TrimPrefix(r.URL.Path, server.handler.Prefix))
+		// Get, when applied to collection, will return a HTML directory listing for browsers,
+		// and the same as PROPFIND method for other clients.
+		if r.Method == "GET" || r.Method == "POST" {
+			info, err := handler.FileSystem.Stat(r.Context(), strings.TrimPrefix(r.URL.Path, handler.Prefix))
 			if err == nil && info.IsDir() {
+				if r.Method == "POST" || acceptsHTML(r) {
+					browser{share: share, handler: handler, user: user}.ServeHTTP(targetResponse, r)
+					return
+				}
+
 				r.Method = "PROPFIND"
 
 				if r.Header.Get("Depth") == "" {
@@ -162,61 +238,178 @@ func (server *webdavServer) buildHandler(conf *config.Config, userGroupRules *co
 
 		// Runs the WebDAV.
 		//u.Handler.LockSystem = webdav.NewMemLS()
-		server.handler.ServeHTTP(targetResponse, r)
+		handler.ServeHTTP(handlerResponse, r)
+
+		if r.Method == "COPY" && (targetResponse.statusCode == http.StatusCreated || targetResponse.statusCode == http.StatusNoContent) {
+			if err := copyCollectionProps(handler, r); err != nil {
+				log.WithFields(log.Fields{"username": username, "share": share.Conf.Name}).Errorf("copy dead properties failed: %v", err)
+			}
+		}
+	}
+}
+
+// serveReserved 处理服务端保留的接口
+func (server *webdavServer) serveReserved(w http.ResponseWriter, r *http.Request, user *auth.AuthedUser) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, uploadsPrefix):
+		server.uploads.ServeHTTP(w, r, user)
+	case r.URL.Path == trashAPIPrefix || strings.HasPrefix(r.URL.Path, trashAPIPrefix+"/"):
+		trashAPI{shares: server.shares}.ServeHTTP(w, r, user)
+	case r.URL.Path == linkAPIPrefix || strings.HasPrefix(r.URL.Path, linkAPIPrefix+"/"):
+		linkAPI{shares: server.shares, store: server.links}.ServeHTTP(w, r, user)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// copyCollectionProps 复制目录的 dead property，文件的 dead property 已经由 webdav.Handler 在 COPY 时复制
+func copyCollectionProps(handler *webdav.Handler, r *http.Request) error {
+	dir, ok := handler.FileSystem.(WebDavDir)
+	if !ok {
+		return nil
+	}
+
+	dst, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		return err
 	}
+
+	return dir.CopyProps(
+		strings.TrimPrefix(r.URL.Path, handler.Prefix),
+		strings.TrimPrefix(dst.Path, handler.Prefix),
+		r.Header.Get("Depth") != "0",
+	)
 }
 
-// responseWriterWrap http.ResponseWriter 实现，用于存储代理请求返回数据，避免直接发送给客户端
-type responseWriterWrap struct {
-	Headers    http.Header
-	body       *bytes.Buffer
-	Body       []byte
-	StatusCode int
+// requestClientIP 返回请求的客户端地址
+func requestClientIP(conf *config.Config, r *http.Request) string {
+	var clientIP string
+	if conf.ClientRealIPHeader != "" {
+		// 如从请求头 X-Forwarded-For 中获取真实 IP，列表中第一个 IP 为真实的客户端 IP 地址
+		clientIP = strings.Split(r.Header.Get(conf.ClientRealIPHeader), ",")[0]
+	}
+
+	if clientIP == "" {
+		clientIP = strings.Split(r.RemoteAddr, ":")[0]
+	}
+
+	return clientIP
+}
+
+// shareName 返回共享名称，用于日志输出
+func shareName(share *Share) string {
+	if share == nil {
+		return ""
+	}
+
+	return share.Conf.Name
+}
+
+// maxBodyExcerpt is the maximum number of response body bytes kept for the audit log in verbose mode
+const maxBodyExcerpt = 4096
+
+// responseWriter http.ResponseWriter 实现，数据直接发送给客户端，同时记录状态码、发送字节数、耗时，
+// verbose 模式下额外保留响应体的前 maxBodyExcerpt 字节用于审计日志
+type responseWriter struct {
+	http.ResponseWriter
+	startTime  time.Time
+	statusCode int
+	written    int64
+	excerpt    *bytes.Buffer
+	state      *requestState
 }
 
 type response struct {
 	StatusCode int    `json:"status_code"`
+	Bytes      int64  `json:"bytes"`
+	Duration   string `json:"duration"`
 	Body       string `json:"body,omitempty"`
 }
 
-func (rw *responseWriterWrap) RealWrite(w http.ResponseWriter, verbose bool) response {
-	body := rw.body.Bytes()
-	for k, v := range rw.Header() {
-		for _, vv := range v {
-			w.Header().Add(k, vv)
-		}
+// newResponseWriter creates a new responseWriter, the body excerpt is only recorded when verbose is true
+func newResponseWriter(w http.ResponseWriter, verbose bool) *responseWriter {
+	rw := &responseWriter{ResponseWriter: w, startTime: time.Now()}
+	if verbose {
+		rw.excerpt = bytes.NewBuffer(nil)
+	}
+
+	return rw
+}
+
+// Response returns the summary of the response for audit log
+func (rw *responseWriter) Response() response {
+	resp := response{
+		StatusCode: rw.statusCode,
+		Bytes:      rw.written,
+		Duration:   time.Since(rw.startTime).String(),
 	}
 
-	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
-	if rw.StatusCode > 0 {
-		w.WriteHeader(rw.StatusCode)
+	if rw.excerpt != nil {
+		resp.Body = rw.excerpt.String()
 	}
 
-	_, _ = w.Write(body)
+	return resp
+}
 
-	if verbose {
-		return response{
-			StatusCode: rw.StatusCode,
-			Body:       string(body),
+// WriteHeader 实现 http.ResponseWriter 接口，文件系统操作因为超出配额失败时，
+// webdav.Handler 返回的错误状态码改写为 507 Insufficient Storage
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.state != nil && rw.state.quotaExceeded && statusCode >= 400 {
+		statusCode = http.StatusInsufficientStorage
+	}
+
+	if rw.statusCode == 0 {
+		rw.statusCode = statusCode
+	}
+
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write 实现 http.ResponseWriter 接口
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+
+	n, err := rw.ResponseWriter.Write(data)
+	rw.written += int64(n)
+
+	if rw.excerpt != nil && rw.excerpt.Len() < maxBodyExcerpt {
+		remain := maxBodyExcerpt - rw.excerpt.Len()
+		if remain > n {
+			remain = n
 		}
+		rw.excerpt.Write(data[:remain])
 	}
 
-	return response{StatusCode: rw.StatusCode}
+	return n, err
 }
 
-// Header 实现 http.ResponseWriter 接口
-func (rw *responseWriterWrap) Header() http.Header {
-	return rw.Headers
+// ReadFrom 实现 io.ReaderFrom 接口，非 verbose 模式下允许底层连接使用 sendfile 等优化
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := rw.ResponseWriter.(io.ReaderFrom); ok && rw.excerpt == nil {
+		if rw.statusCode == 0 {
+			rw.statusCode = http.StatusOK
+		}
+
+		n, err := rf.ReadFrom(src)
+		rw.written += n
+		return n, err
+	}
+
+	return io.Copy(writerOnly{rw}, src)
 }
 
-// Write 实现 http.ResponseWriter 接口
-func (rw *responseWriterWrap) Write(bytes []byte) (int, error) {
-	return rw.body.Write(bytes)
+// Flush 实现 http.Flusher 接口
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
 
-// WriteHeader 实现 http.ResponseWriter 接口
-func (rw *responseWriterWrap) WriteHeader(statusCode int) {
-	rw.StatusCode = statusCode
+// writerOnly hides the ReadFrom method of the underlying writer to avoid infinite recursion in io.Copy
+type writerOnly struct {
+	io.Writer
 }
 
 // responseWriterNoBody is a wrapper used to suppress the body of the response
@@ -236,8 +429,8 @@ func (w responseWriterNoBody) Header() http.Header {
 }
 
 // Write suppress the body.
-func (w responseWriterNoBody) Write([]byte) (int, error) {
-	return 0, nil
+func (w responseWriterNoBody) Write(data []byte) (int, error) {
+	return len(data), nil
 }
 
 // WriteHeader writes the header to the http.ResponseWriter.
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/lock"
+	"github.com/mylxsw/webdav-server/internal/props"
+	"github.com/mylxsw/webdav-server/internal/quota"
+	"github.com/mylxsw/webdav-server/internal/trash"
+	"github.com/mylxsw/webdav-server/internal/version"
+	"golang.org/x/net/webdav"
+)
+
+// Share 一个通过独立 URL 前缀提供服务的 WebDAV 共享
+type Share struct {
+	Conf *config.Share
+
+	lockManager lock.Manager
+	propsStore  props.Store
+	quota       quota.Manager
+	lock        sync.Mutex
+	handlers    map[string]*webdav.Handler
+}
+
+// NewShare 创建一个共享
+func NewShare(conf *config.Share, lockManager lock.Manager, propsStore props.Store, quotaManager quota.Manager) *Share {
+	return &Share{
+		Conf:        conf,
+		lockManager: lockManager,
+		propsStore:  propsStore,
+		quota:       quotaManager,
+		handlers:    make(map[string]*webdav.Handler),
+	}
+}
+
+// Handler 返回用户访问当前共享时使用的 webdav.Handler
+//
+// 共享目录为模板时，按照用户解析出实际的目录，每个目录拥有独立的 Handler，
+// 目录不存在且开启了 auto_create 时，首次访问自动创建
+func (share *Share) Handler(user *auth.AuthedUser) (*webdav.Handler, error) {
+	scope := share.Conf.Scope
+	if share.Conf.IsTemplate() {
+		resolved, err := share.Conf.ResolveScope(user.ScopeVars())
+		if err != nil {
+			return nil, err
+		}
+
+		scope = resolved
+	}
+
+	share.lock.Lock()
+	defer share.lock.Unlock()
+
+	if handler, ok := share.handlers[scope]; ok {
+		return handler, nil
+	}
+
+	if share.Conf.AutoCreate {
+		if _, err := os.Stat(scope); os.IsNotExist(err) {
+			if err := os.MkdirAll(scope, share.Conf.DirFileMode()); err != nil {
+				return nil, fmt.Errorf("create scope %s failed: %w", scope, err)
+			}
+
+			log.WithFields(log.Fields{"share": share.Conf.Name, "scope": scope, "account": user.Account}).Info("share scope created")
+		}
+	}
+
+	if share.Conf.IsTemplate() {
+		go share.cleanTempFiles(scope)
+	}
+
+	namespace := share.Conf.Name + ":" + scope
+	if err := share.quota.Init(namespace, scope); err != nil {
+		return nil, fmt.Errorf("init quota usage for %s failed: %w", scope, err)
+	}
+
+	handler := &webdav.Handler{
+		Prefix: share.Conf.Prefix,
+		FileSystem: WebDavDir{
+			Dir:       webdav.Dir(scope),
+			NoSniff:   share.Conf.NoSniff,
+			Namespace: namespace,
+			Share:     share.Conf,
+			Props:     share.propsStore,
+			Quota:     share.quota,
+			Trash:     share.trash(scope),
+			Versions:  share.versions(scope),
+		},
+		LockSystem: share.lockManager.LockSystem(namespace),
+	}
+
+	share.handlers[scope] = handler
+	return handler, nil
+}
+
+// staleTempFileAge 超过该时间未修改的临时文件视为上传中断后遗留的文件，
+// 不直接删除所有临时文件，避免多个实例共享存储时删除其它实例正在写入的文件
+const staleTempFileAge = time.Hour
+
+// cleanTempFiles 清理共享目录中遗留的临时文件
+func (share *Share) cleanTempFiles(scope string) {
+	removed, err := cleanTempFiles(scope, staleTempFileAge)
+	if err != nil {
+		log.WithFields(log.Fields{"share": share.Conf.Name, "scope": scope}).Errorf("clean temp files failed: %v", err)
+		return
+	}
+
+	if removed > 0 {
+		log.WithFields(log.Fields{"share": share.Conf.Name, "scope": scope, "removed": removed}).Info("stale temp files removed")
+	}
+}
+
+func (share *Share) trash(scope string) *trash.Trash {
+	if !share.Conf.Trash.Enabled {
+		return nil
+	}
+
+	return trash.New(scope)
+}
+
+func (share *Share) versions(scope string) *version.Store {
+	if !share.Conf.Versions.Enabled {
+		return nil
+	}
+
+	return version.New(scope, share.Conf.Versions.MaxVersions, share.Conf.Versions.MaxAgeDuration())
+}
+
+// scopes 返回共享所有的目录，共享目录为模板时，返回所有用户已经创建的目录
+func (share *Share) scopes() []string {
+	if !share.Conf.IsTemplate() {
+		return []string{share.Conf.Scope}
+	}
+
+	matches, err := filepath.Glob(share.Conf.ScopeGlob())
+	if err != nil {
+		return nil
+	}
+
+	return matches
+}
+
+// expireVersions 删除超过保留时间的历史版本
+func (share *Share) expireVersions() {
+	if !share.Conf.Versions.Enabled {
+		return
+	}
+
+	for _, scope := range share.scopes() {
+		removed, err := share.versions(scope).Expire()
+		if err != nil {
+			log.WithFields(log.Fields{"share": share.Conf.Name, "scope": scope}).Errorf("expire versions failed: %v", err)
+			continue
+		}
+
+		if removed > 0 {
+			log.WithFields(log.Fields{"share": share.Conf.Name, "scope": scope, "removed": removed}).Info("expired versions removed")
+		}
+	}
+}
+
+// NewTrashDir 创建用于操作共享目录 scope 中回收站的 WebDavDir，恢复或者永久删除文件时同时更新 dead property 以及配额用量
+func NewTrashDir(conf *config.Share, scope string, propsStore props.Store, quotaManager quota.Manager) WebDavDir {
+	return WebDavDir{
+		Dir:       webdav.Dir(scope),
+		Namespace: conf.Name + ":" + scope,
+		Share:     conf,
+		Props:     propsStore,
+		Quota:     quotaManager,
+		Trash:     trash.New(scope),
+	}
+}
+
+// purgeTrash 永久删除回收站中超过保留时间的文件
+func (share *Share) purgeTrash() {
+	retention := share.Conf.Trash.RetentionDuration()
+	if !share.Conf.Trash.Enabled || retention <= 0 {
+		return
+	}
+
+	for _, scope := range share.scopes() {
+		dir := NewTrashDir(share.Conf, scope, share.propsStore, share.quota)
+
+		items, err := dir.Trash.Expired(retention)
+		if err != nil {
+			log.WithFields(log.Fields{"share": share.Conf.Name, "scope": scope}).Errorf("list expired trash failed: %v", err)
+			continue
+		}
+
+		for _, item := range items {
+			if err := dir.PurgeTrash(item); err != nil {
+				log.WithFields(log.Fields{"share": share.Conf.Name, "scope": scope, "id": item.ID}).Errorf("purge trash failed: %v", err)
+				continue
+			}
+
+			log.WithFields(log.Fields{"share": share.Conf.Name, "scope": scope, "path": item.Path, "account": item.Account}).Info("expired trash purged")
+		}
+	}
+}
+
+// Shares 所有的共享，按照前缀长度倒序排列，保证最长前缀优先匹配
+type Shares struct {
+	lockManager lock.Manager
+	propsStore  props.Store
+	quota       quota.Manager
+
+	lock   sync.RWMutex
+	shares []*Share
+}
+
+// NewShares 根据配置创建所有的共享
+func NewShares(conf *config.Config, lockManager lock.Manager, propsStore props.Store, quotaManager quota.Manager) *Shares {
+	shares := &Shares{lockManager: lockManager, propsStore: propsStore, quota: quotaManager}
+	shares.shares = shares.build(conf)
+
+	for _, share := range shares.shares {
+		// 模板目录在首次解析时清理
+		if !share.Conf.IsTemplate() {
+			go share.cleanTempFiles(share.Conf.Scope)
+		}
+	}
+
+	return shares
+}
+
+func (shares *Shares) build(conf *config.Config) []*Share {
+	items := make([]*Share, 0, len(conf.Shares))
+	for i := range conf.Shares {
+		items = append(items, NewShare(&conf.Shares[i], shares.lockManager, shares.propsStore, shares.quota))
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return len(items[i].Conf.Prefix) > len(items[j].Conf.Prefix)
+	})
+
+	return items
+}
+
+// Reload 使用新的配置替换所有的共享
+//
+// 正在处理的请求继续使用原来的共享完成，新的请求使用新的共享；锁按照共享名称以及目录保存在锁管理器中，
+// 重新加载后对同一目录的锁仍然有效
+func (shares *Shares) Reload(conf *config.Config) {
+	items := shares.build(conf)
+
+	shares.lock.Lock()
+	defer shares.lock.Unlock()
+
+	shares.shares = items
+}
+
+// all 返回当前所有的共享
+func (shares *Shares) all() []*Share {
+	shares.lock.RLock()
+	defer shares.lock.RUnlock()
+
+	return shares.shares
+}
+
+// Get 根据名称查找共享，name 为空并且只有一个共享时返回该共享
+func (shares *Shares) Get(name string) *Share {
+	items := shares.all()
+	if name == "" && len(items) == 1 {
+		return items[0]
+	}
+
+	for _, share := range items {
+		if share.Conf.Name == name {
+			return share
+		}
+	}
+
+	return nil
+}
+
+// cleanupInterval 清理回收站以及历史版本中过期文件的时间间隔
+const cleanupInterval = time.Hour
+
+// Cleanup 定期清理所有共享回收站以及历史版本中的过期文件，直到 ctx 结束
+func (shares *Shares) Cleanup(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, share := range shares.all() {
+			share.purgeTrash()
+			share.expireVersions()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Match 查找请求路径所属的共享，没有匹配的共享时返回 nil
+func (shares *Shares) Match(requestPath string) *Share {
+	for _, share := range shares.all() {
+		if share.Conf.Contains(requestPath) {
+			return share
+		}
+	}
+
+	return nil
+}
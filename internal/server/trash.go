@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/trash"
+)
+
+// trashAPIPrefix 回收站接口的路径
+//
+//	GET    /.webdav/api/trash?share=name              列出当前用户回收站中的文件
+//	POST   /.webdav/api/trash/<id>/restore?share=name 恢复文件到原来的位置
+//	DELETE /.webdav/api/trash/<id>?share=name         永久删除文件
+//	DELETE /.webdav/api/trash?share=name              清空当前用户的回收站
+//
+// 只有一个共享时可以省略 share 参数，用户只能操作自己删除的文件
+const trashAPIPrefix = "/.webdav/api/trash"
+
+// trashEntry 回收站接口返回的文件信息
+type trashEntry struct {
+	trash.Item
+	// URL 文件恢复后的请求路径
+	URL string `json:"url"`
+}
+
+type trashAPI struct {
+	shares *Shares
+}
+
+func (api trashAPI) ServeHTTP(w http.ResponseWriter, r *http.Request, user *auth.AuthedUser) {
+	share := api.shares.Get(r.URL.Query().Get("share"))
+	if share == nil || !share.Conf.Trash.Enabled {
+		http.Error(w, "trash not available", http.StatusNotFound)
+		return
+	}
+
+	handler, err := share.Handler(user)
+	if err != nil {
+		http.Error(w, "share not available", http.StatusInternalServerError)
+		return
+	}
+
+	dir, ok := handler.FileSystem.(WebDavDir)
+	if !ok || dir.Trash == nil {
+		http.Error(w, "trash not available", http.StatusNotFound)
+		return
+	}
+
+	segs := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, trashAPIPrefix), "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && segs[0] == "":
+		items, err := dir.Trash.List(user.Account)
+		if err != nil {
+			http.Error(w, "list trash failed", http.StatusInternalServerError)
+			return
+		}
+
+		entries := make([]trashEntry, 0, len(items))
+		for _, item := range items {
+			entries = append(entries, trashEntry{Item: item, URL: path.Join(share.Conf.Prefix, item.Path)})
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(entries)
+	case r.Method == http.MethodDelete && segs[0] == "":
+		items, err := dir.Trash.List(user.Account)
+		if err != nil {
+			http.Error(w, "list trash failed", http.StatusInternalServerError)
+			return
+		}
+
+		for _, item := range items {
+			if err := dir.PurgeTrash(item); err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && len(segs) == 1:
+		item, err := dir.Trash.Get(user.Account, segs[0])
+		if err == nil {
+			err = dir.PurgeTrash(item)
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), trashErrorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && len(segs) == 2 && segs[1] == "restore":
+		item, err := dir.Trash.Get(user.Account, segs[0])
+		if err == nil {
+			err = api.restore(r, user, share, dir, item)
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{"account": user.Account, "share": share.Conf.Name, "id": segs[0]}).Debugf("restore trash failed: %v", err)
+			http.Error(w, err.Error(), trashErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(trashEntry{Item: item, URL: path.Join(share.Conf.Prefix, item.Path)})
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// restore 恢复文件，用户需要对原来的位置拥有 create 权限
+func (api trashAPI) restore(r *http.Request, user *auth.AuthedUser, share *Share, dir WebDavDir, item trash.Item) error {
+	if !user.HasPrivilege(share.Conf, config.PrivilegeCreate, collectionPath(path.Join(share.Conf.Prefix, item.Path), item.IsDir)) {
+		return errForbidden
+	}
+
+	handler, err := share.Handler(user)
+	if err != nil {
+		return err
+	}
+
+	return withLock(handler.LockSystem, item.Path, func() error {
+		return dir.RestoreTrash(r.Context(), item)
+	})
+}
+
+// trashErrorStatus 根据错误类型返回回收站接口的响应状态码
+func trashErrorStatus(err error) int {
+	if errors.Is(err, trash.ErrNotFound) {
+		return http.StatusNotFound
+	}
+
+	return errorStatus(err)
+}
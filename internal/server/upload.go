@@ -0,0 +1,471 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// uploadsPrefix 断点续传上传接口的路径，该路径保留给服务端使用，不会被路由到任何共享
+	uploadsPrefix = "/.webdav/uploads/"
+	// tusVersion 支持的 tus 协议版本，参考 https://tus.io/protocols/resumable-upload
+	tusVersion = "1.0.0"
+	// uploadExpiration 未完成的上传在最后一次写入之后保留的时间
+	uploadExpiration = 24 * time.Hour
+)
+
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadBusy     = errors.New("upload is in progress")
+	errOffsetMismatch = errors.New("upload offset mismatch")
+)
+
+// upload 一次断点续传上传的元信息，上传的内容暂存在 data_dir 中，完成后再写入共享目录
+type upload struct {
+	ID        string            `json:"id"`
+	Account   string            `json:"account"`
+	Path      string            `json:"path"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// uploads 实现 tus 协议（core、creation、termination、expiration 扩展）的断点续传上传
+//
+// 客户端通过 POST 创建上传，Upload-Metadata 中的 path 为上传完成后文件的请求路径，例如 /home/a.zip，
+// 之后通过 PATCH 追加内容，上传中断后可以通过 HEAD 获取已上传的位置继续上传。
+// 所有内容上传完成后，文件被原子的写入目标位置，写入前会再次检查写权限以及配额
+type uploads struct {
+	shares *Shares
+	dir    string
+
+	lock sync.Mutex
+	busy map[string]bool
+}
+
+func newUploads(shares *Shares, dataDir string) *uploads {
+	return &uploads{shares: shares, dir: filepath.Join(dataDir, "uploads"), busy: make(map[string]bool)}
+}
+
+// ServeHTTP 处理 uploadsPrefix 下的请求
+func (u *uploads) ServeHTTP(w http.ResponseWriter, r *http.Request, user *auth.AuthedUser) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination,expiration")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, uploadsPrefix)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		u.create(w, r, user)
+		return
+	}
+
+	info, err := u.load(id)
+	if err != nil || info.Account != user.Account {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		offset, err := u.offset(info.ID)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+		w.Header().Set("Upload-Expires", info.ExpiresAt.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		u.patch(w, r, user, info)
+	case http.MethodDelete:
+		if err := u.acquire(info.ID, func() error { return u.remove(info.ID) }); err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (u *uploads) create(w http.ResponseWriter, r *http.Request, user *auth.AuthedUser) {
+	u.purgeExpired()
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	target := metadata["path"]
+	if target == "" || !strings.HasPrefix(target, "/") || strings.HasSuffix(target, "/") {
+		http.Error(w, "invalid upload path", http.StatusBadRequest)
+		return
+	}
+
+	target = path.Clean(target)
+	if _, err := u.authorize(r, user, target, length); err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, "create upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	info := upload{
+		ID:        id,
+		Account:   user.Account,
+		Path:      target,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(uploadExpiration),
+	}
+
+	if err := u.save(info, true); err != nil {
+		log.WithFields(log.Fields{"account": user.Account, "path": target}).Errorf("create upload failed: %v", err)
+		http.Error(w, "create upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	if length == 0 {
+		if err := u.acquire(id, func() error { return u.assemble(r, user, info) }); err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+	}
+
+	w.Header().Set("Location", uploadsPrefix+id)
+	w.Header().Set("Upload-Expires", info.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (u *uploads) patch(w http.ResponseWriter, r *http.Request, user *auth.AuthedUser, info upload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	var offset int64
+	err = u.acquire(info.ID, func() error {
+		// 每次追加内容都检查写权限，避免权限被收回后继续上传
+		if _, err := u.authorize(r, user, info.Path, info.Length); err != nil {
+			return err
+		}
+
+		if offset, err = u.offset(info.ID); err != nil {
+			return err
+		}
+
+		if offset != clientOffset {
+			return errOffsetMismatch
+		}
+
+		f, err := os.OpenFile(u.dataPath(info.ID), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+
+		n, copyErr := io.Copy(f, io.LimitReader(r.Body, info.Length-offset))
+		offset += n
+		if err := f.Sync(); copyErr == nil {
+			copyErr = err
+		}
+		if err := f.Close(); copyErr == nil {
+			copyErr = err
+		}
+
+		if copyErr != nil {
+			return copyErr
+		}
+
+		info.ExpiresAt = time.Now().Add(uploadExpiration)
+		if err := u.save(info, false); err != nil {
+			return err
+		}
+
+		if offset < info.Length {
+			return nil
+		}
+
+		return u.assemble(r, user, info)
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{"account": user.Account, "path": info.Path, "id": info.ID}).Debugf("upload failed: %v", err)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", info.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorize 检查用户对上传目标拥有写权限，并且写入 length 字节不会超出配额，返回上传目标所属共享的 webdav.Handler
+func (u *uploads) authorize(r *http.Request, user *auth.AuthedUser, target string, length int64) (*webdav.Handler, error) {
+	share := u.shares.Match(target)
+	if share == nil {
+		return nil, os.ErrNotExist
+	}
+
+	handler, err := share.Handler(user)
+	if err != nil {
+		return nil, err
+	}
+
+	// 不允许上传到 .webdav 等保留的路径
+	if isReserved(strings.TrimPrefix(target, handler.Prefix)) {
+		return nil, errForbidden
+	}
+
+	info, exists := statRequestPath(r, handler, target)
+	if !user.HasPrivilege(share.Conf, writePrivilege(info, exists), collectionPath(target, exists && info.IsDir())) {
+		return nil, errForbidden
+	}
+
+	dir, ok := handler.FileSystem.(WebDavDir)
+	if !ok {
+		return nil, errUnsupportedAction
+	}
+
+	return handler, dir.CheckWrite(r.Context(), strings.TrimPrefix(target, handler.Prefix), length)
+}
+
+// assemble 将上传完成的内容原子的写入目标位置，写入成功后删除暂存的内容
+func (u *uploads) assemble(r *http.Request, user *auth.AuthedUser, info upload) error {
+	// 配置可能在上传过程中重新加载，使用检查权限时找到的共享完成写入
+	handler, err := u.authorize(r, user, info.Path, info.Length)
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimPrefix(info.Path, handler.Prefix)
+	if err := withLock(handler.LockSystem, name, func() error {
+		src, err := os.Open(u.dataPath(info.ID))
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		return handler.FileSystem.(WebDavDir).Replace(r.Context(), name, src)
+	}); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"account": user.Account, "path": info.Path, "bytes": info.Length}).Debug("upload completed")
+	return u.remove(info.ID)
+}
+
+// acquire 保证同一个上传同时只有一个请求在处理
+func (u *uploads) acquire(id string, cb func() error) error {
+	u.lock.Lock()
+	if u.busy[id] {
+		u.lock.Unlock()
+		return errUploadBusy
+	}
+	u.busy[id] = true
+	u.lock.Unlock()
+
+	defer func() {
+		u.lock.Lock()
+		delete(u.busy, id)
+		u.lock.Unlock()
+	}()
+
+	return cb()
+}
+
+func (u *uploads) infoPath(id string) string { return filepath.Join(u.dir, id+".json") }
+func (u *uploads) dataPath(id string) string { return filepath.Join(u.dir, id+".bin") }
+
+func (u *uploads) load(id string) (upload, error) {
+	var info upload
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return info, errUploadNotFound
+	}
+
+	data, err := os.ReadFile(u.infoPath(id))
+	if err != nil {
+		return info, errUploadNotFound
+	}
+
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, err
+	}
+
+	if time.Now().After(info.ExpiresAt) {
+		return info, errUploadNotFound
+	}
+
+	return info, nil
+}
+
+func (u *uploads) save(info upload, create bool) error {
+	if err := os.MkdirAll(u.dir, 0700); err != nil {
+		return err
+	}
+
+	if create {
+		f, err := os.OpenFile(u.dataPath(info.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_ = f.Close()
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tmp := u.infoPath(info.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, u.infoPath(info.ID))
+}
+
+// offset 已上传的字节数，以暂存文件的大小为准，服务异常退出后也能从正确的位置继续上传
+func (u *uploads) offset(id string) (int64, error) {
+	stat, err := os.Stat(u.dataPath(id))
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Size(), nil
+}
+
+func (u *uploads) remove(id string) error {
+	if err := os.Remove(u.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(u.infoPath(id))
+}
+
+// purgeExpired 删除已经过期的上传
+func (u *uploads) purgeExpired() {
+	matches, _ := filepath.Glob(filepath.Join(u.dir, "*.json"))
+	for _, match := range matches {
+		id := strings.TrimSuffix(filepath.Base(match), ".json")
+
+		data, err := os.ReadFile(match)
+		if err != nil {
+			continue
+		}
+
+		var info upload
+		if err := json.Unmarshal(data, &info); err != nil || time.Now().Before(info.ExpiresAt) {
+			continue
+		}
+
+		if err := u.acquire(id, func() error { return u.remove(id) }); err != nil {
+			log.WithFields(log.Fields{"id": id}).Warningf("remove expired upload failed: %v", err)
+		}
+	}
+}
+
+// parseUploadMetadata 解析 Upload-Metadata 请求头，格式为逗号分隔的 key base64(value)
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		segs := strings.SplitN(pair, " ", 2)
+		if len(segs) == 1 {
+			metadata[segs[0]] = ""
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(segs[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		metadata[segs[0]] = string(value)
+	}
+
+	return metadata, nil
+}
+
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// uploadErrorStatus 根据错误类型返回上传接口的响应状态码
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUploadBusy), errors.Is(err, errOffsetMismatch):
+		return http.StatusConflict
+	case errors.Is(err, errUploadNotFound):
+		return http.StatusNotFound
+	case os.IsNotExist(err):
+		// 目标目录不存在
+		return http.StatusConflict
+	}
+
+	return errorStatus(err)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/version"
+	"golang.org/x/net/webdav"
+)
+
+// isVersionsRequest 判断是否为文件历史版本请求
+func isVersionsRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return false
+	}
+
+	query := r.URL.Query()
+	return query.Has("versions") || query.Has("version")
+}
+
+// serveVersions 处理文件历史版本请求，读写权限已经由调用方检查
+//
+//	GET  /path/file?versions       列出文件的历史版本
+//	GET  /path/file?version=<id>   下载指定的历史版本
+//	POST /path/file?version=<id>   将文件恢复为指定的历史版本，当前内容保存为新的历史版本
+func serveVersions(w http.ResponseWriter, r *http.Request, handler *webdav.Handler) {
+	dir, ok := handler.FileSystem.(WebDavDir)
+	if !ok || dir.Versions == nil {
+		http.Error(w, "versions not enabled", http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, handler.Prefix)
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && query.Has("versions"):
+		versions, err := dir.Versions.List(name)
+		if err != nil {
+			http.Error(w, "list versions failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(versions)
+	case r.Method == http.MethodGet:
+		f, v, err := dir.Versions.Open(name, query.Get("version"))
+		if err != nil {
+			http.Error(w, err.Error(), versionErrorStatus(err))
+			return
+		}
+		defer f.Close()
+
+		http.ServeContent(w, r, path.Base(name), v.ModTime, f)
+	case r.Method == http.MethodPost && query.Get("version") != "":
+		err := withLock(handler.LockSystem, name, func() error {
+			f, v, err := dir.Versions.Open(name, query.Get("version"))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if err := dir.CheckWrite(r.Context(), name, v.Size); err != nil {
+				return err
+			}
+
+			return dir.Replace(r.Context(), name, f)
+		})
+
+		if err != nil {
+			log.WithFields(log.Fields{"path": r.URL.Path, "version": query.Get("version")}).Debugf("restore version failed: %v", err)
+			http.Error(w, err.Error(), versionErrorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+// versionErrorStatus 根据错误类型返回历史版本请求的响应状态码
+func versionErrorStatus(err error) int {
+	if errors.Is(err, version.ErrNotFound) {
+		return http.StatusNotFound
+	}
+
+	return errorStatus(err)
+}
@@ -2,10 +2,24 @@ package server
 
 import (
 	"context"
+	"encoding/xml"
+	"io"
 	"mime"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/webdav-server/internal/auth"
+	"github.com/mylxsw/webdav-server/internal/config"
+	"github.com/mylxsw/webdav-server/internal/props"
+	"github.com/mylxsw/webdav-server/internal/quota"
+	"github.com/mylxsw/webdav-server/internal/trash"
+	"github.com/mylxsw/webdav-server/internal/version"
 	"golang.org/x/net/webdav"
 )
 
@@ -24,12 +38,31 @@ func (w NoSniffFileInfo) ContentType(ctx context.Context) (contentType string, e
 	}
 }
 
+var (
+	quotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedBytes      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// WebDavDir webdav.Dir 的包装，提供 NoSniff、dead property 持久化以及存储配额支持
 type WebDavDir struct {
 	webdav.Dir
 	NoSniff bool
+	// Namespace 共享目录的唯一标识，用于区分不同共享目录的 dead property 以及配额用量
+	Namespace string
+	Share     *config.Share
+	Props     props.Store
+	Quota     quota.Manager
+	// Trash 回收站，为 nil 时删除的文件不可恢复
+	Trash *trash.Trash
+	// Versions 历史版本，为 nil 时覆盖文件不保留历史版本
+	Versions *version.Store
 }
 
 func (d WebDavDir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if isReserved(name) {
+		return nil, os.ErrNotExist
+	}
+
 	// Skip wrapping if NoSniff is off
 	if !d.NoSniff {
 		return d.Dir.Stat(ctx, name)
@@ -44,40 +77,696 @@ func (d WebDavDir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 }
 
 func (d WebDavDir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
-	// Skip wrapping if NoSniff is off
-	if !d.NoSniff {
-		return d.Dir.OpenFile(ctx, name, flag, perm)
+	if isReserved(name) {
+		return nil, os.ErrNotExist
+	}
+
+	state := requestStateFrom(ctx)
+	trackQuota := d.Quota.Enabled() && flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	var oldSize int64
+	var created bool
+	if trackQuota {
+		info, err := d.Dir.Stat(ctx, name)
+		if err == nil {
+			oldSize = info.Size()
+		} else if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+			created = true
+			if err := d.Quota.Check(d.Share, d.Namespace, state.user, quota.Usage{Files: 1}); err != nil {
+				state.quotaExceeded = true
+				return nil, err
+			}
+		}
+	}
+
+	var file webdav.File
+	var err error
+	if d.Share != nil && d.Share.AtomicPut && flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		file, err = d.createAtomic(name, state)
+	} else {
+		if d.Versions != nil && flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			if err := d.archive(name); err != nil {
+				return nil, err
+			}
+		}
+
+		file, err = d.Dir.OpenFile(ctx, name, flag, perm)
+	}
+
+	if err != nil {
+		// PROPPATCH opens the resource with O_RDWR, which always fails for directories
+		if flag&(os.O_WRONLY|os.O_RDWR) == 0 || flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+			return nil, err
+		}
+
+		if info, statErr := d.Dir.Stat(ctx, name); statErr != nil || !info.IsDir() {
+			return nil, err
+		}
+
+		if file, err = d.Dir.OpenFile(ctx, name, os.O_RDONLY, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	davFile := WebDavFile{File: file, dir: d, name: slashClean(name), state: state, filter: hasRequestState(ctx)}
+	if !trackQuota {
+		return davFile, nil
+	}
+
+	available, _, limited, err := d.Quota.Available(d.Share, d.Namespace, state.user)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &quotaFile{
+		WebDavFile: davFile,
+		oldSize:    oldSize,
+		created:    created,
+		truncated:  flag&os.O_TRUNC != 0,
+		limited:    limited,
+		maxSize:    available + oldSize,
+	}, nil
+}
+
+func (d WebDavDir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isReserved(name) {
+		return os.ErrPermission
+	}
+
+	if !d.Quota.Enabled() {
+		return d.Dir.Mkdir(ctx, name, perm)
+	}
+
+	state := requestStateFrom(ctx)
+	if err := d.Quota.Check(d.Share, d.Namespace, state.user, quota.Usage{Files: 1}); err != nil {
+		state.quotaExceeded = true
+		return err
+	}
+
+	if err := d.Dir.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+
+	return d.Quota.Written(d.Namespace, slashClean(name), state.user, 0, 0, true)
+}
+
+// RemoveAll 删除文件或者目录，开启回收站时，文件移动到当前用户的回收站中
+func (d WebDavDir) RemoveAll(ctx context.Context, name string) error {
+	if isReserved(name) {
+		return os.ErrPermission
+	}
+
+	var removed quota.Usage
+	if d.Quota.Enabled() {
+		usage, err := d.DiskUsage(ctx, name, true)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		removed = usage
+	}
+
+	if d.Trash != nil && slashClean(name) != "/" {
+		if _, err := d.Dir.Stat(ctx, name); os.IsNotExist(err) {
+			return nil
+		}
+
+		state := requestStateFrom(ctx)
+		item, err := d.Trash.Move(name, state.user.Account)
+		if err == nil {
+			// 回收站中的文件在永久删除前仍然计入用量，由删除文件的用户负担
+			if err := d.Quota.Moved(d.Namespace, slashClean(name), item.DataPath()); err != nil {
+				return err
+			}
+
+			if d.Quota.Enabled() {
+				if err := d.chargeTree(ctx, item.DataPath(), state.user); err != nil {
+					return err
+				}
+			}
+
+			return d.Props.Move(d.Namespace, slashClean(name), item.DataPath())
+		}
+
+		// 回收站与文件不在同一个文件系统中时无法移动，直接删除
+		log.WithFields(log.Fields{"namespace": d.Namespace, "name": name}).Warningf("move to trash failed, remove permanently: %v", err)
+	}
+
+	if err := d.Dir.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+
+	// 文件移动到回收站时保留历史版本，恢复后可以继续使用，永久删除时历史版本随之删除
+	if d.Versions != nil {
+		if err := d.Versions.Remove(name); err != nil {
+			return err
+		}
+	}
+
+	if err := d.Quota.Removed(d.Namespace, slashClean(name), removed); err != nil {
+		return err
+	}
+
+	return d.Props.Delete(d.Namespace, slashClean(name))
+}
+
+func (d WebDavDir) Rename(ctx context.Context, oldName, newName string) error {
+	if isReserved(oldName) || isReserved(newName) {
+		return os.ErrPermission
+	}
+
+	if err := d.Dir.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+
+	if d.Versions != nil {
+		if err := d.Versions.Move(oldName, newName); err != nil {
+			return err
+		}
+	}
+
+	if err := d.Quota.Moved(d.Namespace, slashClean(oldName), slashClean(newName)); err != nil {
+		return err
+	}
+
+	return d.Props.Move(d.Namespace, slashClean(oldName), slashClean(newName))
+}
+
+// RestoreTrash 将回收站中的文件恢复到原来的位置，回收站中的文件已经计入用量，恢复时不再检查配额
+func (d WebDavDir) RestoreTrash(ctx context.Context, item trash.Item) error {
+	if d.Trash == nil {
+		return trash.ErrNotFound
+	}
+
+	if err := d.Trash.Restore(item); err != nil {
+		return err
+	}
+
+	if err := d.Quota.Moved(d.Namespace, item.DataPath(), item.Path); err != nil {
+		return err
+	}
+
+	return d.Props.Move(d.Namespace, item.DataPath(), item.Path)
+}
+
+// PurgeTrash 永久删除回收站中的文件，同时释放文件占用的用量
+func (d WebDavDir) PurgeTrash(item trash.Item) error {
+	if d.Trash == nil {
+		return trash.ErrNotFound
+	}
+
+	var removed quota.Usage
+	if d.Quota.Enabled() {
+		usage, err := d.DiskUsage(context.Background(), item.DataPath(), true)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		removed = usage
+	}
+
+	if err := d.Trash.Purge(item); err != nil {
+		return err
+	}
+
+	if err := d.Quota.Removed(d.Namespace, item.DataPath(), removed); err != nil {
+		return err
+	}
+
+	return d.Props.Delete(d.Namespace, item.DataPath())
+}
+
+// chargeTree 将 name 以及其子孙资源的所有者变更为 user，资源已经计入共享的用量
+func (d WebDavDir) chargeTree(ctx context.Context, name string, user *auth.AuthedUser) error {
+	info, err := d.Dir.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	if info.Mode().IsRegular() {
+		size = info.Size()
+	}
+
+	if err := d.Quota.Written(d.Namespace, slashClean(name), user, size, size, false); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	f, err := d.Dir.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	children, err := f.Readdir(-1)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := d.chargeTree(ctx, path.Join(name, child.Name()), user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CopyProps 复制资源的 dead property，webdav.Handler 在 COPY 时只会复制文件的 dead property，
+// 目录的 dead property 需要在 COPY 完成后单独复制
+func (d WebDavDir) CopyProps(src, dst string, recursive bool) error {
+	return d.Props.Copy(d.Namespace, slashClean(src), slashClean(dst), recursive)
+}
+
+// CheckWrite 检查将 name 写入为 size 字节的文件是否会超出配额，size 小于 0 表示大小未知，只检查文件数
+func (d WebDavDir) CheckWrite(ctx context.Context, name string, size int64) error {
+	if !d.Quota.Enabled() {
+		return nil
+	}
+
+	var delta quota.Usage
+	info, err := d.Dir.Stat(ctx, name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		delta.Files = 1
+	} else if info.IsDir() {
+		return nil
+	}
+
+	if size > 0 {
+		delta.Bytes = size
+		if info != nil {
+			delta.Bytes -= info.Size()
+		}
+	}
+
+	return d.Quota.Check(d.Share, d.Namespace, requestStateFrom(ctx).user, delta)
+}
+
+// Replace 将 src 的内容写入目标目录下的临时文件，写入完成并 fsync 之后通过 rename 原子替换 name，
+// 写入失败时原文件保持不变
+func (d WebDavDir) Replace(ctx context.Context, name string, src io.Reader) error {
+	if isReserved(name) {
+		return os.ErrPermission
+	}
+
+	target := d.resolve(name)
+	if target == "" {
+		return os.ErrNotExist
+	}
+
+	var oldSize int64
+	created := true
+	if info, err := os.Stat(target); err == nil {
+		if info.IsDir() {
+			return os.ErrExist
+		}
+
+		oldSize, created = info.Size(), false
+	}
+
+	tmp, err := createTempFile(target)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, src)
+	if err == nil && d.Versions != nil {
+		_, err = d.Versions.Archive(name)
 	}
 
-	file, err := d.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := commitTempFile(tmp, target); err != nil {
+		return err
+	}
+
+	return d.Quota.Written(d.Namespace, slashClean(name), requestStateFrom(ctx).user, oldSize, size, created)
+}
+
+// createAtomic 为 PUT 创建原子写入的文件，内容写入目标目录下的临时文件，关闭时替换目标文件
+func (d WebDavDir) createAtomic(name string, state *requestState) (webdav.File, error) {
+	target := d.resolve(name)
+	if target == "" {
+		return nil, os.ErrNotExist
+	}
+
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+
+	tmp, err := createTempFile(target)
 	if err != nil {
 		return nil, err
 	}
 
-	return WebDavFile{File: file}, nil
+	return &atomicFile{File: tmp, dir: d, name: name, target: target, state: state}, nil
+}
+
+// archive 将文件当前的内容保存为历史版本，历史版本为硬链接时重新创建原文件，避免截断文件时同时修改历史版本
+func (d WebDavDir) archive(name string) error {
+	target := d.resolve(name)
+	info, err := os.Lstat(target)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	linked, err := d.Versions.Archive(name)
+	if err != nil || !linked {
+		return err
+	}
+
+	if err := os.Remove(target); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Chmod(target, info.Mode().Perm())
+}
+
+// resolve 与 webdav.Dir 一致，将资源名称转换为本地文件路径，名称不合法时返回空字符串
+func (d WebDavDir) resolve(name string) string {
+	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) || strings.Contains(name, "\x00") {
+		return ""
+	}
+
+	dir := string(d.Dir)
+	if dir == "" {
+		dir = "."
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(slashClean(name)))
+}
+
+// DiskUsage 计算资源占用的字节数以及文件数（包含目录自身），recursive 为 false 时只计算资源自身
+func (d WebDavDir) DiskUsage(ctx context.Context, name string, recursive bool) (quota.Usage, error) {
+	var usage quota.Usage
+	info, err := d.Dir.Stat(ctx, name)
+	if err != nil {
+		return usage, err
+	}
+
+	usage.Files = 1
+	if info.Mode().IsRegular() {
+		usage.Bytes = info.Size()
+	}
+
+	if !info.IsDir() || !recursive {
+		return usage, nil
+	}
+
+	f, err := d.Dir.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return usage, err
+	}
+
+	children, err := f.Readdir(-1)
+	_ = f.Close()
+	if err != nil {
+		return usage, err
+	}
+
+	for _, child := range children {
+		childUsage, err := d.DiskUsage(ctx, path.Join(name, child.Name()), true)
+		if err != nil {
+			return usage, err
+		}
+
+		usage.Bytes += childUsage.Bytes
+		usage.Files += childUsage.Files
+	}
+
+	return usage, nil
 }
 
 type WebDavFile struct {
 	webdav.File
+	dir   WebDavDir
+	name  string
+	state *requestState
+	// filter 文件由用户请求打开，Readdir 只返回用户可见的文件
+	filter bool
 }
 
 func (f WebDavFile) Stat() (os.FileInfo, error) {
 	info, err := f.File.Stat()
-	if err != nil {
-		return nil, err
+	if err != nil || !f.dir.NoSniff {
+		return info, err
 	}
 
 	return NoSniffFileInfo{info}, nil
 }
 
+// Readdir 过滤临时文件、保留目录以及用户不可见（没有 list 或者 read 权限，或者匹配 hidden 规则）的文件，
+// PROPFIND、目录浏览、SEARCH、压缩包下载以及 COPY 都只能看到过滤后的结果
 func (f WebDavFile) Readdir(count int) (fis []os.FileInfo, err error) {
 	fis, err = f.File.Readdir(count)
+	if err != nil {
+		return fis, err
+	}
+
+	visible := fis[:0]
+	for _, info := range fis {
+		if isTempFile(info.Name()) || isReserved(path.Join(f.name, info.Name())) {
+			continue
+		}
+
+		if f.filter && f.dir.Share != nil {
+			requestPath := path.Join(f.dir.Share.Prefix, f.name, info.Name())
+			if info.IsDir() {
+				requestPath += "/"
+			}
+
+			if !f.state.user.CanSee(f.dir.Share, requestPath) {
+				continue
+			}
+		}
+
+		if f.dir.NoSniff {
+			info = NoSniffFileInfo{info}
+		}
+
+		visible = append(visible, info)
+	}
+	return visible, nil
+}
+
+// DeadProps 实现 webdav.DeadPropsHolder 接口，启用配额时，目录额外返回 RFC 4331 定义的配额属性
+func (f WebDavFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	properties, err := f.dir.Props.Get(f.dir.Namespace, f.name)
+	if err != nil || !f.dir.Quota.Enabled() {
+		return properties, err
+	}
+
+	if info, err := f.File.Stat(); err != nil || !info.IsDir() {
+		return properties, nil
+	}
+
+	available, used, limited, err := f.dir.Quota.Available(f.dir.Share, f.dir.Namespace, f.state.user)
 	if err != nil {
 		return nil, err
 	}
 
-	for i := range fis {
-		fis[i] = NoSniffFileInfo{fis[i]}
+	if properties == nil {
+		properties = make(map[xml.Name]webdav.Property)
+	}
+
+	properties[quotaUsedBytes] = webdav.Property{XMLName: quotaUsedBytes, InnerXML: []byte(strconv.FormatInt(used, 10))}
+	if limited {
+		properties[quotaAvailableBytes] = webdav.Property{XMLName: quotaAvailableBytes, InnerXML: []byte(strconv.FormatInt(available, 10))}
+	}
+
+	return properties, nil
+}
+
+// Patch 实现 webdav.DeadPropsHolder 接口
+func (f WebDavFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return f.dir.Props.Patch(f.dir.Namespace, f.name, patches)
+}
+
+// quotaFile 以写模式打开的文件，写入时检查配额，关闭时更新用量
+type quotaFile struct {
+	WebDavFile
+	oldSize   int64
+	created   bool
+	truncated bool
+	written   bool
+	limited   bool
+	maxSize   int64
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	if f.limited {
+		pos, err := f.File.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+
+		if pos+int64(len(p)) > f.maxSize {
+			f.state.quotaExceeded = true
+			return 0, quota.ErrQuotaExceeded
+		}
+	}
+
+	f.written = true
+	return f.File.Write(p)
+}
+
+func (f *quotaFile) Close() error {
+	info, statErr := f.File.Stat()
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+
+	if statErr != nil || !(f.written || f.created || f.truncated) {
+		return statErr
+	}
+
+	return f.dir.Quota.Written(f.dir.Namespace, f.name, f.state.user, f.oldSize, info.Size(), f.created)
+}
+
+// atomicFile 原子写入的文件，内容写入临时文件，关闭时如果请求体完整读取、写入成功并且没有超出配额，
+// 则 fsync 之后 rename 替换目标文件，否则丢弃临时文件，目标文件保持不变
+type atomicFile struct {
+	*os.File
+	dir    WebDavDir
+	name   string
+	target string
+	state  *requestState
+	err    error
+}
+
+func (f *atomicFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		f.err = err
+	}
+
+	return n, err
+}
+
+func (f *atomicFile) Close() error {
+	defer os.Remove(f.File.Name())
+
+	err := f.err
+	if err == nil {
+		err = f.state.bodyErr
+	}
+
+	// 超出配额时 quotaFile 不会调用 Write，临时文件中只有部分内容
+	if err == nil && f.state.quotaExceeded {
+		err = quota.ErrQuotaExceeded
+	}
+
+	if err != nil {
+		_ = f.File.Close()
+		return err
+	}
+
+	if f.dir.Versions != nil {
+		if _, err := f.dir.Versions.Archive(f.name); err != nil {
+			_ = f.File.Close()
+			return err
+		}
+	}
+
+	return commitTempFile(f.File, f.target)
+}
+
+const (
+	// tempFilePrefix 原子写入时使用的临时文件名前缀，临时文件对客户端不可见
+	tempFilePrefix = ".webdav-upload-"
+	// reservedDir 共享目录中保留给服务端使用的目录，用于保存回收站等数据，对客户端不可见
+	reservedDir = "/.webdav"
+)
+
+// isReserved 判断资源是否为对客户端不可见的保留资源
+func isReserved(name string) bool {
+	name = slashClean(name)
+	return name == reservedDir || strings.HasPrefix(name, reservedDir+"/") || isTempFile(name)
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(path.Base(name), tempFilePrefix)
+}
+
+// createTempFile 在 target 所在的目录中创建临时文件，保证临时文件与 target 在同一个文件系统中
+func createTempFile(target string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(target), tempFilePrefix+"*")
+}
+
+// commitTempFile fsync 临时文件之后通过 rename 替换 target，target 已存在时保留其权限
+func commitTempFile(tmp *os.File, target string) error {
+	err := tmp.Sync()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+// cleanTempFiles 删除 scope 中超过 olderThan 未修改的临时文件，这些文件是服务异常退出或者上传中断时遗留的
+func cleanTempFiles(scope string, olderThan time.Duration) (int, error) {
+	removed := 0
+	err := filepath.Walk(scope, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.Mode().IsRegular() && isTempFile(info.Name()) && time.Since(info.ModTime()) > olderThan {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+		}
+
+		return nil
+	})
+
+	return removed, err
+}
+
+// slashClean is equivalent to but slightly more efficient than
+// path.Clean("/" + name).
+func slashClean(name string) string {
+	if name == "" || name[0] != '/' {
+		name = "/" + name
 	}
-	return fis, nil
+	return path.Clean(name)
 }
@@ -4,27 +4,42 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/mylxsw/webdav-server/internal/auth"
 	"github.com/mylxsw/webdav-server/internal/cache"
+	"github.com/mylxsw/webdav-server/internal/config"
 )
 
 type AuthService interface {
 	Login(username, password string) (*auth.AuthedUser, error)
+	// GetUser 查询用户当前的信息，用户不存在或者已经禁用时返回 auth.ErrNoSuchUser
+	GetUser(username string) (*auth.AuthedUser, error)
+	// Reload 配置重新加载后更新用户信息，并使所有缓存的登录信息失效
+	Reload(conf *config.Config)
 }
 
 type authService struct {
 	author auth.Author
 	cache  cache.Driver
+	// generation 缓存的登录信息的版本，配置重新加载或者用户信息变化后递增，旧版本的缓存不再使用
+	generation uint64
 }
 
 func NewAuthService(author auth.Author, cache cache.Driver) AuthService {
-	return &authService{author: author, cache: cache}
+	srv := &authService{author: author, cache: cache}
+
+	// 用户信息来自外部文件时，文件修改后同样使缓存的登录信息失效
+	if notifier, ok := author.(auth.Notifier); ok {
+		notifier.OnChange(srv.invalidate)
+	}
+
+	return srv
 }
 
 func (srv *authService) Login(username, password string) (*auth.AuthedUser, error) {
-	cacheKey := fmt.Sprintf("webdav:login:%s:%s", username, fmt.Sprintf("%x", md5.Sum([]byte(password+"-webdav.server"))))
+	cacheKey := fmt.Sprintf("webdav:login:%d:%s:%s", atomic.LoadUint64(&srv.generation), username, fmt.Sprintf("%x", md5.Sum([]byte(password+"-webdav.server"))))
 	cachedRaw, err := srv.cache.Get(cacheKey)
 	if err == nil {
 		var authedUser auth.AuthedUser
@@ -51,3 +66,45 @@ func (srv *authService) Login(username, password string) (*auth.AuthedUser, erro
 
 	return authedUser, nil
 }
+
+func (srv *authService) GetUser(username string) (*auth.AuthedUser, error) {
+	cacheKey := fmt.Sprintf("webdav:user:%d:%s", atomic.LoadUint64(&srv.generation), username)
+	cachedRaw, err := srv.cache.Get(cacheKey)
+	if err == nil {
+		var authedUser auth.AuthedUser
+		if err := json.Unmarshal([]byte(cachedRaw), &authedUser); err != nil {
+			return nil, err
+		}
+
+		return &authedUser, nil
+	}
+
+	authedUser, err := srv.author.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	authedUserRaw, err := json.Marshal(authedUser)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := srv.cache.Set(cacheKey, string(authedUserRaw), time.Minute); err != nil {
+		return nil, err
+	}
+
+	return authedUser, nil
+}
+
+func (srv *authService) Reload(conf *config.Config) {
+	if reloadable, ok := srv.author.(auth.Reloadable); ok {
+		reloadable.Reload(conf)
+	}
+
+	srv.invalidate()
+}
+
+// invalidate 使所有缓存的登录信息失效
+func (srv *authService) invalidate() {
+	atomic.AddUint64(&srv.generation, 1)
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"github.com/mylxsw/glacier/infra"
+	"github.com/mylxsw/webdav-server/internal/config"
 )
 
 type Provider struct{}
@@ -9,3 +10,9 @@ type Provider struct{}
 func (p Provider) Register(cc infra.Binder) {
 	cc.MustSingletonOverride(NewAuthService)
 }
+
+func (p Provider) Boot(resolver infra.Resolver) {
+	resolver.MustResolve(func(reloader *config.Reloader, authSrv AuthService) {
+		reloader.OnReload(authSrv.Reload)
+	})
+}
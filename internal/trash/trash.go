@@ -0,0 +1,223 @@
+package trash
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dir 回收站在共享目录中的位置，每个用户删除的文件保存在 Dir/<account>/<id> 中
+const Dir = "/.webdav/trash"
+
+var ErrNotFound = errors.New("trash item not found")
+
+// Item 回收站中的一个文件或者目录
+type Item struct {
+	ID string `json:"id"`
+	// Account 删除文件的用户
+	Account string `json:"account"`
+	// Path 文件删除前在共享目录中的路径
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// DataPath 回收站中文件内容在共享目录中的路径
+func (item Item) DataPath() string {
+	return path.Join(Dir, url.PathEscape(item.Account), item.ID, "data")
+}
+
+// Trash 共享目录的回收站
+type Trash struct {
+	scope string
+}
+
+// New 创建 scope 目录的回收站
+func New(scope string) *Trash {
+	return &Trash{scope: scope}
+}
+
+// Move 将共享目录中的 name 移动到 account 的回收站
+func (t *Trash) Move(name string, account string) (Item, error) {
+	name = path.Clean("/" + name)
+	if name == "/" || name == Dir || strings.HasPrefix(name, Dir+"/") {
+		return Item{}, os.ErrInvalid
+	}
+
+	info, err := os.Lstat(t.local(name))
+	if err != nil {
+		return Item{}, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Item{}, err
+	}
+
+	item := Item{ID: id, Account: account, Path: name, IsDir: info.IsDir(), DeletedAt: time.Now()}
+	itemDir := filepath.Dir(t.local(item.DataPath()))
+	if err := os.MkdirAll(itemDir, 0700); err != nil {
+		return Item{}, err
+	}
+
+	if err := os.Rename(t.local(name), t.local(item.DataPath())); err != nil {
+		_ = os.RemoveAll(itemDir)
+		return Item{}, err
+	}
+
+	item.Size = diskUsage(t.local(item.DataPath()))
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return Item{}, err
+	}
+
+	if err := os.WriteFile(filepath.Join(itemDir, "info.json"), data, 0600); err != nil {
+		return Item{}, err
+	}
+
+	return item, nil
+}
+
+// List 返回 account 回收站中的所有文件，account 为空时返回所有用户的文件，按照删除时间倒序排列
+func (t *Trash) List(account string) ([]Item, error) {
+	pattern := filepath.Join(t.local(Dir), "*", "*", "info.json")
+	if account != "" {
+		pattern = filepath.Join(t.local(Dir), url.PathEscape(account), "*", "info.json")
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, 0, len(matches))
+	for _, match := range matches {
+		item, err := readItem(match)
+		if err != nil {
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+
+	return items, nil
+}
+
+// Get 查找 account 回收站中的文件，account 为空时在所有用户的回收站中查找
+func (t *Trash) Get(account string, id string) (Item, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return Item{}, ErrNotFound
+	}
+
+	items, err := t.List(account)
+	if err != nil {
+		return Item{}, err
+	}
+
+	for _, item := range items {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+
+	return Item{}, ErrNotFound
+}
+
+// Restore 将回收站中的文件恢复到原来的位置，原位置已经存在文件时返回 os.ErrExist
+func (t *Trash) Restore(item Item) error {
+	target := t.local(item.Path)
+	if _, err := os.Lstat(target); err == nil {
+		return os.ErrExist
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(t.local(item.DataPath()), target); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Dir(t.local(item.DataPath())))
+}
+
+// Purge 永久删除回收站中的文件
+func (t *Trash) Purge(item Item) error {
+	return os.RemoveAll(filepath.Dir(t.local(item.DataPath())))
+}
+
+// Expired 返回删除时间超过 retention 的文件
+func (t *Trash) Expired(retention time.Duration) ([]Item, error) {
+	items, err := t.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make([]Item, 0)
+	for _, item := range items {
+		if time.Since(item.DeletedAt) > retention {
+			expired = append(expired, item)
+		}
+	}
+
+	return expired, nil
+}
+
+func (t *Trash) local(name string) string {
+	return filepath.Join(t.scope, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func readItem(infoPath string) (Item, error) {
+	var item Item
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return item, err
+	}
+
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, err
+	}
+
+	// 目录名称以 info.json 所在的位置为准，避免 info.json 被篡改后操作其它目录
+	item.ID = filepath.Base(filepath.Dir(infoPath))
+	if account, err := url.PathUnescape(filepath.Base(filepath.Dir(filepath.Dir(infoPath)))); err == nil {
+		item.Account = account
+	}
+
+	return item, nil
+}
+
+func diskUsage(p string) int64 {
+	var size int64
+	_ = filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
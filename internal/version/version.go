@@ -0,0 +1,262 @@
+package version
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dir 历史版本在共享目录中的位置，文件 /a/b.txt 的历史版本保存为 Dir/a/b.txt/<id>.version
+const Dir = "/.webdav/versions"
+
+const suffix = ".version"
+
+var ErrNotFound = errors.New("version not found")
+
+// Version 文件的一个历史版本
+type Version struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+	// ModTime 该版本被覆盖之前的最后修改时间
+	ModTime time.Time `json:"modified"`
+	// CreatedAt 该版本被覆盖，保存为历史版本的时间
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store 共享目录中文件的历史版本
+type Store struct {
+	scope       string
+	maxVersions int
+	maxAge      time.Duration
+}
+
+// New 创建 scope 目录的历史版本存储，每个文件最多保留 maxVersions 个版本，maxAge 为 0 时不限制保留时间
+func New(scope string, maxVersions int, maxAge time.Duration) *Store {
+	return &Store{scope: scope, maxVersions: maxVersions, maxAge: maxAge}
+}
+
+// Archive 将文件当前的内容保存为历史版本，文件不存在或者不是普通文件时忽略
+//
+// 优先使用硬链接保存，linked 为 true 时历史版本与文件共享同一个 inode，
+// 调用方在写入新内容之前必须先删除原文件，不能直接截断
+func (s *Store) Archive(name string) (linked bool, err error) {
+	src := s.local(name)
+	info, err := os.Lstat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+
+	dir := s.local(path.Join(Dir, name))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, err
+	}
+
+	dst := filepath.Join(dir, strconv.FormatInt(time.Now().UnixNano(), 10)+suffix)
+	if err := os.Link(src, dst); err == nil {
+		linked = true
+	} else if err := copyFile(src, dst, info); err != nil {
+		return false, err
+	}
+
+	return linked, s.prune(name)
+}
+
+// List 返回文件所有的历史版本，按照时间倒序排列
+func (s *Store) List(name string) ([]Version, error) {
+	entries, err := os.ReadDir(s.local(path.Join(Dir, name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Version{}, nil
+		}
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), suffix)
+		created, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		versions = append(versions, Version{
+			ID:        id,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+			CreatedAt: time.Unix(0, created),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].CreatedAt.After(versions[j].CreatedAt)
+	})
+
+	return versions, nil
+}
+
+// Open 打开文件指定的历史版本
+func (s *Store) Open(name string, id string) (*os.File, Version, error) {
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return nil, Version{}, ErrNotFound
+	}
+
+	versions, err := s.List(name)
+	if err != nil {
+		return nil, Version{}, err
+	}
+
+	for _, v := range versions {
+		if v.ID != id {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(s.local(path.Join(Dir, name)), id+suffix))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, v, ErrNotFound
+			}
+			return nil, v, err
+		}
+
+		return f, v, nil
+	}
+
+	return nil, Version{}, ErrNotFound
+}
+
+// Move 文件或者目录移动后，历史版本随之移动，目标位置原有的历史版本被删除
+func (s *Store) Move(oldName string, newName string) error {
+	src, dst := s.local(path.Join(Dir, oldName)), s.local(path.Join(Dir, newName))
+	if _, err := os.Lstat(src); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	return os.Rename(src, dst)
+}
+
+// Remove 删除文件或者目录（包含子孙文件）所有的历史版本
+func (s *Store) Remove(name string) error {
+	if path.Clean("/"+name) == "/" {
+		return nil
+	}
+
+	return os.RemoveAll(s.local(path.Join(Dir, name)))
+}
+
+// Expire 删除所有超过保留时间的历史版本，包括已经删除的文件遗留的历史版本
+func (s *Store) Expire() (int, error) {
+	if s.maxAge <= 0 {
+		return 0, nil
+	}
+
+	removed := 0
+	err := filepath.Walk(s.local(Dir), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), suffix) {
+			return nil
+		}
+
+		created, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), suffix), 10, 64)
+		if err != nil || time.Since(time.Unix(0, created)) <= s.maxAge {
+			return nil
+		}
+
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		removed++
+		return nil
+	})
+
+	return removed, err
+}
+
+// prune 删除超出数量或者超过保留时间的历史版本
+func (s *Store) prune(name string) error {
+	versions, err := s.List(name)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range versions {
+		if i < s.maxVersions && (s.maxAge <= 0 || time.Since(v.CreatedAt) <= s.maxAge) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.local(path.Join(Dir, name)), v.ID+suffix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) local(name string) string {
+	return filepath.Join(s.scope, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// copyFile 复制文件内容，并且保留原文件的修改时间
+func copyFile(src string, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}